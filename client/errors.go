@@ -0,0 +1,86 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"vk-feed/types"
+)
+
+var (
+	ErrBadRequest       = errors.New("request is invalid")
+	ErrUnauthorized     = errors.New("access token is missing or expired")
+	ErrWrongCredentials = errors.New("wrong credentials")
+	ErrNotFound         = errors.New("not found")
+	ErrConflict         = errors.New("already exists")
+	ErrUnprocessable    = errors.New("rejected by the server")
+	ErrTooLarge         = errors.New("request body is too large")
+	ErrServer           = errors.New("server error")
+	ErrUnexpectedStatus = errors.New("unexpected status")
+	ErrNoCredentials    = errors.New("no credentials to sign in with")
+)
+
+// Error is returned for every non successful response. It unwraps to one of
+// the sentinel errors above, so callers can use errors.Is.
+type Error struct {
+	StatusCode int
+	// Message, Code, Field and Errors are decoded from the JSON error
+	// body, see types.ApiError. Bodies that are not such JSON, e.g. from a
+	// proxy in front of the API, end up in Message as is.
+	Message string
+	Code    types.ApiErrorCode
+	// Field names the request field the error is about, if any.
+	Field string
+	// Errors lists the rejected body fields or query parameters.
+	Errors []types.ApiFieldError
+	kind   error
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%s (%d)", e.kind, e.StatusCode)
+	}
+	return fmt.Sprintf("%s (%d): %s", e.kind, e.StatusCode, e.Message)
+}
+
+func (e *Error) Unwrap() error {
+	return e.kind
+}
+
+func newError(status int, message string, signin bool) *Error {
+	var kind error
+	switch {
+	case status == http.StatusBadRequest:
+		kind = ErrBadRequest
+	case status == http.StatusUnauthorized:
+		kind = ErrUnauthorized
+	case status == http.StatusNotFound && signin:
+		kind = ErrWrongCredentials
+	case status == http.StatusNotFound:
+		kind = ErrNotFound
+	case status == http.StatusConflict:
+		kind = ErrConflict
+	case status == http.StatusUnprocessableEntity:
+		kind = ErrUnprocessable
+	case status == http.StatusRequestEntityTooLarge:
+		kind = ErrTooLarge
+	case status >= 500:
+		kind = ErrServer
+	default:
+		kind = ErrUnexpectedStatus
+	}
+	return &Error{StatusCode: status, Message: message, kind: kind}
+}
+
+// responseError reads the error from a response body, structured or not.
+func responseError(status int, payload []byte, signin bool) *Error {
+	var apiErr types.ApiError
+	if err := json.Unmarshal(payload, &apiErr); err == nil && apiErr.Code != "" {
+		e := newError(status, apiErr.Message, signin)
+		e.Code, e.Field, e.Errors = apiErr.Code, apiErr.Field, apiErr.Errors
+		return e
+	}
+	return newError(status, strings.TrimSpace(string(payload)), signin)
+}
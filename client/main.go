@@ -0,0 +1,352 @@
+// Package client is a typed client of the vk-feed API v1.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"vk-feed/health"
+	"vk-feed/types"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const apiPrefix = "/v1"
+
+// tokens expiring sooner than this are refreshed before the request is sent
+const refreshSkew = 30 * time.Second
+
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+	retries    int
+	backoff    time.Duration
+
+	mu       sync.Mutex
+	token    string
+	name     string
+	password string
+}
+
+type Option func(c *Client)
+
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithRetries sets how many times idempotent calls are retried on network
+// errors and 5xx responses. The delay starts at backoff and doubles with
+// every attempt.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.backoff = backoff
+	}
+}
+
+// WithCredentials lets the client sign in on its own when the token is
+// missing, about to expire or rejected by the server.
+func WithCredentials(name, password string) Option {
+	return func(c *Client) {
+		c.name = name
+		c.password = password
+	}
+}
+
+// WithToken sets the access token obtained elsewhere.
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// New creates a client of the API served at baseURL, e.g.
+// "https://feed.example.com" or "http://localhost:6969/api".
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	c := &Client{
+		baseURL:    u,
+		httpClient: http.DefaultClient,
+		retries:    2,
+		backoff:    100 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// Token returns the current access token, empty if the client has not
+// signed in yet.
+func (c *Client) Token() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token
+}
+
+func (c *Client) SignUp(ctx context.Context, name, password string) (types.User, error) {
+	var user types.User
+	err := c.do(ctx, request{method: "POST", path: apiPrefix + "/signup", body: types.SignDto{Name: name, Password: password}}, &user)
+	return user, err
+}
+
+// SignIn obtains an access token and remembers the credentials to refresh
+// it later.
+func (c *Client) SignIn(ctx context.Context, name, password string) (types.Token, error) {
+	var token types.Token
+	err := c.do(ctx, request{method: "POST", path: apiPrefix + "/signin", body: types.SignDto{Name: name, Password: password}, signin: true}, &token)
+	if err != nil {
+		return types.Token{}, err
+	}
+	c.mu.Lock()
+	c.token = token.Token
+	c.name = name
+	c.password = password
+	c.mu.Unlock()
+	return token, nil
+}
+
+func (c *Client) CreateAd(ctx context.Context, dto types.AdDto) (types.Ad, error) {
+	var ad types.Ad
+	err := c.do(ctx, request{method: "POST", path: apiPrefix + "/ads", body: dto, auth: authRequired}, &ad)
+	return ad, err
+}
+
+// ListAds returns a page of the feed. Zero valued params are left to the
+// server defaults, PageSize is configured on the server and ignored. Lat and
+// Lon are only sent with Near.
+func (c *Client) ListAds(ctx context.Context, params types.GetAdParams) ([]types.AdFeed, error) {
+	q := url.Values{}
+	if params.Page != 0 {
+		q.Set("page", strconv.Itoa(params.Page))
+	}
+	if params.SortBy != "" {
+		q.Set("sort_by", string(params.SortBy))
+	}
+	if params.OrderBy != "" {
+		q.Set("order_by", string(params.OrderBy))
+	}
+	if params.MinPrice != 0 {
+		q.Set("min_price", strconv.Itoa(params.MinPrice))
+	}
+	if params.MaxPrice != 0 {
+		q.Set("max_price", strconv.Itoa(params.MaxPrice))
+	}
+	if !params.CreatedAfter.IsZero() {
+		q.Set("created_after", params.CreatedAfter.Format(time.RFC3339Nano))
+	}
+	if !params.CreatedBefore.IsZero() {
+		q.Set("created_before", params.CreatedBefore.Format(time.RFC3339Nano))
+	}
+	if params.AuthorId != 0 {
+		q.Set("author_id", strconv.Itoa(params.AuthorId))
+	}
+	if params.OnlyMine {
+		q.Set("only_mine", "true")
+	}
+	if params.ExcludeMine {
+		q.Set("exclude_mine", "true")
+	}
+	if params.HasImage != types.IMAGE_ANY {
+		q.Set("has_image", string(params.HasImage))
+	}
+	if params.Near {
+		q.Set("lat", strconv.FormatFloat(params.Lat, 'f', -1, 64))
+		q.Set("lon", strconv.FormatFloat(params.Lon, 'f', -1, 64))
+	}
+	if params.RadiusKm != 0 {
+		q.Set("radius_km", strconv.FormatFloat(params.RadiusKm, 'f', -1, 64))
+	}
+	var feed []types.AdFeed
+	err := c.do(ctx, request{method: "GET", path: apiPrefix + "/ads", query: q, auth: authOptional, idempotent: true}, &feed)
+	return feed, err
+}
+
+// Readiness reports whether the server is ready to take traffic. The
+// report is returned along with ErrServer when it is not.
+func (c *Client) Readiness(ctx context.Context) (health.Report, error) {
+	var report health.Report
+	status, payload, err := c.send(ctx, request{method: "GET", path: "/readyz"}, nil, "")
+	if err != nil {
+		return report, err
+	}
+	if err := json.Unmarshal(payload, &report); err != nil {
+		return report, newError(status, strings.TrimSpace(string(payload)), false)
+	}
+	if status >= 300 {
+		return report, newError(status, report.Status, false)
+	}
+	return report, nil
+}
+
+// Spec returns the OpenAPI specification served by the API.
+func (c *Client) Spec(ctx context.Context) ([]byte, error) {
+	var spec []byte
+	err := c.do(ctx, request{method: "GET", path: "/openapi.yaml", idempotent: true}, &spec)
+	return spec, err
+}
+
+type authMode int
+
+const (
+	authNone authMode = iota
+	authOptional
+	authRequired
+)
+
+type request struct {
+	method     string
+	path       string
+	query      url.Values
+	body       any
+	auth       authMode
+	idempotent bool
+	signin     bool
+}
+
+func (c *Client) do(ctx context.Context, req request, out any) error {
+	var body []byte
+	if req.body != nil {
+		var err error
+		if body, err = json.Marshal(req.body); err != nil {
+			return err
+		}
+	}
+	token, err := c.authToken(ctx, req.auth)
+	if err != nil {
+		return err
+	}
+	status, payload, err := c.send(ctx, req, body, token)
+	if err == nil && status == http.StatusUnauthorized && req.auth != authNone && c.hasCredentials() {
+		if token, err = c.refresh(ctx); err != nil {
+			return err
+		}
+		status, payload, err = c.send(ctx, req, body, token)
+	}
+	if err != nil {
+		return err
+	}
+	if status >= 300 {
+		return responseError(status, payload, req.signin)
+	}
+	switch out := out.(type) {
+	case nil:
+		return nil
+	case *[]byte:
+		*out = payload
+		return nil
+	default:
+		return json.Unmarshal(payload, out)
+	}
+}
+
+// send performs the request, retrying idempotent ones on network errors
+// and 5xx responses.
+func (c *Client) send(ctx context.Context, req request, body []byte, token string) (int, []byte, error) {
+	attempts := 1
+	if req.idempotent {
+		attempts += c.retries
+	}
+	delay := c.backoff
+	for i := 0; ; i++ {
+		status, payload, err := c.sendOnce(ctx, req, body, token)
+		retryable := err != nil || status >= 500
+		if !retryable || i+1 >= attempts || ctx.Err() != nil {
+			return status, payload, err
+		}
+		select {
+		case <-ctx.Done():
+			return 0, nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (c *Client) sendOnce(ctx context.Context, req request, body []byte, token string) (int, []byte, error) {
+	u := *c.baseURL
+	u.Path += req.path
+	u.RawQuery = req.query.Encode()
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	r, err := http.NewRequestWithContext(ctx, req.method, u.String(), reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	if body != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := c.httpClient.Do(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	payload, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, payload, nil
+}
+
+// authToken returns the token to send, signing in first when the token is
+// missing or about to expire and the credentials are known.
+func (c *Client) authToken(ctx context.Context, mode authMode) (string, error) {
+	if mode == authNone {
+		return "", nil
+	}
+	c.mu.Lock()
+	token := c.token
+	c.mu.Unlock()
+	if token != "" && !expiresSoon(token) {
+		return token, nil
+	}
+	if !c.hasCredentials() {
+		if token == "" && mode == authRequired {
+			return "", ErrNoCredentials
+		}
+		return token, nil
+	}
+	return c.refresh(ctx)
+}
+
+func (c *Client) refresh(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	name, password := c.name, c.password
+	c.mu.Unlock()
+	token, err := c.SignIn(ctx, name, password)
+	return token.Token, err
+}
+
+func (c *Client) hasCredentials() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.name != "" && c.password != ""
+}
+
+// expiresSoon reads the exp claim without verifying the signature, the
+// client has no key and the server checks the token anyway.
+func expiresSoon(token string) bool {
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(token, claims); err != nil {
+		return false
+	}
+	exp, err := claims.GetExpirationTime()
+	if err != nil || exp == nil {
+		return false
+	}
+	return time.Until(exp.Time) < refreshSkew
+}
@@ -0,0 +1,375 @@
+package client
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"vk-feed/config"
+	"vk-feed/db"
+	"vk-feed/health"
+	"vk-feed/openapi"
+	"vk-feed/service"
+	"vk-feed/types"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+const jwtSecret = "mock_secret_mock_secret_mock_secret"
+
+type mockDB struct {
+	params *types.GetAdParams
+}
+
+func (m mockDB) CreateUser(ctx context.Context, name, password string) (int, error) {
+	if name == "existing_name" {
+		return 0, &db.ConstraintError{Kind: db.ErrConflict, Table: "usrs", Constraint: "usrs_name_key", Column: "name"}
+	}
+	return 1, nil
+}
+
+func (m mockDB) GetUserByName(ctx context.Context, name string) (int, string, error) {
+	if name != "mock_name" {
+		return 0, "", db.ErrNotFound
+	}
+	temp := sha512.Sum512([]byte("mock_password"))
+	return 1, base64.StdEncoding.EncodeToString(temp[:]), nil
+}
+
+func (m mockDB) GetUserById(ctx context.Context, id int) (types.User, error) {
+	return types.User{Id: id, Name: "mock_name"}, nil
+}
+
+func (m mockDB) GetUserPassword(ctx context.Context, id int) (string, error) {
+	temp := sha512.Sum512([]byte("mock_password"))
+	return base64.StdEncoding.EncodeToString(temp[:]), nil
+}
+
+func (m mockDB) DeleteUser(ctx context.Context, id int) error { return nil }
+
+func (m mockDB) ScheduleUserDeletion(ctx context.Context, id int, at time.Time) error { return nil }
+
+func (m mockDB) CancelUserDeletion(ctx context.Context, id int) error { return nil }
+
+func (m mockDB) PurgeUsers(ctx context.Context, before time.Time) (int64, error) { return 0, nil }
+
+func (m mockDB) CreateAd(ctx context.Context, dto types.AdDto, userId int) (int, error) {
+	return 1, nil
+}
+
+func (m mockDB) CreateAds(ctx context.Context, dtos []types.AdDto, userId int) ([]int, error) {
+	ids := make([]int, len(dtos))
+	for i := range ids {
+		ids[i] = i + 1
+	}
+	return ids, nil
+}
+
+func (m mockDB) GetAds(ctx context.Context, userId int, params types.GetAdParams) ([]types.AdFeed, error) {
+	if m.params != nil {
+		*m.params = params
+	}
+	return []types.AdFeed{{
+		Id:        1,
+		Title:     "mock_title",
+		Content:   "mock_content",
+		ImageUrl:  "http://mocksite.com/image.jpg",
+		Price:     6969,
+		CreatedAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		AuthorId:  1,
+		IsYours:   userId == 1,
+	}}, nil
+}
+
+func (m mockDB) ForEachUserAd(ctx context.Context, userId int, fn func(types.AdFeed) error) error {
+	return nil
+}
+
+type mockIC struct{}
+
+func (mockIC) Check(ctx context.Context, url string) error { return nil }
+
+func newServer(t *testing.T, db mockDB) *httptest.Server {
+	cfg := config.Default()
+	cfg.JwtSecret = jwtSecret
+	h, err := service.NewHandler(service.WithDB(db), service.WithImageChecker(mockIC{}), service.WithConfig(cfg))
+	assert.NoError(t, err)
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+var ad = types.AdDto{
+	Title:    "mock_title",
+	Content:  "mock_content",
+	ImageUrl: "http://mocksite.com/image.jpg",
+	Price:    6969,
+}
+
+func TestAuth(t *testing.T) {
+	srv := newServer(t, mockDB{})
+	ctx := context.Background()
+	t.Run("Sign up", func(t *testing.T) {
+		c, _ := New(srv.URL)
+		user, err := c.SignUp(ctx, "mock_name", "mock_password")
+		assert.NoError(t, err)
+		assert.Equal(t, types.User{Id: 1, Name: "mock_name"}, user)
+	})
+	t.Run("Sign up taken name", func(t *testing.T) {
+		c, _ := New(srv.URL)
+		_, err := c.SignUp(ctx, "existing_name", "mock_password")
+		assert.ErrorIs(t, err, ErrConflict)
+		var apiErr *Error
+		if assert.ErrorAs(t, err, &apiErr) {
+			assert.Equal(t, "name", apiErr.Field)
+		}
+	})
+	t.Run("Sign in", func(t *testing.T) {
+		c, _ := New(srv.URL)
+		token, err := c.SignIn(ctx, "mock_name", "mock_password")
+		assert.NoError(t, err)
+		assert.NotEmpty(t, token.Token)
+		assert.Equal(t, token.Token, c.Token())
+	})
+	t.Run("Wrong credentials", func(t *testing.T) {
+		c, _ := New(srv.URL)
+		_, err := c.SignIn(ctx, "wrong_name", "mock_password")
+		assert.ErrorIs(t, err, ErrWrongCredentials)
+		assert.Empty(t, c.Token())
+	})
+	t.Run("No credentials", func(t *testing.T) {
+		c, _ := New(srv.URL)
+		_, err := c.CreateAd(ctx, ad)
+		assert.ErrorIs(t, err, ErrNoCredentials)
+	})
+	t.Run("Signs in on demand", func(t *testing.T) {
+		c, _ := New(srv.URL, WithCredentials("mock_name", "mock_password"))
+		created, err := c.CreateAd(ctx, ad)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, created.Id)
+		assert.NotEmpty(t, c.Token())
+	})
+	t.Run("Refreshes rejected token", func(t *testing.T) {
+		c, _ := New(srv.URL, WithToken("monke"), WithCredentials("mock_name", "mock_password"))
+		_, err := c.CreateAd(ctx, ad)
+		assert.NoError(t, err)
+		assert.NotEqual(t, "monke", c.Token())
+	})
+	t.Run("Refreshes expiring token", func(t *testing.T) {
+		expired, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"sub": 1,
+			"exp": time.Now().Add(time.Second).Unix(),
+		}).SignedString([]byte(jwtSecret))
+		c, _ := New(srv.URL, WithToken(expired), WithCredentials("mock_name", "mock_password"))
+		_, err := c.CreateAd(ctx, ad)
+		assert.NoError(t, err)
+		assert.NotEqual(t, expired, c.Token())
+	})
+	t.Run("Rejected token without credentials", func(t *testing.T) {
+		c, _ := New(srv.URL, WithToken("monke"))
+		_, err := c.CreateAd(ctx, ad)
+		assert.ErrorIs(t, err, ErrUnauthorized)
+	})
+}
+
+func TestCreateAd(t *testing.T) {
+	srv := newServer(t, mockDB{})
+	c, _ := New(srv.URL, WithCredentials("mock_name", "mock_password"))
+	t.Run("OK", func(t *testing.T) {
+		created, err := c.CreateAd(context.Background(), ad)
+		assert.NoError(t, err)
+		assert.Equal(t, types.Ad{Id: 1, Title: ad.Title, Content: ad.Content, ImageUrl: ad.ImageUrl, Price: ad.Price}, created)
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := c.CreateAd(context.Background(), types.AdDto{Title: "mock_title"})
+		assert.ErrorIs(t, err, ErrBadRequest)
+		var apiErr *Error
+		assert.True(t, errors.As(err, &apiErr))
+		assert.Equal(t, 400, apiErr.StatusCode)
+		assert.NotEmpty(t, apiErr.Message)
+	})
+}
+
+func TestListAds(t *testing.T) {
+	var params types.GetAdParams
+	srv := newServer(t, mockDB{params: &params})
+	t.Run("Anonymous", func(t *testing.T) {
+		c, _ := New(srv.URL)
+		feed, err := c.ListAds(context.Background(), types.GetAdParams{
+			Page:     2,
+			MinPrice: 10,
+			MaxPrice: 100,
+			SortBy:   types.SORT_BY_PRICE,
+			OrderBy:  types.ORDER_BY_DESC,
+		})
+		assert.NoError(t, err)
+		assert.Len(t, feed, 1)
+		assert.Equal(t, "http://mocksite.com/image.jpg", feed[0].ImageUrl)
+		assert.False(t, feed[0].IsYours)
+		assert.Equal(t, types.GetAdParams{
+			Page:     2,
+			PageSize: 10,
+			MinPrice: 10,
+			MaxPrice: 100,
+			SortBy:   types.SORT_BY_PRICE,
+			OrderBy:  types.ORDER_BY_DESC,
+		}, params)
+	})
+	t.Run("Authorized", func(t *testing.T) {
+		c, _ := New(srv.URL, WithCredentials("mock_name", "mock_password"))
+		feed, err := c.ListAds(context.Background(), types.GetAdParams{})
+		assert.NoError(t, err)
+		assert.True(t, feed[0].IsYours)
+	})
+	t.Run("Filters", func(t *testing.T) {
+		c, _ := New(srv.URL, WithCredentials("mock_name", "mock_password"))
+		after := time.Date(2024, 1, 1, 12, 30, 0, 0, time.UTC)
+		before := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+		_, err := c.ListAds(context.Background(), types.GetAdParams{
+			CreatedAfter:  after,
+			CreatedBefore: before,
+			AuthorId:      7,
+			ExcludeMine:   true,
+			HasImage:      types.IMAGE_WITHOUT,
+			Lat:           55.7558,
+			Lon:           37.6173,
+			Near:          true,
+			RadiusKm:      25,
+			SortBy:        types.SORT_BY_DISTANCE,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, after, params.CreatedAfter)
+		assert.Equal(t, before, params.CreatedBefore)
+		assert.Equal(t, 7, params.AuthorId)
+		assert.True(t, params.ExcludeMine)
+		assert.False(t, params.OnlyMine)
+		assert.Equal(t, types.IMAGE_WITHOUT, params.HasImage)
+		assert.True(t, params.Near)
+		assert.Equal(t, 55.7558, params.Lat)
+		assert.Equal(t, 37.6173, params.Lon)
+		assert.Equal(t, 25.0, params.RadiusKm)
+		assert.Equal(t, types.SORT_BY_DISTANCE, params.SortBy)
+	})
+	t.Run("Mounted under prefix", func(t *testing.T) {
+		mux := http.NewServeMux()
+		mux.Handle("/api/", http.StripPrefix("/api", srv.Config.Handler))
+		prefixed := httptest.NewServer(mux)
+		defer prefixed.Close()
+		c, _ := New(prefixed.URL + "/api/")
+		_, err := c.ListAds(context.Background(), types.GetAdParams{})
+		assert.NoError(t, err)
+	})
+}
+
+// flaky fails the first n requests with 503.
+func flaky(t *testing.T, n int32, next http.Handler) (*httptest.Server, *atomic.Int32) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= n {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func TestRetries(t *testing.T) {
+	api := newServer(t, mockDB{}).Config.Handler
+	t.Run("Idempotent call is retried", func(t *testing.T) {
+		srv, calls := flaky(t, 2, api)
+		c, _ := New(srv.URL, WithRetries(2, time.Millisecond))
+		_, err := c.ListAds(context.Background(), types.GetAdParams{})
+		assert.NoError(t, err)
+		assert.Equal(t, int32(3), calls.Load())
+	})
+	t.Run("Retries run out", func(t *testing.T) {
+		srv, calls := flaky(t, 5, api)
+		c, _ := New(srv.URL, WithRetries(2, time.Millisecond))
+		_, err := c.ListAds(context.Background(), types.GetAdParams{})
+		assert.ErrorIs(t, err, ErrServer)
+		assert.Equal(t, int32(3), calls.Load())
+	})
+	t.Run("Non idempotent call is not retried", func(t *testing.T) {
+		srv, calls := flaky(t, 1, api)
+		c, _ := New(srv.URL, WithRetries(2, time.Millisecond))
+		_, err := c.SignUp(context.Background(), "mock_name", "mock_password")
+		assert.ErrorIs(t, err, ErrServer)
+		assert.Equal(t, int32(1), calls.Load())
+	})
+	t.Run("Context is respected", func(t *testing.T) {
+		srv, _ := flaky(t, 5, api)
+		c, _ := New(srv.URL, WithRetries(5, time.Hour))
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := c.ListAds(ctx, types.GetAdParams{})
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+func TestError(t *testing.T) {
+	err := newError(400, "name too short", false)
+	assert.Equal(t, "request is invalid (400): name too short", err.Error())
+	assert.True(t, errors.Is(err, ErrBadRequest))
+	assert.True(t, errors.Is(newError(404, "", true), ErrWrongCredentials))
+	assert.True(t, errors.Is(newError(404, "", false), ErrNotFound))
+	assert.True(t, errors.Is(newError(409, "", false), ErrConflict))
+	assert.True(t, errors.Is(newError(422, "", false), ErrUnprocessable))
+	assert.True(t, errors.Is(newError(413, "", false), ErrTooLarge))
+	assert.True(t, errors.Is(newError(502, "", false), ErrServer))
+	assert.True(t, errors.Is(newError(418, "", false), ErrUnexpectedStatus))
+	assert.False(t, strings.Contains(newError(500, "", false).Error(), ":"))
+
+	structured := responseError(409, []byte(`{"code": "conflict", "message": "user already exists", "field": "name"}`), false)
+	assert.Equal(t, "already exists (409): user already exists", structured.Error())
+	assert.Equal(t, "name", structured.Field)
+	assert.Equal(t, types.API_ERROR_CONFLICT, structured.Code)
+	invalid := responseError(400, []byte(`{"code": "invalid_body", "message": "name must be at least 8 characters long", "field": "name", "errors": [{"field": "name", "message": "must be at least 8 characters long"}]}`), false)
+	assert.Equal(t, []types.ApiFieldError{{Field: "name", Message: "must be at least 8 characters long"}}, invalid.Errors)
+	assert.Equal(t, "name too short", responseError(400, []byte("name too short\n"), false).Message)
+}
+
+func TestOperational(t *testing.T) {
+	api := newServer(t, mockDB{}).Config.Handler
+	var failing atomic.Bool
+	h := health.New(time.Second)
+	h.Add("database", func(ctx context.Context) error {
+		if failing.Load() {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/", api)
+	mux.HandleFunc("GET /readyz", h.Readiness)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	c, _ := New(srv.URL)
+
+	t.Run("Ready", func(t *testing.T) {
+		report, err := c.Readiness(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, health.StatusOk, report.Status)
+	})
+	t.Run("Not ready", func(t *testing.T) {
+		failing.Store(true)
+		defer failing.Store(false)
+		report, err := c.Readiness(context.Background())
+		assert.ErrorIs(t, err, ErrServer)
+		assert.Equal(t, health.StatusUnavailable, report.Status)
+		assert.Contains(t, report.Checks, "database")
+	})
+	t.Run("Spec", func(t *testing.T) {
+		spec, err := c.Spec(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, openapi.Spec, spec)
+	})
+}
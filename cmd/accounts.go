@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"time"
+	"vk-feed/db"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// purgeAccounts deletes the accounts whose grace period is over every
+// interval until ctx is done.
+func purgeAccounts(ctx context.Context, conn db.DBConnection, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := conn.PurgeUsers(ctx, time.Now())
+		if err != nil && ctx.Err() == nil {
+			log.Errorf("purging deleted accounts: %s", err)
+		} else if n > 0 {
+			log.Infof("purged %d deleted account(s)", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
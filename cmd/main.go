@@ -1,10 +1,19 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"vk-feed/config"
 	"vk-feed/db"
+	"vk-feed/health"
+	"vk-feed/metrics"
+	"vk-feed/migrations"
 	"vk-feed/service"
+	"vk-feed/tracing"
 
 	"github.com/joho/godotenv"
 	log "github.com/sirupsen/logrus"
@@ -17,30 +26,101 @@ func init() {
 func main() {
 	godotenv.Load(".env")
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		log.Warn("PORT is not specified. Default port of 6969 will be used.")
-		port = "6969"
+	cfg, err := config.Load(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		log.Fatal(err)
 	}
+	log.Infof("effective config: %s", cfg)
 
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		log.Fatal("JWT_SECRET is not specified")
+	shutdownTracing, err := tracing.Init(context.Background(), cfg.TracesExporter)
+	if err != nil {
+		log.Fatal(err)
 	}
+	defer shutdownTracing(context.Background())
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	dbUrl := os.Getenv("DB_URL")
-	if dbUrl == "" {
-		log.Fatal("DB_URL is not specified")
+	h := health.New(cfg.Shutdown.HealthCheckTimeout)
+	var conn db.DBConnection
+	if cfg.DbUrl == db.MemoryUrl {
+		if len(os.Args) > 1 && os.Args[1] == "migrate" {
+			log.Fatal("the in-memory database has no migrations")
+		}
+		log.Warn("using the in-memory database, data is lost on restart")
+		memConn := db.NewMemoryConnection()
+		h.Add("database", memConn.Ping)
+		conn = memConn
+	} else {
+		dbConn, err := db.Init(ctx, cfg.DbUrl, cfg.Db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer dbConn.Close()
+
+		migrator, err := db.NewMigrator(dbConn, migrations.FS)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(os.Args) > 1 && os.Args[1] == "migrate" {
+			if err := runMigrate(context.Background(), migrator, os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		if cfg.MigrateOnStart {
+			if _, err := migrator.Up(context.Background()); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := migrator.Check(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+		metrics.Registry.MustRegister(metrics.NewPoolCollector(dbConn.Client))
+		h.Add("database", dbConn.Ping)
+		h.Add("migrations", migrator.Check)
+		conn = dbConn
 	}
-	dbConn, err := db.Init(dbUrl)
+
+	api, err := service.NewHandler(
+		service.WithDB(conn),
+		service.WithConfig(cfg),
+		service.WithLogger(log.StandardLogger()),
+	)
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Info("database connected")
-	defer dbConn.Client.Close()
 
-	service.Register(dbConn, []byte(jwtSecret))
+	mux := http.NewServeMux()
+	mux.Handle("/", api)
+	mux.Handle("GET /metrics", metrics.Handler())
+	mux.HandleFunc("GET /healthz", h.Liveness)
+	mux.HandleFunc("GET /readyz", h.Readiness)
+
+	srv := &http.Server{Addr: ":" + cfg.Port, Handler: mux}
+	go purgeAccounts(ctx, conn, cfg.Account.PurgeInterval)
+	// ListenAndServe returns as soon as Shutdown is called, main waits for
+	// the requests in flight before closing the database
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		log.Info("shutting down")
+		// give the orchestrator time to notice failing readiness before
+		// the listener is closed
+		h.Shutdown()
+		time.Sleep(cfg.Shutdown.DrainDelay)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Shutdown.Timeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Error(err)
+		}
+	}()
 
-	log.Infof("server is running on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	log.Infof("server is running on port %s", cfg.Port)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-shutdownDone
+	log.Info("server stopped")
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"vk-feed/db"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const migrateUsage = "usage: app migrate up | down [steps] | status"
+
+func runMigrate(ctx context.Context, migrator db.Migrator, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		if err != nil {
+			return err
+		}
+		log.Infof("applied %d migration(s), schema is at version %d", applied, migrator.Latest())
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps: %s", args[1])
+			}
+		}
+		reverted, err := migrator.Down(ctx, steps)
+		if err != nil {
+			return err
+		}
+		log.Infof("reverted %d migration(s)", reverted)
+	case "status":
+		status, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "version: %d\ndirty:   %t\nlatest:  %d\n", status.Version, status.Dirty, status.Latest)
+		for _, m := range status.Pending {
+			fmt.Fprintf(os.Stdout, "pending: %d_%s\n", m.Version, m.Name)
+		}
+	default:
+		return errors.New(migrateUsage)
+	}
+	return nil
+}
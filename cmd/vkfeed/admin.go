@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const adminUsage = "usage: vkfeed admin status | spec"
+
+// admin covers the operational endpoints, the API has no user or ad
+// management routes to build anything else on.
+func (app *cli) admin(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New(adminUsage)
+	}
+	switch args[0] {
+	case "status":
+		report, err := app.client.Readiness(ctx)
+		if report.Status != "" {
+			fmt.Fprintf(app.stdout, "status: %s\n", report.Status)
+			names := make([]string, 0, len(report.Checks))
+			for name := range report.Checks {
+				names = append(names, name)
+			}
+			slices.Sort(names)
+			for _, name := range names {
+				fmt.Fprintf(app.stdout, "  %s: %s\n", name, report.Checks[name])
+			}
+		}
+		return err
+	case "spec":
+		spec, err := app.client.Spec(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprint(app.stdout, strings.TrimRight(string(spec), "\n")+"\n")
+		return err
+	default:
+		return errors.New(adminUsage)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+	"vk-feed/types"
+)
+
+func (app *cli) post(ctx context.Context, args []string) error {
+	fs := app.flags("post")
+	file := fs.String("file", "", `JSON file with the ad, "-" for stdin; flags override its fields`)
+	var dto types.AdDto
+	fs.StringVar(&dto.Title, "title", "", "title")
+	fs.StringVar(&dto.Content, "content", "", "text of the ad")
+	fs.StringVar(&dto.ImageUrl, "image-url", "", "image address")
+	fs.IntVar(&dto.Price, "price", 0, "price")
+	fs.Func("lat", "latitude of the location", floatPtr(&dto.Latitude))
+	fs.Func("lon", "longitude of the location", floatPtr(&dto.Longitude))
+	fs.StringVar(&dto.City, "city", "", "city of the location")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *file != "" {
+		var fromFile types.AdDto
+		if err := app.readJSON(*file, &fromFile); err != nil {
+			return err
+		}
+		set := map[string]bool{}
+		fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		if !set["title"] {
+			dto.Title = fromFile.Title
+		}
+		if !set["content"] {
+			dto.Content = fromFile.Content
+		}
+		if !set["image-url"] {
+			dto.ImageUrl = fromFile.ImageUrl
+		}
+		if !set["price"] {
+			dto.Price = fromFile.Price
+		}
+		if !set["lat"] {
+			dto.Latitude = fromFile.Latitude
+		}
+		if !set["lon"] {
+			dto.Longitude = fromFile.Longitude
+		}
+		if !set["city"] {
+			dto.City = fromFile.City
+		}
+	}
+	if app.client.Token() == "" {
+		return errors.New(`not signed in, run "vkfeed signin" first`)
+	}
+	ad, err := app.client.CreateAd(ctx, dto)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(app.stdout, "ad %d posted\n", ad.Id)
+	return nil
+}
+
+// floatPtr sets *p to the parsed flag, nil stays for flags not given.
+func floatPtr(p **float64) func(string) error {
+	return func(raw string) error {
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		*p = &f
+		return nil
+	}
+}
+
+func (app *cli) readJSON(path string, out any) error {
+	var r io.Reader = app.stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(out); err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	return nil
+}
+
+func (app *cli) list(ctx context.Context, args []string) error {
+	fs := app.flags("list")
+	var params types.GetAdParams
+	var sortBy, orderBy, after, before, hasImage string
+	fs.IntVar(&params.Page, "page", 0, "zero based page number")
+	fs.StringVar(&sortBy, "sort-by", "", "comma separated created_at, price or id, each optionally with :asc or :desc")
+	fs.StringVar(&orderBy, "order-by", "", "asc or desc")
+	fs.IntVar(&params.MinPrice, "min-price", 0, "minimal price")
+	fs.IntVar(&params.MaxPrice, "max-price", 0, "maximal price")
+	fs.StringVar(&after, "created-after", "", "RFC 3339 date-time or date")
+	fs.StringVar(&before, "created-before", "", "RFC 3339 date-time or date")
+	fs.IntVar(&params.AuthorId, "author-id", 0, "only ads of this author")
+	fs.BoolVar(&params.OnlyMine, "only-mine", false, "only your ads")
+	fs.BoolVar(&params.ExcludeMine, "exclude-mine", false, "hide your ads")
+	fs.StringVar(&hasImage, "has-image", "", "true or false")
+	var lat, lon *float64
+	fs.Func("lat", "latitude to measure distances from, requires -lon", floatPtr(&lat))
+	fs.Func("lon", "longitude to measure distances from, requires -lat", floatPtr(&lon))
+	fs.Float64Var(&params.RadiusKm, "radius-km", 0, "only ads within this distance, requires -lat and -lon")
+	output := fs.String("output", "table", "table or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	switch types.ORDER_BY(orderBy) {
+	case "", types.ORDER_BY_ASC, types.ORDER_BY_DESC:
+		params.OrderBy = types.ORDER_BY(orderBy)
+	default:
+		return fmt.Errorf("invalid -order-by %q", orderBy)
+	}
+	if (lat == nil) != (lon == nil) || (lat == nil && params.RadiusKm != 0) {
+		return errors.New("-lat and -lon go together, -radius-km requires them")
+	}
+	if lat != nil {
+		params.Lat, params.Lon, params.Near = *lat, *lon, true
+	}
+	if sortBy != "" {
+		// checked with the server default direction when none is given
+		sorted := params
+		sorted.SortBy, sorted.OrderBy = types.SORT_BY(sortBy), cmp.Or(params.OrderBy, types.ORDER_BY_ASC)
+		if _, err := sorted.SortKeys(); err != nil {
+			return fmt.Errorf("invalid -sort-by %q: %w", sortBy, err)
+		}
+		params.SortBy = sorted.SortBy
+	}
+	var err error
+	if params.CreatedAfter, err = parseTime(after); err != nil {
+		return fmt.Errorf("invalid -created-after %q", after)
+	}
+	if params.CreatedBefore, err = parseTime(before); err != nil {
+		return fmt.Errorf("invalid -created-before %q", before)
+	}
+	switch types.IMAGE_FILTER(hasImage) {
+	case types.IMAGE_ANY, types.IMAGE_WITH, types.IMAGE_WITHOUT:
+		params.HasImage = types.IMAGE_FILTER(hasImage)
+	default:
+		return fmt.Errorf("invalid -has-image %q", hasImage)
+	}
+	if *output != "table" && *output != "json" {
+		return fmt.Errorf("invalid -output %q", *output)
+	}
+
+	feed, err := app.client.ListAds(ctx, params)
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		if feed == nil {
+			feed = []types.AdFeed{}
+		}
+		enc := json.NewEncoder(app.stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(feed)
+	}
+	return writeTable(app.stdout, feed)
+}
+
+// parseTime accepts what the server does, the empty string is no filter.
+func parseTime(raw string) (time.Time, error) {
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, raw); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, raw)
+}
+
+func writeTable(w io.Writer, feed []types.AdFeed) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTITLE\tPRICE\tAUTHOR\tYOURS\tCREATED\tIMAGE")
+	for _, ad := range feed {
+		yours := ""
+		if ad.IsYours {
+			yours = "yes"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%d\t%s\t%s\t%s\n",
+			ad.Id, truncate(ad.Title, 40), ad.Price, ad.AuthorId, yours,
+			ad.CreatedAt.Local().Format(time.DateTime), ad.ImageUrl)
+	}
+	return tw.Flush()
+}
+
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
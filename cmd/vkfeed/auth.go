@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// credentials reads -name and -password, the password falls back to
+// VKFEED_PASSWORD so it does not end up in the shell history.
+func (app *cli) credentials(name string, args []string) (string, string, error) {
+	fs := app.flags(name)
+	user := fs.String("name", "", "user name, 8 to 16 characters")
+	password := fs.String("password", "", "password, 8 to 16 characters, defaults to VKFEED_PASSWORD")
+	if err := fs.Parse(args); err != nil {
+		return "", "", err
+	}
+	if *password == "" {
+		*password = os.Getenv("VKFEED_PASSWORD")
+	}
+	if *user == "" || *password == "" {
+		return "", "", errors.New("name and password are required")
+	}
+	return *user, *password, nil
+}
+
+func (app *cli) signup(ctx context.Context, args []string) error {
+	name, password, err := app.credentials("signup", args)
+	if err != nil {
+		return err
+	}
+	user, err := app.client.SignUp(ctx, name, password)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(app.stdout, "user %s registered with id %d\n", user.Name, user.Id)
+	return nil
+}
+
+func (app *cli) signin(ctx context.Context, args []string) error {
+	name, password, err := app.credentials("signin", args)
+	if err != nil {
+		return err
+	}
+	token, err := app.client.SignIn(ctx, name, password)
+	if err != nil {
+		return err
+	}
+	app.cfg.Name = name
+	app.cfg.Token = token.Token
+	if err := saveConfig(app.cfgPath, app.cfg); err != nil {
+		return err
+	}
+	fmt.Fprintf(app.stdout, "signed in as %s\n", name)
+	return nil
+}
+
+func (app *cli) signout() error {
+	app.cfg.Name = ""
+	app.cfg.Token = ""
+	return saveConfig(app.cfgPath, app.cfg)
+}
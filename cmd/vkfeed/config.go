@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const defaultServer = "http://localhost:6969"
+
+// cliConfig is what the CLI remembers between runs.
+type cliConfig struct {
+	Server string `json:"server,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Token  string `json:"token,omitempty"`
+}
+
+// configPath returns VKFEED_CONFIG or vkfeed/config.json in the user config
+// directory.
+func configPath() (string, error) {
+	if path := os.Getenv("VKFEED_CONFIG"); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "vkfeed", "config.json"), nil
+}
+
+// loadConfig returns an empty config when the file does not exist yet.
+func loadConfig(path string) (cliConfig, error) {
+	var cfg cliConfig
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	err = json.Unmarshal(content, &cfg)
+	return cfg, err
+}
+
+// saveConfig writes the config readable by the owner only since it holds
+// the access token.
+func saveConfig(path string, cfg cliConfig) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(content, '\n'), 0o600)
+}
@@ -0,0 +1,109 @@
+// Command vkfeed is a command line client of the vk-feed API.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"vk-feed/client"
+)
+
+const usage = `usage: vkfeed [-server url] <command> [flags]
+
+commands:
+  signup   register a new user
+  signin   sign in and store the access token
+  signout  forget the stored access token
+  post     post an ad from flags or a JSON file
+  list     list the feed, alias: search
+  admin    operational commands: status, spec
+
+Run "vkfeed <command> -h" for the command flags. The config file is
+VKFEED_CONFIG or vkfeed/config.json in the user config directory.
+`
+
+var errUsage = errors.New(usage)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := run(ctx, os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// cli holds what every command needs.
+type cli struct {
+	cfg     cliConfig
+	cfgPath string
+	client  *client.Client
+	stdin   io.Reader
+	stdout  io.Writer
+}
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) error {
+	global := flag.NewFlagSet("vkfeed", flag.ContinueOnError)
+	global.SetOutput(stdout)
+	global.Usage = func() { fmt.Fprint(stdout, usage) }
+	server := global.String("server", "", "API address, defaults to VKFEED_SERVER, the stored one or "+defaultServer)
+	if err := global.Parse(args); err != nil {
+		return err
+	}
+	if global.NArg() == 0 {
+		return errUsage
+	}
+
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	switch {
+	case *server != "":
+		cfg.Server = *server
+	case os.Getenv("VKFEED_SERVER") != "":
+		cfg.Server = os.Getenv("VKFEED_SERVER")
+	case cfg.Server == "":
+		cfg.Server = defaultServer
+	}
+	c, err := client.New(cfg.Server, client.WithToken(cfg.Token))
+	if err != nil {
+		return err
+	}
+	app := &cli{cfg: cfg, cfgPath: path, client: c, stdin: stdin, stdout: stdout}
+
+	cmd, cmdArgs := global.Arg(0), global.Args()[1:]
+	switch cmd {
+	case "signup":
+		return app.signup(ctx, cmdArgs)
+	case "signin":
+		return app.signin(ctx, cmdArgs)
+	case "signout":
+		return app.signout()
+	case "post":
+		return app.post(ctx, cmdArgs)
+	case "list", "search":
+		return app.list(ctx, cmdArgs)
+	case "admin":
+		return app.admin(ctx, cmdArgs)
+	default:
+		return fmt.Errorf("unknown command %q\n\n%s", cmd, usage)
+	}
+}
+
+func (app *cli) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("vkfeed "+name, flag.ContinueOnError)
+	fs.SetOutput(app.stdout)
+	return fs
+}
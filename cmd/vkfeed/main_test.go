@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"vk-feed/config"
+	"vk-feed/db"
+	"vk-feed/openapi"
+	"vk-feed/service"
+	"vk-feed/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mockDB struct {
+	ads *[]types.AdDto
+}
+
+func (m mockDB) CreateUser(ctx context.Context, name, password string) (int, error) {
+	return 1, nil
+}
+
+func (m mockDB) GetUserByName(ctx context.Context, name string) (int, string, error) {
+	if name != "mock_name" {
+		return 0, "", db.ErrNotFound
+	}
+	temp := sha512.Sum512([]byte("mock_password"))
+	return 1, base64.StdEncoding.EncodeToString(temp[:]), nil
+}
+
+func (m mockDB) GetUserById(ctx context.Context, id int) (types.User, error) {
+	return types.User{Id: id, Name: "mock_name"}, nil
+}
+
+func (m mockDB) GetUserPassword(ctx context.Context, id int) (string, error) {
+	temp := sha512.Sum512([]byte("mock_password"))
+	return base64.StdEncoding.EncodeToString(temp[:]), nil
+}
+
+func (m mockDB) DeleteUser(ctx context.Context, id int) error { return nil }
+
+func (m mockDB) ScheduleUserDeletion(ctx context.Context, id int, at time.Time) error { return nil }
+
+func (m mockDB) CancelUserDeletion(ctx context.Context, id int) error { return nil }
+
+func (m mockDB) PurgeUsers(ctx context.Context, before time.Time) (int64, error) { return 0, nil }
+
+func (m mockDB) CreateAd(ctx context.Context, dto types.AdDto, userId int) (int, error) {
+	*m.ads = append(*m.ads, dto)
+	return len(*m.ads), nil
+}
+
+func (m mockDB) CreateAds(ctx context.Context, dtos []types.AdDto, userId int) ([]int, error) {
+	ids := make([]int, len(dtos))
+	for i, dto := range dtos {
+		ids[i], _ = m.CreateAd(ctx, dto, userId)
+	}
+	return ids, nil
+}
+
+func (m mockDB) GetAds(ctx context.Context, userId int, params types.GetAdParams) ([]types.AdFeed, error) {
+	return []types.AdFeed{{
+		Id:        1,
+		Title:     "mock_title",
+		Content:   "mock_content",
+		ImageUrl:  "http://mocksite.com/image.jpg",
+		Price:     6969,
+		CreatedAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		AuthorId:  1,
+		IsYours:   userId == 1,
+	}}, nil
+}
+
+func (m mockDB) ForEachUserAd(ctx context.Context, userId int, fn func(types.AdFeed) error) error {
+	return nil
+}
+
+type mockIC struct{}
+
+func (mockIC) Check(ctx context.Context, url string) error { return nil }
+
+func TestRun(t *testing.T) {
+	var ads []types.AdDto
+	cfg := config.Default()
+	cfg.JwtSecret = strings.Repeat("s", 32)
+	h, err := service.NewHandler(service.WithDB(mockDB{ads: &ads}), service.WithImageChecker(mockIC{}), service.WithConfig(cfg))
+	assert.NoError(t, err)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	cfgPath := filepath.Join(t.TempDir(), "config.json")
+	t.Setenv("VKFEED_CONFIG", cfgPath)
+	t.Setenv("VKFEED_SERVER", srv.URL)
+	t.Setenv("VKFEED_PASSWORD", "")
+	exec := func(stdin string, args ...string) (string, error) {
+		var out bytes.Buffer
+		err := run(context.Background(), args, strings.NewReader(stdin), &out)
+		return out.String(), err
+	}
+
+	t.Run("Usage", func(t *testing.T) {
+		_, err := exec("")
+		assert.Equal(t, errUsage, err)
+		_, err = exec("", "monke")
+		assert.ErrorContains(t, err, `unknown command "monke"`)
+	})
+	t.Run("Post without signing in", func(t *testing.T) {
+		_, err := exec("", "post", "-title", "mock_title")
+		assert.ErrorContains(t, err, "not signed in")
+	})
+	t.Run("Sign up", func(t *testing.T) {
+		out, err := exec("", "signup", "-name", "mock_name", "-password", "mock_password")
+		assert.NoError(t, err)
+		assert.Equal(t, "user mock_name registered with id 1\n", out)
+	})
+	t.Run("Sign in stores the token", func(t *testing.T) {
+		t.Setenv("VKFEED_PASSWORD", "mock_password")
+		out, err := exec("", "signin", "-name", "mock_name")
+		assert.NoError(t, err)
+		assert.Equal(t, "signed in as mock_name\n", out)
+		stored, err := loadConfig(cfgPath)
+		assert.NoError(t, err)
+		assert.Equal(t, "mock_name", stored.Name)
+		assert.NotEmpty(t, stored.Token)
+	})
+	t.Run("Post from flags", func(t *testing.T) {
+		out, err := exec("", "post", "-title", "mock_title", "-content", "mock_content", "-image-url", "http://mocksite.com/image.jpg", "-price", "100")
+		assert.NoError(t, err)
+		assert.Equal(t, "ad 1 posted\n", out)
+		assert.Equal(t, types.AdDto{Title: "mock_title", Content: "mock_content", ImageUrl: "http://mocksite.com/image.jpg", Price: 100}, ads[0])
+	})
+	t.Run("Post from file with override", func(t *testing.T) {
+		file := `{"title": "file_title", "content": "file_content", "imageUrl": "http://mocksite.com/image.jpg", "price": 5}`
+		out, err := exec(file, "post", "-file", "-", "-price", "10")
+		assert.NoError(t, err)
+		assert.Equal(t, "ad 2 posted\n", out)
+		assert.Equal(t, types.AdDto{Title: "file_title", Content: "file_content", ImageUrl: "http://mocksite.com/image.jpg", Price: 10}, ads[1])
+	})
+	t.Run("Post invalid", func(t *testing.T) {
+		_, err := exec("", "post", "-title", "mock_title")
+		assert.ErrorContains(t, err, "request is invalid (400)")
+	})
+	t.Run("List table", func(t *testing.T) {
+		out, err := exec("", "list", "-sort-by", "price", "-order-by", "desc")
+		assert.NoError(t, err)
+		lines := strings.Split(strings.TrimSpace(out), "\n")
+		assert.Len(t, lines, 2)
+		assert.True(t, strings.HasPrefix(lines[0], "ID"))
+		assert.Contains(t, lines[1], "mock_title")
+		assert.Contains(t, lines[1], "yes")
+	})
+	t.Run("Search JSON", func(t *testing.T) {
+		out, err := exec("", "search", "-min-price", "10", "-output", "json")
+		assert.NoError(t, err)
+		var feed []types.AdFeed
+		assert.NoError(t, json.Unmarshal([]byte(out), &feed))
+		assert.Equal(t, 6969, feed[0].Price)
+	})
+	t.Run("List invalid flags", func(t *testing.T) {
+		_, err := exec("", "list", "-sort-by", "monke")
+		assert.ErrorContains(t, err, "invalid -sort-by")
+		_, err = exec("", "list", "-sort-by", "price:up")
+		assert.ErrorContains(t, err, "invalid -sort-by")
+		_, err = exec("", "list", "-created-after", "yesterday")
+		assert.ErrorContains(t, err, "invalid -created-after")
+		_, err = exec("", "list", "-has-image", "maybe")
+		assert.ErrorContains(t, err, "invalid -has-image")
+		_, err = exec("", "list", "-lat", "55.75", "-radius-km", "10")
+		assert.ErrorContains(t, err, "-lat and -lon go together")
+		_, err = exec("", "list", "-sort-by", "distance")
+		assert.ErrorContains(t, err, "invalid -sort-by")
+	})
+	t.Run("Post with location", func(t *testing.T) {
+		file := `{"title": "file_title", "content": "file_content", "imageUrl": "http://mocksite.com/image.jpg", "price": 5, "latitude": 1, "longitude": 2}`
+		_, err := exec(file, "post", "-file", "-", "-lat", "55.7558", "-city", "Москва")
+		assert.NoError(t, err)
+		dto := ads[len(ads)-1]
+		if assert.NotNil(t, dto.Latitude) && assert.NotNil(t, dto.Longitude) {
+			assert.Equal(t, 55.7558, *dto.Latitude)
+			assert.Equal(t, 2.0, *dto.Longitude)
+		}
+		assert.Equal(t, "Москва", dto.City)
+	})
+	t.Run("List filters", func(t *testing.T) {
+		_, err := exec("", "list", "-created-after", "2024-01-01", "-author-id", "7", "-exclude-mine", "-has-image", "true", "-sort-by", "distance,price:desc", "-lat", "55.75", "-lon", "37.62", "-radius-km", "10")
+		assert.NoError(t, err)
+	})
+	t.Run("Sign out", func(t *testing.T) {
+		_, err := exec("", "signout")
+		assert.NoError(t, err)
+		stored, _ := loadConfig(cfgPath)
+		assert.Empty(t, stored.Token)
+	})
+	t.Run("Admin spec", func(t *testing.T) {
+		out, err := exec("", "admin", "spec")
+		assert.NoError(t, err)
+		assert.Equal(t, strings.TrimRight(string(openapi.Spec), "\n")+"\n", out)
+	})
+}
@@ -0,0 +1,267 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Port           string        `yaml:"port" env:"PORT" validate:"required,numeric"`
+	JwtSecret      string        `yaml:"jwt_secret" env:"JWT_SECRET" validate:"required,min=32" secret:"true"`
+	TokenTTL       time.Duration `yaml:"token_ttl" env:"TOKEN_TTL" validate:"min=1m"`
+	DbUrl          string        `yaml:"db_url" env:"DB_URL" validate:"required,url|eq=memory://" secret:"url"`
+	MigrateOnStart bool          `yaml:"migrate_on_start" env:"MIGRATE_ON_START"`
+	Db             Db            `yaml:"db"`
+	TracesExporter string        `yaml:"traces_exporter" env:"OTEL_TRACES_EXPORTER" validate:"omitempty,oneof=none stdout otlp"`
+	Http           Http          `yaml:"http"`
+	Feed           Feed          `yaml:"feed"`
+	Image          Image         `yaml:"image"`
+	Bulk           Bulk          `yaml:"bulk"`
+	Account        Account       `yaml:"account"`
+	Shutdown       Shutdown      `yaml:"shutdown"`
+}
+
+type Db struct {
+	// how long startup keeps retrying to connect; zero tries once
+	ConnectTimeout    time.Duration `yaml:"connect_timeout" env:"DB_CONNECT_TIMEOUT" validate:"min=0s"`
+	MaxConns          int           `yaml:"max_conns" env:"DB_MAX_CONNS" validate:"min=1,max=1000"`
+	MinConns          int           `yaml:"min_conns" env:"DB_MIN_CONNS" validate:"min=0,ltefield=MaxConns"`
+	MaxConnLifetime   time.Duration `yaml:"max_conn_lifetime" env:"DB_MAX_CONN_LIFETIME" validate:"min=1s"`
+	MaxConnIdleTime   time.Duration `yaml:"max_conn_idle_time" env:"DB_MAX_CONN_IDLE_TIME" validate:"min=1s"`
+	HealthCheckPeriod time.Duration `yaml:"health_check_period" env:"DB_HEALTH_CHECK_PERIOD" validate:"min=1s"`
+	// zero leaves statements without a timeout
+	StatementTimeout time.Duration `yaml:"statement_timeout" env:"DB_STATEMENT_TIMEOUT" validate:"min=0s"`
+	// reads are spread over these when set
+	ReplicaUrls []string `yaml:"replica_urls" env:"DB_REPLICA_URLS" validate:"dive,url" secret:"url"`
+	// how long a user reads from the primary after their own write
+	ReadYourWritesWindow time.Duration `yaml:"read_your_writes_window" env:"DB_READ_YOUR_WRITES_WINDOW" validate:"min=0s"`
+}
+
+type Http struct {
+	MaxBodySize    int64    `yaml:"max_body_size" env:"HTTP_MAX_BODY_SIZE" validate:"min=1"`
+	MaxBodyLog     int      `yaml:"max_body_log" env:"HTTP_MAX_BODY_LOG" validate:"min=0"`
+	RedactFields   []string `yaml:"redact_fields" env:"HTTP_REDACT_FIELDS"`
+	TrustedProxies []string `yaml:"trusted_proxies" env:"TRUSTED_PROXIES" validate:"dive,cidr|ip"`
+	// date after which the unversioned routes are removed
+	LegacySunset string `yaml:"legacy_sunset" env:"HTTP_LEGACY_SUNSET" validate:"omitempty,datetime=2006-01-02"`
+}
+
+type Feed struct {
+	PageSize int `yaml:"page_size" env:"FEED_PAGE_SIZE" validate:"min=1,max=100"`
+	MinPrice int `yaml:"min_price" env:"FEED_MIN_PRICE" validate:"min=1,ltefield=MaxPrice"`
+	MaxPrice int `yaml:"max_price" env:"FEED_MAX_PRICE" validate:"min=1"`
+	// reject invalid query parameters instead of clamping them, clients can
+	// choose either with the Prefer header
+	StrictParams bool `yaml:"strict_params" env:"FEED_STRICT_PARAMS"`
+	// how long anonymous pages are cached and may be cached by clients;
+	// zero disables caching
+	CacheTTL  time.Duration `yaml:"cache_ttl" env:"FEED_CACHE_TTL" validate:"min=0s"`
+	CacheSize int           `yaml:"cache_size" env:"FEED_CACHE_SIZE" validate:"min=1"`
+}
+
+type Image struct {
+	Timeout time.Duration `yaml:"timeout" env:"IMAGE_TIMEOUT" validate:"min=1ms"`
+	MaxSize int64         `yaml:"max_size" env:"IMAGE_MAX_SIZE" validate:"min=1"`
+}
+
+type Bulk struct {
+	MaxRows     int   `yaml:"max_rows" env:"BULK_MAX_ROWS" validate:"min=1"`
+	MaxBodySize int64 `yaml:"max_body_size" env:"BULK_MAX_BODY_SIZE" validate:"min=1"`
+	// number of images checked at the same time
+	Parallelism int `yaml:"parallelism" env:"BULK_PARALLELISM" validate:"min=1,max=64"`
+}
+
+type Account struct {
+	// time before a deleted account is purged, during which signing in
+	// cancels the deletion; zero deletes at once
+	DeletionGracePeriod time.Duration `yaml:"deletion_grace_period" env:"ACCOUNT_DELETION_GRACE_PERIOD" validate:"min=0s"`
+	PurgeInterval       time.Duration `yaml:"purge_interval" env:"ACCOUNT_PURGE_INTERVAL" validate:"min=1s"`
+}
+
+type Shutdown struct {
+	HealthCheckTimeout time.Duration `yaml:"health_check_timeout" env:"HEALTH_CHECK_TIMEOUT" validate:"min=1ms"`
+	DrainDelay         time.Duration `yaml:"drain_delay" env:"SHUTDOWN_DRAIN_DELAY" validate:"min=0s"`
+	Timeout            time.Duration `yaml:"timeout" env:"SHUTDOWN_TIMEOUT" validate:"min=1ms"`
+}
+
+func Default() Config {
+	return Config{
+		Port:     "6969",
+		TokenTTL: 24 * time.Hour,
+		Db: Db{
+			ConnectTimeout:       30 * time.Second,
+			MaxConns:             10,
+			MaxConnLifetime:      time.Hour,
+			MaxConnIdleTime:      30 * time.Minute,
+			HealthCheckPeriod:    time.Minute,
+			ReadYourWritesWindow: 5 * time.Second,
+		},
+		Http: Http{
+			MaxBodySize:  1 << 20,
+			MaxBodyLog:   2048,
+			RedactFields: []string{"password", "pass", "token", "secret"},
+			LegacySunset: "2027-06-30",
+		},
+		Feed: Feed{
+			PageSize:  10,
+			MinPrice:  1,
+			MaxPrice:  1e6,
+			CacheTTL:  5 * time.Second,
+			CacheSize: 1000,
+		},
+		Image: Image{
+			Timeout: 10 * time.Second,
+			MaxSize: 5 * 10e6,
+		},
+		Bulk: Bulk{
+			MaxRows:     1000,
+			MaxBodySize: 10 << 20,
+			Parallelism: 8,
+		},
+		Account: Account{
+			PurgeInterval: time.Hour,
+		},
+		Shutdown: Shutdown{
+			HealthCheckTimeout: 2 * time.Second,
+			DrainDelay:         5 * time.Second,
+			Timeout:            15 * time.Second,
+		},
+	}
+}
+
+// Load builds the configuration from defaults, then the YAML file at path
+// (if not empty), then environment variables, and validates the result.
+func Load(path string) (Config, error) {
+	cfg := Default()
+	if path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return Config{}, err
+		}
+		if err := yaml.Unmarshal(content, &cfg); err != nil {
+			return Config{}, fmt.Errorf("config file %s: %w", path, err)
+		}
+	}
+	if err := loadEnv(reflect.ValueOf(&cfg).Elem(), os.LookupEnv); err != nil {
+		return Config{}, err
+	}
+	if err := validator.New().Struct(cfg); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+func loadEnv(v reflect.Value, lookup func(string) (string, bool)) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := loadEnv(field, lookup); err != nil {
+				return err
+			}
+			continue
+		}
+		name := t.Field(i).Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		raw, ok := lookup(name)
+		if !ok || raw == "" {
+			continue
+		}
+		if err := setField(field, raw); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, raw string) error {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(raw)
+	case bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+	case int, int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case []string:
+		var out []string
+		for _, part := range strings.Split(raw, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				out = append(out, part)
+			}
+		}
+		field.Set(reflect.ValueOf(out))
+	default:
+		return fmt.Errorf("unsupported config field type %s", field.Type())
+	}
+	return nil
+}
+
+// Masked returns a copy of the config safe to be logged.
+func (cfg Config) Masked() Config {
+	out := cfg
+	maskFields(reflect.ValueOf(&out).Elem())
+	return out
+}
+
+func maskFields(v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			maskFields(field)
+			continue
+		}
+		switch t.Field(i).Tag.Get("secret") {
+		case "true":
+			if field.String() != "" {
+				field.SetString("****")
+			}
+		case "url":
+			if field.Kind() == reflect.Slice {
+				urls := make([]string, field.Len())
+				for i := range urls {
+					urls[i] = redactUrl(field.Index(i).String())
+				}
+				field.Set(reflect.ValueOf(urls))
+			} else {
+				field.SetString(redactUrl(field.String()))
+			}
+		}
+	}
+}
+
+func redactUrl(raw string) string {
+	if u, err := url.Parse(raw); err == nil {
+		return u.Redacted()
+	}
+	return "****"
+}
+
+func (cfg Config) String() string {
+	type plain Config
+	return fmt.Sprintf("%+v", plain(cfg.Masked()))
+}
@@ -0,0 +1,517 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+	"vk-feed/migrations"
+	"vk-feed/pgtest"
+	"vk-feed/types"
+
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryConnection(t *testing.T) {
+	testConformance(t, func(t *testing.T) DBConnection {
+		return NewMemoryConnection()
+	})
+}
+
+// TestPgxConnection gives every check a fresh schema, it is skipped when
+// there is no Postgres to run against, see pgtest.
+func TestPgxConnection(t *testing.T) {
+	pgtest.Require(t)
+	testConformance(t, func(t *testing.T) DBConnection {
+		conn := PgxConnection{Client: pgtest.Pool(t)}
+		migrator, err := NewMigrator(conn, migrations.FS)
+		assert.NoError(t, err)
+		_, err = migrator.Up(context.Background())
+		assert.NoError(t, err)
+		return conn
+	})
+}
+
+// TestPgxConnectionReplica reads through a replica that is the primary
+// itself, so the read paths run against Postgres without replication.
+func TestPgxConnectionReplica(t *testing.T) {
+	pgtest.Require(t)
+	testConformance(t, func(t *testing.T) DBConnection {
+		pool := pgtest.Pool(t)
+		r := &replica{name: "primary", pool: pool}
+		r.healthy.Store(true)
+		conn := PgxConnection{Client: pool, replicas: newReplicaSet([]*replica{r}, 0)}
+		migrator, err := NewMigrator(conn, migrations.FS)
+		assert.NoError(t, err)
+		_, err = migrator.Up(context.Background())
+		assert.NoError(t, err)
+		return conn
+	})
+}
+
+// assertConstraint checks the error is a ConstraintError of the kind on
+// the column, empty when the driver does not name it.
+func assertConstraint(t *testing.T, kind error, column string, err error) {
+	t.Helper()
+	var constraintErr *ConstraintError
+	if assert.ErrorAs(t, err, &constraintErr) {
+		assert.ErrorIs(t, err, kind)
+		assert.Equal(t, column, constraintErr.Column)
+		var pgErr *pgconn.PgError
+		assert.ErrorAs(t, err, &pgErr, "the driver error is kept")
+	}
+}
+
+func newAd(title string, price int) types.AdDto {
+	return types.AdDto{Title: title, Content: "mock_content", ImageUrl: "http://mocksite.com/image.jpg", Price: price}
+}
+
+func feedIds(ads []types.AdFeed) []int {
+	ids := make([]int, len(ads))
+	for i, ad := range ads {
+		ids[i] = ad.Id
+	}
+	return ids
+}
+
+// testConformance checks the behaviour every DBConnection shares with the
+// Postgres schema; newConn returns an empty database.
+func testConformance(t *testing.T, newConn func(t *testing.T) DBConnection) {
+	ctx := context.Background()
+
+	t.Run("Users", func(t *testing.T) {
+		conn := newConn(t)
+		id, err := conn.CreateUser(ctx, "mock_name", "mock_hash")
+		assert.NoError(t, err)
+		_, err = conn.CreateUser(ctx, "mock_name", "other_hash")
+		assertConstraint(t, ErrConflict, "name", err)
+		_, err = conn.CreateUser(ctx, "short", "mock_hash")
+		assertConstraint(t, ErrInvalid, "name", err)
+		_, err = conn.CreateUser(ctx, "much_too_long_name", "mock_hash")
+		assertConstraint(t, ErrInvalid, "", err)
+
+		gotId, pass, err := conn.GetUserByName(ctx, "mock_name")
+		assert.NoError(t, err)
+		assert.Equal(t, id, gotId)
+		assert.Equal(t, "mock_hash", pass)
+		_, _, err = conn.GetUserByName(ctx, "wrong_name")
+		assert.Equal(t, ErrNotFound, err)
+
+		user, err := conn.GetUserById(ctx, id)
+		assert.NoError(t, err)
+		assert.Equal(t, types.User{Id: id, Name: "mock_name"}, user)
+		_, err = conn.GetUserById(ctx, id+100)
+		assert.Equal(t, ErrNotFound, err)
+
+		pass, err = conn.GetUserPassword(ctx, id)
+		assert.NoError(t, err)
+		assert.Equal(t, "mock_hash", pass)
+		_, err = conn.GetUserPassword(ctx, id+100)
+		assert.Equal(t, ErrNotFound, err)
+	})
+
+	t.Run("Create ads", func(t *testing.T) {
+		conn := newConn(t)
+		userId, _ := conn.CreateUser(ctx, "mock_name", "mock_hash")
+		id, err := conn.CreateAd(ctx, newAd("mock_title", 100), userId)
+		assert.NoError(t, err)
+		assert.NotZero(t, id)
+		_, err = conn.CreateAd(ctx, newAd("mock_title", 100), userId+100)
+		assertConstraint(t, ErrReference, "user_id", err)
+		_, err = conn.CreateAd(ctx, newAd("mock_title", 0), userId)
+		assertConstraint(t, ErrInvalid, "price", err)
+		_, err = conn.CreateAd(ctx, newAd("m", 100), userId)
+		assertConstraint(t, ErrInvalid, "title", err)
+
+		ids, err := conn.CreateAds(ctx, []types.AdDto{newAd("first", 1), newAd("second", 2)}, userId)
+		assert.NoError(t, err)
+		assert.Len(t, ids, 2)
+		assert.Less(t, ids[0], ids[1])
+		_, err = conn.CreateAds(ctx, []types.AdDto{newAd("third", 3), newAd("fourth", 2_000_000)}, userId)
+		assertConstraint(t, ErrInvalid, "price", err)
+
+		ads, err := conn.GetAds(ctx, userId, types.GetAdParams{PageSize: 10, MinPrice: 1, MaxPrice: 1_000_000, SortBy: types.SORT_BY_PRICE, OrderBy: types.ORDER_BY_ASC})
+		assert.NoError(t, err)
+		assert.Equal(t, []int{ids[0], ids[1], id}, feedIds(ads), "a failed batch inserts nothing")
+	})
+
+	t.Run("Get ads", func(t *testing.T) {
+		conn := newConn(t)
+		alice, _ := conn.CreateUser(ctx, "alice_name", "mock_hash")
+		bob, _ := conn.CreateUser(ctx, "bob_the_name", "mock_hash")
+		var ids []int
+		for i, price := range []int{30, 10, 50, 20, 40} {
+			userId := alice
+			if i%2 == 1 {
+				userId = bob
+			}
+			id, err := conn.CreateAd(ctx, newAd("mock_title", price), userId)
+			assert.NoError(t, err)
+			ids = append(ids, id)
+			time.Sleep(time.Millisecond)
+		}
+		params := func(sortBy types.SORT_BY, orderBy types.ORDER_BY) types.GetAdParams {
+			return types.GetAdParams{PageSize: 10, MinPrice: 1, MaxPrice: 1_000_000, SortBy: sortBy, OrderBy: orderBy}
+		}
+
+		cases := []struct {
+			name   string
+			params types.GetAdParams
+			want   []int
+		}{
+			{"By date", params(types.SORT_BY_DATE, types.ORDER_BY_ASC), ids},
+			{"By date desc", params(types.SORT_BY_DATE, types.ORDER_BY_DESC), []int{ids[4], ids[3], ids[2], ids[1], ids[0]}},
+			{"By price", params(types.SORT_BY_PRICE, types.ORDER_BY_ASC), []int{ids[1], ids[3], ids[0], ids[4], ids[2]}},
+			{"By price desc", params(types.SORT_BY_PRICE, types.ORDER_BY_DESC), []int{ids[2], ids[4], ids[0], ids[3], ids[1]}},
+		}
+		for _, c := range cases {
+			t.Run(c.name, func(t *testing.T) {
+				ads, err := conn.GetAds(ctx, alice, c.params)
+				assert.NoError(t, err)
+				assert.Equal(t, c.want, feedIds(ads))
+			})
+		}
+
+		t.Run("Price range", func(t *testing.T) {
+			p := params(types.SORT_BY_PRICE, types.ORDER_BY_ASC)
+			p.MinPrice, p.MaxPrice = 20, 40
+			ads, err := conn.GetAds(ctx, alice, p)
+			assert.NoError(t, err)
+			assert.Equal(t, []int{ids[3], ids[0], ids[4]}, feedIds(ads))
+		})
+		t.Run("Price bounds are optional", func(t *testing.T) {
+			p := params(types.SORT_BY_PRICE, types.ORDER_BY_ASC)
+			p.MinPrice, p.MaxPrice = 0, 30
+			ads, err := conn.GetAds(ctx, alice, p)
+			assert.NoError(t, err)
+			assert.Equal(t, []int{ids[1], ids[3], ids[0]}, feedIds(ads))
+			p.MinPrice, p.MaxPrice = 30, 0
+			ads, err = conn.GetAds(ctx, alice, p)
+			assert.NoError(t, err)
+			assert.Equal(t, []int{ids[0], ids[4], ids[2]}, feedIds(ads))
+		})
+		t.Run("Invalid sort", func(t *testing.T) {
+			_, err := conn.GetAds(ctx, alice, params("id; DROP TABLE ads", types.ORDER_BY_ASC))
+			assert.ErrorIs(t, err, ErrInvalidParams)
+			_, err = conn.GetAds(ctx, alice, params(types.SORT_BY_PRICE, "sideways"))
+			assert.ErrorIs(t, err, ErrInvalidParams)
+			_, err = conn.GetAds(ctx, alice, params("price,price:desc", types.ORDER_BY_ASC))
+			assert.ErrorIs(t, err, ErrInvalidParams)
+		})
+		t.Run("Page out of range", func(t *testing.T) {
+			for _, page := range []int{-1, 1844674407370955162, math.MaxInt} {
+				p := params(types.SORT_BY_PRICE, types.ORDER_BY_ASC)
+				p.Page = page
+				_, err := conn.GetAds(ctx, alice, p)
+				assert.ErrorIs(t, err, ErrInvalidParams, page)
+			}
+		})
+		t.Run("Pages", func(t *testing.T) {
+			p := params(types.SORT_BY_PRICE, types.ORDER_BY_ASC)
+			p.PageSize = 2
+			var got []int
+			for page := 0; page < 3; page++ {
+				p.Page = page
+				ads, err := conn.GetAds(ctx, alice, p)
+				assert.NoError(t, err)
+				got = append(got, feedIds(ads)...)
+			}
+			assert.Equal(t, []int{ids[1], ids[3], ids[0], ids[4], ids[2]}, got)
+			p.Page = 3
+			ads, err := conn.GetAds(ctx, alice, p)
+			assert.NoError(t, err)
+			assert.Empty(t, ads)
+		})
+		t.Run("Feed fields", func(t *testing.T) {
+			ads, err := conn.GetAds(ctx, alice, params(types.SORT_BY_DATE, types.ORDER_BY_ASC))
+			assert.NoError(t, err)
+			ad := ads[0]
+			assert.Equal(t, "mock_title", ad.Title)
+			assert.Equal(t, "mock_content", ad.Content)
+			assert.Equal(t, "http://mocksite.com/image.jpg", ad.ImageUrl)
+			assert.Equal(t, 30, ad.Price)
+			assert.Equal(t, alice, ad.AuthorId)
+			assert.WithinDuration(t, time.Now(), ad.CreatedAt, time.Minute)
+			for _, ad := range ads {
+				assert.Equal(t, ad.AuthorId == alice, ad.IsYours)
+			}
+		})
+		t.Run("Anonymous", func(t *testing.T) {
+			ads, err := conn.GetAds(ctx, 0, params(types.SORT_BY_DATE, types.ORDER_BY_ASC))
+			assert.NoError(t, err)
+			for _, ad := range ads {
+				assert.False(t, ad.IsYours)
+			}
+		})
+	})
+
+	t.Run("Sort keys", func(t *testing.T) {
+		conn := newConn(t)
+		alice, _ := conn.CreateUser(ctx, "alice_name", "mock_hash")
+		var ids []int
+		for _, price := range []int{20, 10, 20, 10, 20} {
+			id, err := conn.CreateAd(ctx, newAd("mock_title", price), alice)
+			assert.NoError(t, err)
+			ids = append(ids, id)
+			time.Sleep(time.Millisecond)
+		}
+		params := func(sortBy types.SORT_BY, orderBy types.ORDER_BY) types.GetAdParams {
+			return types.GetAdParams{PageSize: 10, SortBy: sortBy, OrderBy: orderBy}
+		}
+
+		cases := []struct {
+			name   string
+			params types.GetAdParams
+			want   []int
+		}{
+			{"Ties by id", params(types.SORT_BY_PRICE, types.ORDER_BY_ASC), []int{ids[1], ids[3], ids[0], ids[2], ids[4]}},
+			{"Ties by id desc", params(types.SORT_BY_PRICE, types.ORDER_BY_DESC), []int{ids[4], ids[2], ids[0], ids[3], ids[1]}},
+			{"Per key direction", params("price:asc,created_at:desc", types.ORDER_BY_ASC), []int{ids[3], ids[1], ids[4], ids[2], ids[0]}},
+			{"Default direction", params("price:desc,created_at", types.ORDER_BY_ASC), []int{ids[0], ids[2], ids[4], ids[1], ids[3]}},
+			{"Explicit id", params("id:desc", types.ORDER_BY_ASC), []int{ids[4], ids[3], ids[2], ids[1], ids[0]}},
+		}
+		for _, c := range cases {
+			t.Run(c.name, func(t *testing.T) {
+				ads, err := conn.GetAds(ctx, alice, c.params)
+				assert.NoError(t, err)
+				assert.Equal(t, c.want, feedIds(ads))
+			})
+		}
+		t.Run("Pages do not overlap", func(t *testing.T) {
+			p := params(types.SORT_BY_PRICE, types.ORDER_BY_DESC)
+			p.PageSize = 2
+			var got []int
+			for page := 0; page < 3; page++ {
+				p.Page = page
+				ads, err := conn.GetAds(ctx, alice, p)
+				assert.NoError(t, err)
+				got = append(got, feedIds(ads)...)
+			}
+			assert.Equal(t, []int{ids[4], ids[2], ids[0], ids[3], ids[1]}, got)
+		})
+	})
+
+	t.Run("Location", func(t *testing.T) {
+		conn := newConn(t)
+		alice, _ := conn.CreateUser(ctx, "alice_name", "mock_hash")
+		located := func(title string, lat, lon float64, city string) types.AdDto {
+			dto := newAd(title, 100)
+			dto.Latitude, dto.Longitude, dto.City = &lat, &lon, city
+			return dto
+		}
+		var ids []int
+		for _, dto := range []types.AdDto{
+			located("spb", 59.9343, 30.3351, "Санкт-Петербург"),
+			newAd("nowhere", 100),
+			located("moscow", 55.7558, 37.6173, "Москва"),
+			located("tver", 56.8587, 35.9176, ""),
+			located("chukotka", 65, -179.5, ""),
+		} {
+			id, err := conn.CreateAd(ctx, dto, alice)
+			assert.NoError(t, err)
+			ids = append(ids, id)
+		}
+		params := func(lat, lon, radiusKm float64, sortBy types.SORT_BY) types.GetAdParams {
+			return types.GetAdParams{PageSize: 10, SortBy: sortBy, OrderBy: types.ORDER_BY_ASC, Lat: lat, Lon: lon, Near: true, RadiusKm: radiusKm}
+		}
+
+		t.Run("Fields", func(t *testing.T) {
+			ads, err := conn.GetAds(ctx, alice, types.GetAdParams{PageSize: 10, SortBy: types.SORT_BY_ID, OrderBy: types.ORDER_BY_ASC})
+			assert.NoError(t, err)
+			if assert.Len(t, ads, 5) {
+				assert.Equal(t, 59.9343, *ads[0].Latitude)
+				assert.Equal(t, 30.3351, *ads[0].Longitude)
+				assert.Equal(t, "Санкт-Петербург", ads[0].City)
+				assert.Nil(t, ads[0].DistanceKm, "no point, no distance")
+				assert.Nil(t, ads[1].Latitude)
+				assert.Empty(t, ads[1].City)
+			}
+		})
+		cases := []struct {
+			name   string
+			params types.GetAdParams
+			want   []int
+		}{
+			{"Radius", params(55.7558, 37.6173, 200, types.SORT_BY_ID), []int{ids[2], ids[3]}},
+			{"Nearest first", params(55.7558, 37.6173, 0, types.SORT_BY_DISTANCE), []int{ids[2], ids[3], ids[0], ids[4], ids[1]}},
+			{"Farthest first", params(55.7558, 37.6173, 0, "distance:desc"), []int{ids[4], ids[0], ids[3], ids[2], ids[1]}},
+			{"Across the antimeridian", params(65, 179.5, 100, types.SORT_BY_ID), []int{ids[4]}},
+		}
+		for _, c := range cases {
+			t.Run(c.name, func(t *testing.T) {
+				ads, err := conn.GetAds(ctx, alice, c.params)
+				assert.NoError(t, err)
+				assert.Equal(t, c.want, feedIds(ads))
+			})
+		}
+		t.Run("Distance", func(t *testing.T) {
+			ads, err := conn.GetAds(ctx, alice, params(55.7558, 37.6173, 1000, types.SORT_BY_DISTANCE))
+			assert.NoError(t, err)
+			if assert.Len(t, ads, 3) {
+				assert.Equal(t, 0.0, *ads[0].DistanceKm)
+				assert.InDelta(t, 634, *ads[2].DistanceKm, 1)
+			}
+		})
+		t.Run("Invalid", func(t *testing.T) {
+			lat := 91.0
+			dto := newAd("mock_title", 100)
+			dto.Latitude, dto.Longitude = &lat, &lat
+			_, err := conn.CreateAd(ctx, dto, alice)
+			assertConstraint(t, ErrInvalid, "latitude", err)
+			dto.Longitude = nil
+			lat = 10
+			_, err = conn.CreateAd(ctx, dto, alice)
+			assertConstraint(t, ErrInvalid, "location", err)
+			_, err = conn.GetAds(ctx, alice, types.GetAdParams{PageSize: 10, SortBy: types.SORT_BY_DISTANCE, OrderBy: types.ORDER_BY_ASC})
+			assert.ErrorIs(t, err, ErrInvalidParams)
+		})
+	})
+
+	t.Run("Filters", func(t *testing.T) {
+		conn := newConn(t)
+		alice, _ := conn.CreateUser(ctx, "alice_name", "mock_hash")
+		bob, _ := conn.CreateUser(ctx, "bob_the_name", "mock_hash")
+		var ids []int
+		for i, userId := range []int{alice, bob, alice, bob, alice} {
+			dto := newAd("mock_title", 10+i)
+			if i == 1 || i == 4 {
+				dto.ImageUrl = ""
+			}
+			id, err := conn.CreateAd(ctx, dto, userId)
+			assert.NoError(t, err)
+			ids = append(ids, id)
+			time.Sleep(time.Millisecond)
+		}
+		all, err := conn.GetAds(ctx, alice, types.GetAdParams{PageSize: 10, SortBy: types.SORT_BY_DATE, OrderBy: types.ORDER_BY_ASC})
+		assert.NoError(t, err)
+		if !assert.Len(t, all, 5) {
+			return
+		}
+		params := func(set func(p *types.GetAdParams)) types.GetAdParams {
+			p := types.GetAdParams{PageSize: 10, SortBy: types.SORT_BY_DATE, OrderBy: types.ORDER_BY_ASC}
+			set(&p)
+			return p
+		}
+
+		cases := []struct {
+			name   string
+			userId int
+			params types.GetAdParams
+			want   []int
+		}{
+			{"Created after", alice, params(func(p *types.GetAdParams) { p.CreatedAfter = all[1].CreatedAt }), ids[2:]},
+			{"Created before", alice, params(func(p *types.GetAdParams) { p.CreatedBefore = all[1].CreatedAt }), ids[:1]},
+			{"Created between", alice, params(func(p *types.GetAdParams) {
+				p.CreatedAfter, p.CreatedBefore = all[0].CreatedAt, all[4].CreatedAt
+			}), ids[1:4]},
+			{"Author", 0, params(func(p *types.GetAdParams) { p.AuthorId = bob }), []int{ids[1], ids[3]}},
+			{"Only mine", alice, params(func(p *types.GetAdParams) { p.OnlyMine = true }), []int{ids[0], ids[2], ids[4]}},
+			{"Only mine anonymous", 0, params(func(p *types.GetAdParams) { p.OnlyMine = true }), []int{}},
+			{"Exclude mine", alice, params(func(p *types.GetAdParams) { p.ExcludeMine = true }), []int{ids[1], ids[3]}},
+			{"Exclude mine anonymous", 0, params(func(p *types.GetAdParams) { p.ExcludeMine = true }), ids},
+			{"With image", alice, params(func(p *types.GetAdParams) { p.HasImage = types.IMAGE_WITH }), []int{ids[0], ids[2], ids[3]}},
+			{"Without image", alice, params(func(p *types.GetAdParams) { p.HasImage = types.IMAGE_WITHOUT }), []int{ids[1], ids[4]}},
+			{"Combined", alice, params(func(p *types.GetAdParams) {
+				p.AuthorId, p.HasImage, p.MinPrice = alice, types.IMAGE_WITH, 11
+			}), []int{ids[2]}},
+		}
+		for _, c := range cases {
+			t.Run(c.name, func(t *testing.T) {
+				ads, err := conn.GetAds(ctx, c.userId, c.params)
+				assert.NoError(t, err)
+				assert.Equal(t, c.want, feedIds(ads))
+			})
+		}
+	})
+
+	t.Run("For each user ad", func(t *testing.T) {
+		conn := newConn(t)
+		alice, _ := conn.CreateUser(ctx, "alice_name", "mock_hash")
+		bob, _ := conn.CreateUser(ctx, "bob_the_name", "mock_hash")
+		first, _ := conn.CreateAd(ctx, newAd("mock_title", 20), alice)
+		conn.CreateAd(ctx, newAd("mock_title", 30), bob)
+		second, _ := conn.CreateAd(ctx, newAd("mock_title", 10), alice)
+
+		var got []types.AdFeed
+		err := conn.ForEachUserAd(ctx, alice, func(ad types.AdFeed) error {
+			got = append(got, ad)
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []int{first, second}, feedIds(got))
+		assert.True(t, got[0].IsYours)
+
+		stop := errors.New("stop")
+		calls := 0
+		err = conn.ForEachUserAd(ctx, alice, func(ad types.AdFeed) error {
+			calls++
+			return stop
+		})
+		assert.Equal(t, stop, err)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("Delete users", func(t *testing.T) {
+		conn := newConn(t)
+		alice, _ := conn.CreateUser(ctx, "alice_name", "mock_hash")
+		bob, _ := conn.CreateUser(ctx, "bob_the_name", "mock_hash")
+		conn.CreateAd(ctx, newAd("mock_title", 10), alice)
+		bobAd, _ := conn.CreateAd(ctx, newAd("mock_title", 20), bob)
+
+		at := time.Now().Add(time.Hour)
+		assert.NoError(t, conn.ScheduleUserDeletion(ctx, alice, at))
+		assert.Equal(t, ErrNotFound, conn.ScheduleUserDeletion(ctx, bob+100, at))
+		user, err := conn.GetUserById(ctx, alice)
+		assert.NoError(t, err)
+		if assert.NotNil(t, user.DeleteAt) {
+			assert.True(t, at.Truncate(time.Microsecond).Equal(*user.DeleteAt))
+		}
+
+		n, err := conn.PurgeUsers(ctx, time.Now())
+		assert.NoError(t, err)
+		assert.Zero(t, n, "not due yet")
+		assert.NoError(t, conn.CancelUserDeletion(ctx, alice))
+		user, _ = conn.GetUserById(ctx, alice)
+		assert.Nil(t, user.DeleteAt)
+
+		conn.ScheduleUserDeletion(ctx, alice, time.Now().Add(-time.Minute))
+		n, err = conn.PurgeUsers(ctx, time.Now())
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), n)
+		_, err = conn.GetUserById(ctx, alice)
+		assert.Equal(t, ErrNotFound, err)
+		ads, err := conn.GetAds(ctx, 0, types.GetAdParams{PageSize: 10, MinPrice: 1, MaxPrice: 1_000_000, SortBy: types.SORT_BY_DATE, OrderBy: types.ORDER_BY_ASC})
+		assert.NoError(t, err)
+		assert.Equal(t, []int{bobAd}, feedIds(ads), "ads are deleted with the user")
+
+		assert.NoError(t, conn.DeleteUser(ctx, bob))
+		assert.Equal(t, ErrNotFound, conn.DeleteUser(ctx, bob))
+		ads, err = conn.GetAds(ctx, 0, types.GetAdParams{PageSize: 10, MinPrice: 1, MaxPrice: 1_000_000, SortBy: types.SORT_BY_DATE, OrderBy: types.ORDER_BY_ASC})
+		assert.NoError(t, err)
+		assert.Empty(t, ads)
+	})
+}
+
+func TestMemoryConnectionConcurrency(t *testing.T) {
+	conn := NewMemoryConnection()
+	ctx := context.Background()
+	userId, _ := conn.CreateUser(ctx, "mock_name", "mock_hash")
+	done := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for j := 0; j < 50; j++ {
+				conn.CreateAd(ctx, newAd("mock_title", j+1), userId)
+				conn.GetAds(ctx, userId, types.GetAdParams{PageSize: 10, MinPrice: 1, MaxPrice: 1_000_000, SortBy: types.SORT_BY_PRICE, OrderBy: types.ORDER_BY_DESC})
+			}
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		<-done
+	}
+	n := 0
+	conn.ForEachUserAd(ctx, userId, func(types.AdFeed) error { n++; return nil })
+	assert.Equal(t, 400, n)
+}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v4"
+)
+
+var (
+	ErrNotFound  = errors.New("not found")
+	ErrConflict  = errors.New("already exists")
+	ErrInvalid   = errors.New("violates a constraint")
+	ErrReference = errors.New("references a missing row")
+)
+
+// ConstraintError is a write rejected by the schema. It matches its Kind,
+// one of ErrConflict, ErrInvalid and ErrReference, with errors.Is and
+// unwraps to the driver error.
+type ConstraintError struct {
+	Kind       error
+	Table      string
+	Constraint string
+	// Column is empty when the driver does not tell which column it was
+	Column string
+	Err    error
+}
+
+func (e *ConstraintError) Error() string {
+	if e.Column == "" {
+		return fmt.Sprintf("%s: %s", e.Kind, e.Err)
+	}
+	return fmt.Sprintf("%s.%s %s", e.Table, e.Column, e.Kind)
+}
+
+func (e *ConstraintError) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *ConstraintError) Unwrap() error {
+	return e.Err
+}
+
+// translateErr turns driver errors the callers can act upon into the errors
+// above, others are returned as is.
+func translateErr(err error) error {
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNotFound
+	}
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return err
+	}
+	var kind error
+	switch pgErr.Code {
+	case pgerrcode.UniqueViolation:
+		kind = ErrConflict
+	case pgerrcode.CheckViolation, pgerrcode.NotNullViolation, pgerrcode.StringDataRightTruncationDataException:
+		kind = ErrInvalid
+	case pgerrcode.ForeignKeyViolation:
+		kind = ErrReference
+	default:
+		return err
+	}
+	return &ConstraintError{
+		Kind:       kind,
+		Table:      pgErr.TableName,
+		Constraint: pgErr.ConstraintName,
+		Column:     constraintColumn(pgErr),
+		Err:        err,
+	}
+}
+
+// constraintColumn relies on the default naming of Postgres constraints,
+// <table>_<column>_key, _check and _fkey.
+func constraintColumn(pgErr *pgconn.PgError) string {
+	if pgErr.ColumnName != "" {
+		return pgErr.ColumnName
+	}
+	column, ok := strings.CutPrefix(pgErr.ConstraintName, pgErr.TableName+"_")
+	if !ok || pgErr.TableName == "" {
+		return ""
+	}
+	for _, suffix := range []string{"_key", "_check", "_fkey"} {
+		if c, ok := strings.CutSuffix(column, suffix); ok {
+			return c
+		}
+	}
+	return ""
+}
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"math"
+	"vk-feed/types"
+)
+
+const earthRadiusKm = 6371.0
+
+// distanceSQL is the haversine distance in km from the point bound to its
+// placeholders, latitude, latitude and longitude, to the ad. LEAST keeps
+// rounding from pushing the argument of ASIN out of its domain.
+const distanceSQL = "12742 * ASIN(LEAST(1, SQRT(" +
+	"POWER(SIN(RADIANS(latitude - ?) / 2), 2) + " +
+	"COS(RADIANS(?)) * COS(RADIANS(latitude)) * POWER(SIN(RADIANS(longitude - ?) / 2), 2))))"
+
+// distanceKm mirrors distanceSQL.
+func distanceKm(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	h := math.Pow(math.Sin((lat2-lat1)*rad/2), 2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Pow(math.Sin((lon2-lon1)*rad/2), 2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// boundingBox returns the latitudes and longitudes the circle of radiusKm
+// around lat, lon fits in. minLon > maxLon when the box crosses the
+// antimeridian, wholeLon when the circle takes a pole in and every
+// longitude is in range.
+func boundingBox(lat, lon, radiusKm float64) (minLat, maxLat, minLon, maxLon float64, wholeLon bool) {
+	deg := 180 / math.Pi
+	angle := radiusKm / earthRadiusKm
+	minLat, maxLat = lat-angle*deg, lat+angle*deg
+	if minLat <= -90 || maxLat >= 90 {
+		return max(minLat, -90), min(maxLat, 90), -180, 180, true
+	}
+	// the widest longitude of the circle, at a latitude a bit closer to the
+	// pole than its center
+	dLon := math.Asin(math.Sin(angle)/math.Cos(lat*math.Pi/180)) * deg
+	minLon, maxLon = lon-dLon, lon+dLon
+	if minLon < -180 {
+		minLon += 360
+	}
+	if maxLon > 180 {
+		maxLon -= 360
+	}
+	return minLat, maxLat, minLon, maxLon, false
+}
+
+// withDistance sets the distance of ad from the point of params, rounded to
+// meters.
+func withDistance(ad types.AdFeed, params types.GetAdParams) types.AdFeed {
+	if params.Near && ad.Latitude != nil && ad.Longitude != nil {
+		d := math.Round(distanceKm(params.Lat, params.Lon, *ad.Latitude, *ad.Longitude)*1000) / 1000
+		ad.DistanceKm = &d
+	}
+	return ad
+}
@@ -0,0 +1,40 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDistanceKm(t *testing.T) {
+	assert.Equal(t, 0.0, distanceKm(55.7558, 37.6173, 55.7558, 37.6173))
+	assert.InDelta(t, 634, distanceKm(55.7558, 37.6173, 59.9343, 30.3351), 1)
+	assert.InDelta(t, 20015, distanceKm(0, 0, 0, 180), 1, "half the equator")
+	assert.InDelta(t, 47, distanceKm(65, 179.5, 65, -179.5), 1, "across the antimeridian")
+}
+
+func TestBoundingBox(t *testing.T) {
+	t.Run("Plain", func(t *testing.T) {
+		minLat, maxLat, minLon, maxLon, wholeLon := boundingBox(55.7558, 37.6173, 100)
+		assert.False(t, wholeLon)
+		assert.InDelta(t, 54.86, minLat, 0.01)
+		assert.InDelta(t, 56.65, maxLat, 0.01)
+		assert.InDelta(t, 36.02, minLon, 0.01)
+		assert.InDelta(t, 39.21, maxLon, 0.01)
+		// the widest points of the circle are in the box
+		assert.InDelta(t, 100, distanceKm(55.7558, 37.6173, 55.7558, maxLon), 1)
+	})
+	t.Run("Antimeridian", func(t *testing.T) {
+		_, _, minLon, maxLon, wholeLon := boundingBox(65, 179.5, 100)
+		assert.False(t, wholeLon)
+		assert.Greater(t, minLon, maxLon)
+		assert.InDelta(t, 177.4, minLon, 0.1)
+		assert.InDelta(t, -178.4, maxLon, 0.1)
+	})
+	t.Run("Pole", func(t *testing.T) {
+		minLat, maxLat, _, _, wholeLon := boundingBox(89.5, 0, 100)
+		assert.True(t, wholeLon)
+		assert.InDelta(t, 88.6, minLat, 0.1)
+		assert.Equal(t, 90.0, maxLat)
+	})
+}
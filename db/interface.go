@@ -1,10 +1,32 @@
 package db
 
-import "vk-feed/types"
+import (
+	"context"
+	"time"
+	"vk-feed/types"
+)
 
 type DBConnection interface {
-	CreateUser(name, password string) (int, error)
-	GetUserByName(name string) (int, string, error)
-	CreateAd(dto types.AdDto, userId int) (int, error)
-	GetAds(userId int, params types.GetAdParams) ([]types.AdFeed, error)
+	CreateUser(ctx context.Context, name, password string) (int, error)
+	GetUserByName(ctx context.Context, name string) (int, string, error)
+	GetUserById(ctx context.Context, id int) (types.User, error)
+	// GetUserPassword reads the password hash from the primary, replicas
+	// may not have a recent change yet. For checks before destructive
+	// operations.
+	GetUserPassword(ctx context.Context, id int) (string, error)
+	// DeleteUser deletes the user along with their ads.
+	DeleteUser(ctx context.Context, id int) error
+	ScheduleUserDeletion(ctx context.Context, id int, at time.Time) error
+	CancelUserDeletion(ctx context.Context, id int) error
+	// PurgeUsers deletes the users scheduled for deletion before the given
+	// time and returns how many were deleted.
+	PurgeUsers(ctx context.Context, before time.Time) (int64, error)
+	CreateAd(ctx context.Context, dto types.AdDto, userId int) (int, error)
+	// CreateAds inserts all the ads in one transaction, ids are returned in
+	// the order of dtos.
+	CreateAds(ctx context.Context, dtos []types.AdDto, userId int) ([]int, error)
+	GetAds(ctx context.Context, userId int, params types.GetAdParams) ([]types.AdFeed, error)
+	// ForEachUserAd calls fn for every ad of the user without loading them
+	// all into memory, iteration stops at the first error.
+	ForEachUserAd(ctx context.Context, userId int, fn func(types.AdFeed) error) error
 }
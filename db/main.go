@@ -2,17 +2,149 @@ package db
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"time"
+	"vk-feed/config"
 
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4/pgxpool"
+	log "github.com/sirupsen/logrus"
 )
 
-func Init(url string) (PgxConnection, error) {
-	pool, err := pgxpool.Connect(context.Background(), url)
+const (
+	initialBackoff = 250 * time.Millisecond
+	maxBackoff     = 5 * time.Second
+)
+
+// Init connects to the database at url. While it is not accepting
+// connections yet, Init retries with exponential backoff until
+// opts.ConnectTimeout runs out or ctx is done. Replicas are not waited for,
+// reads go to the primary until they pass a health check.
+func Init(ctx context.Context, url string, opts config.Db) (PgxConnection, error) {
+	cfg, err := poolConfig(url, opts)
 	if err != nil {
 		return PgxConnection{}, err
 	}
-	if err := pool.Ping(context.Background()); err != nil {
-		return PgxConnection{}, err
+	if opts.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.ConnectTimeout)
+		defer cancel()
+	}
+	for attempt := 1; ; attempt++ {
+		pool, err := connect(ctx, cfg)
+		if err == nil {
+			log.WithField("attempts", attempt).Info("database connected")
+			conn := PgxConnection{Client: pool, state: &connState{}}
+			conn.state.up.Store(true)
+			if len(opts.ReplicaUrls) > 0 {
+				replicas, err := connectReplicas(ctx, opts.ReplicaUrls, opts)
+				if err != nil {
+					pool.Close()
+					return PgxConnection{}, err
+				}
+				conn.replicas = newReplicaSet(replicas, opts.ReadYourWritesWindow)
+				conn.replicas.check(ctx)
+				conn.replicas.watch(opts.HealthCheckPeriod)
+			}
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return PgxConnection{}, fmt.Errorf("database unavailable after %d attempts: %w", attempt, err)
+		}
+		if opts.ConnectTimeout == 0 || !retryable(err) {
+			return PgxConnection{}, err
+		}
+		delay := backoff(attempt)
+		log.WithError(err).WithField("attempt", attempt).Warnf("database unavailable, retrying in %s", delay.Round(time.Millisecond))
+		select {
+		case <-ctx.Done():
+			return PgxConnection{}, fmt.Errorf("database unavailable after %d attempts: %w", attempt, err)
+		case <-time.After(delay):
+		}
+	}
+}
+
+func poolConfig(url string, opts config.Db) (*pgxpool.Config, error) {
+	cfg, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		return nil, err
+	}
+	cfg.MaxConns = int32(opts.MaxConns)
+	cfg.MinConns = int32(opts.MinConns)
+	cfg.MaxConnLifetime = opts.MaxConnLifetime
+	cfg.MaxConnIdleTime = opts.MaxConnIdleTime
+	cfg.HealthCheckPeriod = opts.HealthCheckPeriod
+	if opts.StatementTimeout > 0 {
+		cfg.ConnConfig.RuntimeParams["statement_timeout"] = strconv.FormatInt(opts.StatementTimeout.Milliseconds(), 10)
+	}
+	return cfg, nil
+}
+
+func connect(ctx context.Context, cfg *pgxpool.Config) (*pgxpool.Pool, error) {
+	pool, err := pgxpool.ConnectConfig(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return pool, nil
+}
+
+// retryable tells whether waiting can fix err. A server that refuses the
+// credentials or the database name will keep refusing them.
+func retryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code[:2] {
+		case "28", "3D":
+			return false
+		}
+	}
+	return true
+}
+
+// backoff returns the delay before the next attempt: it doubles from
+// initialBackoff up to maxBackoff and a random half of it is taken off, so
+// replicas started together do not retry in lockstep.
+func backoff(attempt int) time.Duration {
+	ceiling := maxBackoff
+	if attempt < 16 && initialBackoff<<(attempt-1) < maxBackoff {
+		ceiling = initialBackoff << (attempt - 1)
 	}
-	return PgxConnection{Client: pool}, nil
+	return ceiling/2 + time.Duration(rand.Int63n(int64(ceiling/2)+1))
+}
+
+// connState logs when the database goes away and comes back, as noticed by
+// Ping.
+type connState struct {
+	up atomic.Bool
+}
+
+func (s *connState) set(err error) {
+	if s == nil {
+		return
+	}
+	if err == nil && !s.up.Swap(true) {
+		log.Info("database connection restored")
+	} else if err != nil && s.up.Swap(false) {
+		log.WithError(err).Warn("database connection lost")
+	}
+}
+
+// Close closes the primary and the replica pools.
+func (conn PgxConnection) Close() {
+	conn.replicas.close()
+	conn.Client.Close()
+}
+
+func (conn PgxConnection) Ping(ctx context.Context) error {
+	err := conn.Client.Ping(ctx)
+	conn.state.set(err)
+	return err
 }
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+	"vk-feed/config"
+	"vk-feed/pgtest"
+
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(pgtest.Run(m))
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 1; attempt <= 100; attempt++ {
+		ceiling := maxBackoff
+		if attempt <= 5 {
+			ceiling = initialBackoff << (attempt - 1)
+		}
+		delay := backoff(attempt)
+		assert.GreaterOrEqual(t, delay, ceiling/2, "attempt %d", attempt)
+		assert.LessOrEqual(t, delay, ceiling, "attempt %d", attempt)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	assert.True(t, retryable(errors.New("connection refused")))
+	assert.True(t, retryable(&pgconn.PgError{Code: "57P03"}), "the database system is starting up")
+	assert.False(t, retryable(&pgconn.PgError{Code: "28P01"}), "wrong password")
+	assert.False(t, retryable(fmt.Errorf("connect: %w", &pgconn.PgError{Code: "3D000"})), "no such database")
+}
+
+func TestPoolConfig(t *testing.T) {
+	opts := config.Default().Db
+	opts.MinConns = 2
+	opts.StatementTimeout = 1500 * time.Millisecond
+	cfg, err := poolConfig("postgres://postgres@localhost/postgres", opts)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 10, cfg.MaxConns)
+	assert.EqualValues(t, 2, cfg.MinConns)
+	assert.Equal(t, time.Hour, cfg.MaxConnLifetime)
+	assert.Equal(t, "1500", cfg.ConnConfig.RuntimeParams["statement_timeout"])
+
+	opts.StatementTimeout = 0
+	cfg, _ = poolConfig("postgres://postgres@localhost/postgres", opts)
+	assert.NotContains(t, cfg.ConnConfig.RuntimeParams, "statement_timeout")
+
+	_, err = poolConfig("monke://", opts)
+	assert.Error(t, err)
+}
+
+func TestInit(t *testing.T) {
+	// a port nothing listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	url := fmt.Sprintf("postgres://postgres@%s/postgres?sslmode=disable", l.Addr())
+	l.Close()
+
+	t.Run("gives up at the deadline", func(t *testing.T) {
+		opts := config.Default().Db
+		opts.ConnectTimeout = 600 * time.Millisecond
+		start := time.Now()
+		_, err := Init(context.Background(), url, opts)
+		assert.ErrorContains(t, err, "database unavailable after")
+		assert.GreaterOrEqual(t, time.Since(start), opts.ConnectTimeout)
+		assert.Less(t, time.Since(start), opts.ConnectTimeout+maxBackoff)
+	})
+	t.Run("no timeout tries once", func(t *testing.T) {
+		opts := config.Default().Db
+		opts.ConnectTimeout = 0
+		_, err := Init(context.Background(), url, opts)
+		assert.Error(t, err)
+		assert.NotContains(t, err.Error(), "database unavailable after")
+	})
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err := Init(ctx, url, config.Default().Db)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,390 @@
+package db
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"time"
+	"unicode/utf8"
+	"vk-feed/types"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+)
+
+// MemoryUrl is the DB_URL that runs the service on a MemoryConnection.
+const MemoryUrl = "memory://"
+
+type memoryUser struct {
+	id       int
+	name     string
+	pass     string
+	deleteAt *time.Time
+}
+
+type memoryAd struct {
+	id        int
+	title     string
+	content   string
+	imageUrl  string
+	price     int
+	userId    int
+	createdAt time.Time
+	latitude  *float64
+	longitude *float64
+	city      string
+}
+
+// MemoryConnection keeps the data in memory, mirroring the constraints and
+// errors of the Postgres schema, for tests and local development.
+type MemoryConnection struct {
+	mu         sync.RWMutex
+	users      []memoryUser
+	ads        []memoryAd
+	lastUserId int
+	lastAdId   int
+}
+
+func NewMemoryConnection() *MemoryConnection {
+	return &MemoryConnection{}
+}
+
+func (conn *MemoryConnection) Ping(ctx context.Context) error {
+	return nil
+}
+
+// now mirrors NOW()::TIMESTAMP, a UTC time of microsecond precision.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+// constraintErr builds the error Postgres reports for the constraint and
+// translates it the way PgxConnection does.
+func constraintErr(code, table, constraint, format string, args ...any) error {
+	return translateErr(&pgconn.PgError{
+		Severity:       "ERROR",
+		Code:           code,
+		Message:        fmt.Sprintf(format, args...),
+		TableName:      table,
+		ConstraintName: constraint,
+	})
+}
+
+func tooLongErr(n int) error {
+	return translateErr(&pgconn.PgError{
+		Severity: "ERROR",
+		Code:     pgerrcode.StringDataRightTruncationDataException,
+		Message:  fmt.Sprintf("value too long for type character varying(%d)", n),
+	})
+}
+
+func (conn *MemoryConnection) userIndex(id int) int {
+	return slices.IndexFunc(conn.users, func(u memoryUser) bool { return u.id == id })
+}
+
+func (conn *MemoryConnection) CreateUser(ctx context.Context, name, password string) (int, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	// a failed insert still takes a value from the sequence
+	conn.lastUserId++
+	switch {
+	case utf8.RuneCountInString(name) > 16:
+		return 0, tooLongErr(16)
+	case utf8.RuneCountInString(password) > 88:
+		return 0, tooLongErr(88)
+	case utf8.RuneCountInString(name) < 8:
+		return 0, constraintErr(pgerrcode.CheckViolation, "usrs", "usrs_name_check",
+			`new row for relation "usrs" violates check constraint "usrs_name_check"`)
+	case slices.ContainsFunc(conn.users, func(u memoryUser) bool { return u.name == name }):
+		return 0, constraintErr(pgerrcode.UniqueViolation, "usrs", "usrs_name_key",
+			`duplicate key value violates unique constraint "usrs_name_key"`)
+	}
+	conn.users = append(conn.users, memoryUser{id: conn.lastUserId, name: name, pass: password})
+	return conn.lastUserId, nil
+}
+
+func (conn *MemoryConnection) GetUserByName(ctx context.Context, name string) (int, string, error) {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	i := slices.IndexFunc(conn.users, func(u memoryUser) bool { return u.name == name })
+	if i < 0 {
+		return 0, "", ErrNotFound
+	}
+	return conn.users[i].id, conn.users[i].pass, nil
+}
+
+func (conn *MemoryConnection) GetUserById(ctx context.Context, id int) (types.User, error) {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	i := conn.userIndex(id)
+	if i < 0 {
+		return types.User{}, ErrNotFound
+	}
+	u := conn.users[i]
+	user := types.User{Id: u.id, Name: u.name}
+	if u.deleteAt != nil {
+		deleteAt := *u.deleteAt
+		user.DeleteAt = &deleteAt
+	}
+	return user, nil
+}
+
+func (conn *MemoryConnection) GetUserPassword(ctx context.Context, id int) (string, error) {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	i := conn.userIndex(id)
+	if i < 0 {
+		return "", ErrNotFound
+	}
+	return conn.users[i].pass, nil
+}
+
+// deleteUsers removes the matching users with their ads, as ON DELETE
+// CASCADE does.
+func (conn *MemoryConnection) deleteUsers(match func(memoryUser) bool) int64 {
+	deleted := make(map[int]bool)
+	conn.users = slices.DeleteFunc(conn.users, func(u memoryUser) bool {
+		if match(u) {
+			deleted[u.id] = true
+		}
+		return deleted[u.id]
+	})
+	conn.ads = slices.DeleteFunc(conn.ads, func(ad memoryAd) bool { return deleted[ad.userId] })
+	return int64(len(deleted))
+}
+
+func (conn *MemoryConnection) DeleteUser(ctx context.Context, id int) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.deleteUsers(func(u memoryUser) bool { return u.id == id }) == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (conn *MemoryConnection) ScheduleUserDeletion(ctx context.Context, id int, at time.Time) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	i := conn.userIndex(id)
+	if i < 0 {
+		return ErrNotFound
+	}
+	at = at.UTC().Truncate(time.Microsecond)
+	conn.users[i].deleteAt = &at
+	return nil
+}
+
+func (conn *MemoryConnection) CancelUserDeletion(ctx context.Context, id int) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if i := conn.userIndex(id); i >= 0 {
+		conn.users[i].deleteAt = nil
+	}
+	return nil
+}
+
+func (conn *MemoryConnection) PurgeUsers(ctx context.Context, before time.Time) (int64, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.deleteUsers(func(u memoryUser) bool {
+		return u.deleteAt != nil && !u.deleteAt.After(before)
+	}), nil
+}
+
+// checkAd mirrors the column types and constraints of the ads table, the
+// caller holds the lock.
+func (conn *MemoryConnection) checkAd(dto types.AdDto, userId int) error {
+	switch {
+	case utf8.RuneCountInString(dto.Title) > 255:
+		return tooLongErr(255)
+	case utf8.RuneCountInString(dto.Title) < 2:
+		return constraintErr(pgerrcode.CheckViolation, "ads", "ads_title_check",
+			`new row for relation "ads" violates check constraint "ads_title_check"`)
+	case utf8.RuneCountInString(dto.Content) < 2:
+		return constraintErr(pgerrcode.CheckViolation, "ads", "ads_content_check",
+			`new row for relation "ads" violates check constraint "ads_content_check"`)
+	case dto.Price < 1 || dto.Price > 1_000_000:
+		return constraintErr(pgerrcode.CheckViolation, "ads", "ads_price_check",
+			`new row for relation "ads" violates check constraint "ads_price_check"`)
+	case utf8.RuneCountInString(dto.City) > 100:
+		return tooLongErr(100)
+	case dto.Latitude != nil && (*dto.Latitude < -90 || *dto.Latitude > 90):
+		return constraintErr(pgerrcode.CheckViolation, "ads", "ads_latitude_check",
+			`new row for relation "ads" violates check constraint "ads_latitude_check"`)
+	case dto.Longitude != nil && (*dto.Longitude < -180 || *dto.Longitude > 180):
+		return constraintErr(pgerrcode.CheckViolation, "ads", "ads_longitude_check",
+			`new row for relation "ads" violates check constraint "ads_longitude_check"`)
+	case (dto.Latitude == nil) != (dto.Longitude == nil):
+		return constraintErr(pgerrcode.CheckViolation, "ads", "ads_location_check",
+			`new row for relation "ads" violates check constraint "ads_location_check"`)
+	case conn.userIndex(userId) < 0:
+		return constraintErr(pgerrcode.ForeignKeyViolation, "ads", "ads_user_id_fkey",
+			`insert or update on table "ads" violates foreign key constraint "ads_user_id_fkey"`)
+	}
+	return nil
+}
+
+func (conn *MemoryConnection) insertAd(dto types.AdDto, userId int) int {
+	conn.lastAdId++
+	conn.ads = append(conn.ads, memoryAd{
+		id:        conn.lastAdId,
+		title:     dto.Title,
+		content:   dto.Content,
+		imageUrl:  dto.ImageUrl,
+		price:     dto.Price,
+		userId:    userId,
+		createdAt: now(),
+		latitude:  dto.Latitude,
+		longitude: dto.Longitude,
+		city:      dto.City,
+	})
+	return conn.lastAdId
+}
+
+func (conn *MemoryConnection) CreateAd(ctx context.Context, dto types.AdDto, userId int) (int, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if err := conn.checkAd(dto, userId); err != nil {
+		conn.lastAdId++
+		return 0, err
+	}
+	return conn.insertAd(dto, userId), nil
+}
+
+func (conn *MemoryConnection) CreateAds(ctx context.Context, dtos []types.AdDto, userId int) ([]int, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	for i, dto := range dtos {
+		if err := conn.checkAd(dto, userId); err != nil {
+			conn.lastAdId += i + 1
+			return nil, err
+		}
+	}
+	ids := make([]int, len(dtos))
+	for i, dto := range dtos {
+		ids[i] = conn.insertAd(dto, userId)
+	}
+	return ids, nil
+}
+
+func (ad memoryAd) feed(userId int) types.AdFeed {
+	return types.AdFeed{
+		Id:        ad.id,
+		Title:     ad.title,
+		Content:   ad.content,
+		ImageUrl:  ad.imageUrl,
+		Price:     ad.price,
+		CreatedAt: ad.createdAt,
+		AuthorId:  ad.userId,
+		IsYours:   ad.userId == userId,
+		Latitude:  ad.latitude,
+		Longitude: ad.longitude,
+		City:      ad.city,
+	}
+}
+
+// matches mirrors the WHERE clause of PgxConnection.GetAds, times are
+// compared at the microsecond precision of Postgres timestamps.
+func (ad memoryAd) matches(userId int, params types.GetAdParams) bool {
+	switch {
+	case params.MinPrice > 0 && ad.price < params.MinPrice,
+		params.MaxPrice > 0 && ad.price > params.MaxPrice,
+		!params.CreatedAfter.IsZero() && !ad.createdAt.After(params.CreatedAfter.Truncate(time.Microsecond)),
+		!params.CreatedBefore.IsZero() && !ad.createdAt.Before(params.CreatedBefore.Truncate(time.Microsecond)),
+		params.AuthorId != 0 && ad.userId != params.AuthorId,
+		params.OnlyMine && ad.userId != userId,
+		params.ExcludeMine && ad.userId == userId,
+		params.HasImage == types.IMAGE_WITH && ad.imageUrl == "",
+		params.HasImage == types.IMAGE_WITHOUT && ad.imageUrl != "",
+		params.Near && params.RadiusKm > 0 && (ad.latitude == nil || ad.distance(params) > params.RadiusKm):
+		return false
+	}
+	return true
+}
+
+// distance is from the point of params, +Inf without a location.
+func (ad memoryAd) distance(params types.GetAdParams) float64 {
+	if ad.latitude == nil {
+		return math.Inf(1)
+	}
+	return distanceKm(params.Lat, params.Lon, *ad.latitude, *ad.longitude)
+}
+
+func (conn *MemoryConnection) GetAds(ctx context.Context, userId int, params types.GetAdParams) ([]types.AdFeed, error) {
+	columns, directions, err := sortOf(params)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := offsetOf(params)
+	if err != nil {
+		return nil, err
+	}
+	compare := func(a, b memoryAd) int {
+		for i, column := range columns {
+			var c int
+			switch column {
+			case "created_at":
+				c = a.createdAt.Compare(b.createdAt)
+			case "price":
+				c = cmp.Compare(a.price, b.price)
+			case "id":
+				c = cmp.Compare(a.id, b.id)
+			case "distance":
+				x, y := a.distance(params), b.distance(params)
+				if math.IsInf(x, 1) != math.IsInf(y, 1) {
+					// NULLS LAST whatever the direction
+					return cmp.Compare(x, y)
+				}
+				c = cmp.Compare(x, y)
+			}
+			if directions[i] == "DESC" {
+				c = -c
+			}
+			if c != 0 {
+				return c
+			}
+		}
+		return 0
+	}
+
+	conn.mu.RLock()
+	var ads []memoryAd
+	for _, ad := range conn.ads {
+		if ad.matches(userId, params) {
+			ads = append(ads, ad)
+		}
+	}
+	conn.mu.RUnlock()
+
+	slices.SortFunc(ads, compare)
+
+	if offset >= len(ads) || params.PageSize <= 0 {
+		return nil, nil
+	}
+	ads = ads[offset:min(offset+params.PageSize, len(ads))]
+	res := make([]types.AdFeed, len(ads))
+	for i, ad := range ads {
+		res[i] = withDistance(ad.feed(userId), params)
+	}
+	return res, nil
+}
+
+func (conn *MemoryConnection) ForEachUserAd(ctx context.Context, userId int, fn func(types.AdFeed) error) error {
+	conn.mu.RLock()
+	var ads []memoryAd
+	for _, ad := range conn.ads {
+		if ad.userId == userId {
+			ads = append(ads, ad)
+		}
+	}
+	conn.mu.RUnlock()
+	for _, ad := range ads {
+		if err := fn(ad.feed(userId)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
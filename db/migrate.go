@@ -0,0 +1,250 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	log "github.com/sirupsen/logrus"
+)
+
+// migrationLockId is the key of the advisory lock held while migrating so
+// concurrently starting replicas apply migrations one at a time.
+const migrationLockId = 7_284_913_001
+
+var ErrDirtySchema error = errors.New("database schema is dirty")
+var ErrSchemaMismatch error = errors.New("database schema version mismatch")
+
+var migrationFileRe = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Version int
+	Dirty   bool
+	Latest  int
+	Pending []Migration
+}
+
+// Migrator applies migrations using the same schema_migrations table layout
+// as golang-migrate, so databases migrated by the migrate/migrate container
+// are picked up as is.
+type Migrator struct {
+	pool       *pgxpool.Pool
+	migrations []Migration
+}
+
+func NewMigrator(conn PgxConnection, fsys fs.FS) (Migrator, error) {
+	migrations, err := LoadMigrations(fsys)
+	if err != nil {
+		return Migrator{}, err
+	}
+	return Migrator{pool: conn.Client, migrations: migrations}, nil
+}
+
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := migrationFileRe.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, err
+		}
+		content, err := fs.ReadFile(fsys, path.Join(".", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has conflicting names %q and %q", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+	out := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", m.Version, m.Name)
+		}
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// Latest is the schema version the code expects to run against.
+func (m Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Up applies all pending migrations, each in its own transaction.
+func (m Migrator) Up(ctx context.Context) (applied int, err error) {
+	err = m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		version, dirty, err := currentVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if dirty {
+			return ErrDirtySchema
+		}
+		for _, migration := range m.migrations {
+			if migration.Version <= version {
+				continue
+			}
+			log.Infof("applying migration %d_%s", migration.Version, migration.Name)
+			if err := applyMigration(ctx, conn, migration.Up, migration.Version); err != nil {
+				return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+			applied++
+		}
+		return nil
+	})
+	return
+}
+
+// Down rolls back the given number of most recently applied migrations.
+func (m Migrator) Down(ctx context.Context, steps int) (reverted int, err error) {
+	err = m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		version, dirty, err := currentVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if dirty {
+			return ErrDirtySchema
+		}
+		for i := len(m.migrations) - 1; i >= 0 && reverted < steps; i-- {
+			migration := m.migrations[i]
+			if migration.Version > version {
+				continue
+			}
+			if migration.Down == "" {
+				return fmt.Errorf("migration %d_%s has no down file", migration.Version, migration.Name)
+			}
+			previous := 0
+			if i > 0 {
+				previous = m.migrations[i-1].Version
+			}
+			log.Infof("reverting migration %d_%s", migration.Version, migration.Name)
+			if err := applyMigration(ctx, conn, migration.Down, previous); err != nil {
+				return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+			reverted++
+		}
+		return nil
+	})
+	return
+}
+
+func (m Migrator) Status(ctx context.Context) (status MigrationStatus, err error) {
+	conn, err := m.pool.Acquire(ctx)
+	if err != nil {
+		return
+	}
+	defer conn.Release()
+	status.Latest = m.Latest()
+	status.Version, status.Dirty, err = currentVersion(ctx, conn)
+	if err != nil {
+		return
+	}
+	for _, migration := range m.migrations {
+		if migration.Version > status.Version {
+			status.Pending = append(status.Pending, migration)
+		}
+	}
+	return
+}
+
+// Check returns an error unless the database is at the latest version.
+func (m Migrator) Check(ctx context.Context) error {
+	status, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+	if status.Dirty {
+		return ErrDirtySchema
+	}
+	if status.Version != status.Latest {
+		return fmt.Errorf("%w: database is at version %d, expected %d", ErrSchemaMismatch, status.Version, status.Latest)
+	}
+	return nil
+}
+
+func (m Migrator) withLock(ctx context.Context, fn func(conn *pgxpool.Conn) error) error {
+	conn, err := m.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", migrationLockId); err != nil {
+		return err
+	}
+	defer func() {
+		if _, err := conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockId); err != nil {
+			log.Error(err)
+		}
+	}()
+	if _, err := conn.Exec(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations (version BIGINT NOT NULL PRIMARY KEY, dirty BOOLEAN NOT NULL)"); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+func currentVersion(ctx context.Context, conn *pgxpool.Conn) (version int, dirty bool, err error) {
+	var exists bool
+	if err = conn.QueryRow(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists); err != nil || !exists {
+		return
+	}
+	err = conn.QueryRow(ctx, "SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&version, &dirty)
+	if err == pgx.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+func applyMigration(ctx context.Context, conn *pgxpool.Conn, sql string, version int) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, sql); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM schema_migrations"); err != nil {
+		return err
+	}
+	if version > 0 {
+		if _, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version, dirty) VALUES ($1, false)", version); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,52 @@
+package db
+
+import (
+	"testing"
+	"testing/fstest"
+	"vk-feed/migrations"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	t.Run("embedded migrations", func(t *testing.T) {
+		out, err := LoadMigrations(migrations.FS)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, out)
+		for i, m := range out {
+			assert.NotEmpty(t, m.Up, m.Name)
+			assert.NotEmpty(t, m.Down, m.Name)
+			if i > 0 {
+				assert.Greater(t, m.Version, out[i-1].Version)
+			}
+		}
+	})
+	t.Run("sorted by version", func(t *testing.T) {
+		out, err := LoadMigrations(fstest.MapFS{
+			"10_b.up.sql":   {Data: []byte("b")},
+			"2_a.up.sql":    {Data: []byte("a")},
+			"2_a.down.sql":  {Data: []byte("-a")},
+			"README.md":     {Data: []byte("not a migration")},
+			"10_b.down.sql": {Data: []byte("-b")},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []Migration{
+			{Version: 2, Name: "a", Up: "a", Down: "-a"},
+			{Version: 10, Name: "b", Up: "b", Down: "-b"},
+		}, out)
+		assert.Equal(t, 10, Migrator{migrations: out}.Latest())
+	})
+	t.Run("missing up file", func(t *testing.T) {
+		_, err := LoadMigrations(fstest.MapFS{
+			"1_a.down.sql": {Data: []byte("-a")},
+		})
+		assert.Error(t, err)
+	})
+	t.Run("conflicting names", func(t *testing.T) {
+		_, err := LoadMigrations(fstest.MapFS{
+			"1_a.up.sql":   {Data: []byte("a")},
+			"1_b.down.sql": {Data: []byte("-b")},
+		})
+		assert.Error(t, err)
+	})
+}
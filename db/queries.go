@@ -2,51 +2,233 @@ package db
 
 import (
 	"context"
-	"fmt"
+	"time"
+	"vk-feed/tracing"
 	"vk-feed/types"
 
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type PgxConnection struct {
-	Client *pgxpool.Pool
+	Client   *pgxpool.Pool
+	state    *connState
+	replicas *replicaSet
 }
 
-func (conn PgxConnection) CreateUser(name, password string) (id int, err error) {
+func startSpan(ctx context.Context, name, query string) (context.Context, trace.Span) {
+	return tracing.Tracer.Start(ctx, "db."+name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			semconv.DBQueryText(query),
+		))
+}
+
+func (conn PgxConnection) CreateUser(ctx context.Context, name, password string) (id int, err error) {
 	query := "INSERT INTO usrs (name, pass) VALUES ($1, $2) RETURNING id"
-	err = conn.Client.QueryRow(context.Background(), query, name, password).Scan(&id)
+	ctx, span := startSpan(ctx, "CreateUser", query)
+	defer func() { err = translateErr(err); tracing.EndSpan(span, err) }()
+	err = conn.Client.QueryRow(ctx, query, name, password).Scan(&id)
+	if err == nil {
+		conn.replicas.wrote(userKey(id), nameKey(name))
+	}
 	return
 }
 
-func (conn PgxConnection) GetUserByName(name string) (id int, password string, err error) {
+func (conn PgxConnection) GetUserByName(ctx context.Context, name string) (id int, password string, err error) {
 	query := "SELECT id, pass FROM usrs WHERE name = $1"
-	err = conn.Client.QueryRow(context.Background(), query, name).Scan(&id, &password)
+	ctx, span := startSpan(ctx, "GetUserByName", query)
+	defer func() { err = translateErr(err); tracing.EndSpan(span, err) }()
+	err = conn.read(ctx, func(q querier) error {
+		return q.QueryRow(ctx, query, name).Scan(&id, &password)
+	}, nameKey(name))
+	return
+}
+
+func (conn PgxConnection) GetUserById(ctx context.Context, id int) (user types.User, err error) {
+	query := "SELECT id, name, delete_at FROM usrs WHERE id = $1"
+	ctx, span := startSpan(ctx, "GetUserById", query)
+	defer func() { err = translateErr(err); tracing.EndSpan(span, err) }()
+	err = conn.read(ctx, func(q querier) error {
+		return q.QueryRow(ctx, query, id).Scan(&user.Id, &user.Name, &user.DeleteAt)
+	}, userKey(id))
+	return
+}
+
+func (conn PgxConnection) GetUserPassword(ctx context.Context, id int) (password string, err error) {
+	query := "SELECT pass FROM usrs WHERE id = $1"
+	ctx, span := startSpan(ctx, "GetUserPassword", query)
+	defer func() { err = translateErr(err); tracing.EndSpan(span, err) }()
+	err = conn.Client.QueryRow(ctx, query, id).Scan(&password)
+	return
+}
+
+func (conn PgxConnection) DeleteUser(ctx context.Context, id int) (err error) {
+	query := "DELETE FROM usrs WHERE id = $1"
+	ctx, span := startSpan(ctx, "DeleteUser", query)
+	defer func() { err = translateErr(err); tracing.EndSpan(span, err) }()
+	tag, err := conn.Client.Exec(ctx, query, id)
+	if err == nil && tag.RowsAffected() == 0 {
+		err = ErrNotFound
+	}
+	conn.replicas.wrote(userKey(id))
+	return
+}
+
+func (conn PgxConnection) ScheduleUserDeletion(ctx context.Context, id int, at time.Time) (err error) {
+	query := "UPDATE usrs SET delete_at = $2 WHERE id = $1"
+	ctx, span := startSpan(ctx, "ScheduleUserDeletion", query)
+	defer func() { err = translateErr(err); tracing.EndSpan(span, err) }()
+	tag, err := conn.Client.Exec(ctx, query, id, at.UTC())
+	if err == nil && tag.RowsAffected() == 0 {
+		err = ErrNotFound
+	}
+	conn.replicas.wrote(userKey(id))
 	return
 }
 
-func (conn PgxConnection) CreateAd(dto types.AdDto, userId int) (id int, err error) {
-	query := "INSERT INTO ads (title, content, image_url, price, user_id) VALUES ($1, $2, $3, $4, $5) RETURNING id"
-	err = conn.Client.QueryRow(context.Background(), query, dto.Title, dto.Content, dto.ImageUrl, dto.Price, userId).Scan(&id)
+func (conn PgxConnection) CancelUserDeletion(ctx context.Context, id int) (err error) {
+	query := "UPDATE usrs SET delete_at = NULL WHERE id = $1 AND delete_at IS NOT NULL"
+	ctx, span := startSpan(ctx, "CancelUserDeletion", query)
+	defer func() { err = translateErr(err); tracing.EndSpan(span, err) }()
+	_, err = conn.Client.Exec(ctx, query, id)
+	conn.replicas.wrote(userKey(id))
+	return
+}
+
+func (conn PgxConnection) PurgeUsers(ctx context.Context, before time.Time) (n int64, err error) {
+	query := "DELETE FROM usrs WHERE delete_at <= $1"
+	ctx, span := startSpan(ctx, "PurgeUsers", query)
+	defer func() { err = translateErr(err); tracing.EndSpan(span, err) }()
+	tag, err := conn.Client.Exec(ctx, query, before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (conn PgxConnection) CreateAd(ctx context.Context, dto types.AdDto, userId int) (id int, err error) {
+	query := "INSERT INTO ads (title, content, image_url, price, user_id, latitude, longitude, city) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id"
+	ctx, span := startSpan(ctx, "CreateAd", query)
+	defer func() { err = translateErr(err); tracing.EndSpan(span, err) }()
+	err = conn.Client.QueryRow(ctx, query, dto.Title, dto.Content, dto.ImageUrl, dto.Price, userId, dto.Latitude, dto.Longitude, dto.City).Scan(&id)
+	conn.replicas.wrote(userKey(userId))
 	return
 }
 
-func (conn PgxConnection) GetAds(userId int, params types.GetAdParams) (res []types.AdFeed, err error) {
-	query := fmt.Sprintf(
-		"SELECT * FROM ads WHERE price >= $1 AND price <= $2 ORDER BY %s %s OFFSET 10*$3 LIMIT 10",
-		params.SortBy,
-		params.OrderBy,
-	)
-	rows, err := conn.Client.Query(context.Background(), query, params.MinPrice, params.MaxPrice, params.Page)
+func (conn PgxConnection) CreateAds(ctx context.Context, dtos []types.AdDto, userId int) (ids []int, err error) {
+	query := "INSERT INTO ads (title, content, image_url, price, user_id, latitude, longitude, city) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id"
+	ctx, span := startSpan(ctx, "CreateAds", query)
+	defer func() { err = translateErr(err); tracing.EndSpan(span, err) }()
+	tx, err := conn.Client.Begin(ctx)
 	if err != nil {
 		return nil, err
 	}
-	for rows.Next() {
-		var ad types.AdFeed
-		rows.Scan(&ad.Id, &ad.Title, &ad.Content, &ad.ImageUrl, &ad.Price, &ad.AuthorId, &ad.CreatedAt)
-		if ad.AuthorId == userId {
-			ad.IsYours = true
+	defer tx.Rollback(ctx)
+	ids = make([]int, len(dtos))
+	for i, dto := range dtos {
+		if err = tx.QueryRow(ctx, query, dto.Title, dto.Content, dto.ImageUrl, dto.Price, userId, dto.Latitude, dto.Longitude, dto.City).Scan(&ids[i]); err != nil {
+			return nil, err
 		}
-		res = append(res, ad)
 	}
-	return
+	if err = tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	conn.replicas.wrote(userKey(userId))
+	return ids, nil
+}
+
+func (conn PgxConnection) GetAds(ctx context.Context, userId int, params types.GetAdParams) (res []types.AdFeed, err error) {
+	columns, directions, err := sortOf(params)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := offsetOf(params)
+	if err != nil {
+		return nil, err
+	}
+	q := newSelect(adColumns, "ads")
+	if params.MinPrice > 0 {
+		q.Where("price >= ?", params.MinPrice)
+	}
+	if params.MaxPrice > 0 {
+		q.Where("price <= ?", params.MaxPrice)
+	}
+	if !params.CreatedAfter.IsZero() {
+		q.Where("created_at > ?", params.CreatedAfter.UTC())
+	}
+	if !params.CreatedBefore.IsZero() {
+		q.Where("created_at < ?", params.CreatedBefore.UTC())
+	}
+	if params.AuthorId != 0 {
+		q.Where("user_id = ?", params.AuthorId)
+	}
+	if params.OnlyMine {
+		q.Where("user_id = ?", userId)
+	}
+	if params.ExcludeMine {
+		q.Where("user_id IS DISTINCT FROM ?", userId)
+	}
+	switch params.HasImage {
+	case types.IMAGE_WITH:
+		q.Where("image_url IS NOT NULL AND image_url <> ''")
+	case types.IMAGE_WITHOUT:
+		q.Where("(image_url IS NULL OR image_url = '')")
+	}
+	if params.Near && params.RadiusKm > 0 {
+		minLat, maxLat, minLon, maxLon, wholeLon := boundingBox(params.Lat, params.Lon, params.RadiusKm)
+		q.Where("latitude BETWEEN ? AND ?", minLat, maxLat)
+		switch {
+		case wholeLon:
+		case minLon <= maxLon:
+			q.Where("longitude BETWEEN ? AND ?", minLon, maxLon)
+		default:
+			q.Where("(longitude >= ? OR longitude <= ?)", minLon, maxLon)
+		}
+		q.Where(distanceSQL+" <= ?", params.Lat, params.Lat, params.Lon, params.RadiusKm)
+	}
+	for i, column := range columns {
+		if column == "distance" {
+			q.OrderBy(q.Bind(distanceSQL, params.Lat, params.Lat, params.Lon), directions[i]+" NULLS LAST")
+			continue
+		}
+		q.OrderBy(column, directions[i])
+	}
+	query, args := q.Offset(offset).Limit(params.PageSize).SQL()
+	ctx, span := startSpan(ctx, "GetAds", query)
+	defer func() { err = translateErr(err); tracing.EndSpan(span, err) }()
+	err = conn.read(ctx, func(q querier) error {
+		res = nil
+		rows, err := q.Query(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		return eachAd(rows, userId, func(ad types.AdFeed) error {
+			res = append(res, withDistance(ad, params))
+			return nil
+		})
+	}, userKey(userId))
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (conn PgxConnection) ForEachUserAd(ctx context.Context, userId int, fn func(types.AdFeed) error) (err error) {
+	query, args := newSelect(adColumns, "ads").Where("user_id = ?", userId).OrderBy("id", "ASC").SQL()
+	ctx, span := startSpan(ctx, "ForEachUserAd", query)
+	defer func() { err = translateErr(err); tracing.EndSpan(span, err) }()
+	// rows are streamed to fn, so only failing to start the query fails over
+	var rows pgx.Rows
+	err = conn.read(ctx, func(q querier) (err error) {
+		rows, err = q.Query(ctx, query, args...)
+		return
+	}, userKey(userId))
+	if err != nil {
+		return err
+	}
+	return eachAd(rows, userId, fn)
 }
@@ -0,0 +1,159 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"vk-feed/types"
+
+	"github.com/jackc/pgx/v4"
+)
+
+var ErrInvalidParams = errors.New("invalid query parameters")
+
+// adColumns are selected by every ad query, in the order scanAd reads them.
+const adColumns = "id, title, content, COALESCE(image_url, ''), price, user_id, created_at, latitude, longitude, COALESCE(city, '')"
+
+var sortColumns = map[types.SORT_BY]string{
+	types.SORT_BY_DATE:  "created_at",
+	types.SORT_BY_PRICE: "price",
+	types.SORT_BY_ID:    "id",
+	// bound by the caller, see distanceSQL
+	types.SORT_BY_DISTANCE: "distance",
+}
+
+var orderDirections = map[types.ORDER_BY]string{
+	types.ORDER_BY_ASC:  "ASC",
+	types.ORDER_BY_DESC: "DESC",
+}
+
+// sortOf returns the columns and directions of the feed order, ending with
+// id, only values from the maps above ever reach the SQL.
+func sortOf(params types.GetAdParams) (columns, directions []string, err error) {
+	keys, err := params.SortKeys()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrInvalidParams, err)
+	}
+	for _, key := range keys {
+		column, ok := sortColumns[key.By]
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: sort by %q", ErrInvalidParams, key.By)
+		}
+		direction, ok := orderDirections[key.Order]
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: order by %q", ErrInvalidParams, key.Order)
+		}
+		columns, directions = append(columns, column), append(directions, direction)
+	}
+	return columns, directions, nil
+}
+
+// offsetOf returns the rows to skip for the page of params, checked not to
+// overflow: the product is never computed past types.MaxOffset.
+func offsetOf(params types.GetAdParams) (int, error) {
+	if params.Page < 0 || params.PageSize < 0 || params.Page > params.MaxPage() {
+		return 0, fmt.Errorf("%w: page %d of size %d is out of range", ErrInvalidParams, params.Page, params.PageSize)
+	}
+	return params.Page * params.PageSize, nil
+}
+
+// selectQuery builds a SELECT with numbered placeholders. Values are only
+// ever passed as arguments, identifiers must come from constants.
+type selectQuery struct {
+	columns string
+	from    string
+	where   []string
+	orderBy []string
+	limit   string
+	offset  string
+	args    []any
+}
+
+func newSelect(columns, from string) *selectQuery {
+	return &selectQuery{columns: columns, from: from}
+}
+
+func (q *selectQuery) arg(v any) string {
+	q.args = append(q.args, v)
+	return "$" + strconv.Itoa(len(q.args))
+}
+
+// Bind returns expr with its ? placeholders bound to args in order.
+func (q *selectQuery) Bind(expr string, args ...any) string {
+	parts := strings.Split(expr, "?")
+	if len(parts) != len(args)+1 {
+		panic(fmt.Sprintf("db: %q takes %d arguments, got %d", expr, len(parts)-1, len(args)))
+	}
+	var b strings.Builder
+	for i, part := range parts[:len(args)] {
+		b.WriteString(part)
+		b.WriteString(q.arg(args[i]))
+	}
+	b.WriteString(parts[len(args)])
+	return b.String()
+}
+
+// Where adds a condition, its ? placeholders are bound to args in order.
+func (q *selectQuery) Where(cond string, args ...any) *selectQuery {
+	q.where = append(q.where, q.Bind(cond, args...))
+	return q
+}
+
+func (q *selectQuery) OrderBy(column, direction string) *selectQuery {
+	q.orderBy = append(q.orderBy, column+" "+direction)
+	return q
+}
+
+func (q *selectQuery) Limit(n int) *selectQuery {
+	q.limit = q.arg(n)
+	return q
+}
+
+func (q *selectQuery) Offset(n int) *selectQuery {
+	q.offset = q.arg(n)
+	return q
+}
+
+func (q *selectQuery) SQL() (string, []any) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "SELECT %s FROM %s", q.columns, q.from)
+	if len(q.where) > 0 {
+		b.WriteString(" WHERE " + strings.Join(q.where, " AND "))
+	}
+	if len(q.orderBy) > 0 {
+		b.WriteString(" ORDER BY " + strings.Join(q.orderBy, ", "))
+	}
+	if q.offset != "" {
+		b.WriteString(" OFFSET " + q.offset)
+	}
+	if q.limit != "" {
+		b.WriteString(" LIMIT " + q.limit)
+	}
+	return b.String(), q.args
+}
+
+// scanAd reads a row of adColumns.
+func scanAd(row pgx.Row, userId int) (ad types.AdFeed, err error) {
+	err = row.Scan(&ad.Id, &ad.Title, &ad.Content, &ad.ImageUrl, &ad.Price, &ad.AuthorId, &ad.CreatedAt,
+		&ad.Latitude, &ad.Longitude, &ad.City)
+	ad.IsYours = ad.AuthorId == userId
+	return
+}
+
+// eachAd calls fn for every row of adColumns and closes the rows. Errors of
+// scanning and of the iteration itself are returned, so a broken stream is
+// never mistaken for a complete one.
+func eachAd(rows pgx.Rows, userId int, fn func(types.AdFeed) error) error {
+	defer rows.Close()
+	for rows.Next() {
+		ad, err := scanAd(rows, userId)
+		if err != nil {
+			return err
+		}
+		if err := fn(ad); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
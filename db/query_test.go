@@ -0,0 +1,127 @@
+package db
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"vk-feed/types"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectQuery(t *testing.T) {
+	t.Run("Plain", func(t *testing.T) {
+		query, args := newSelect("id", "ads").SQL()
+		assert.Equal(t, "SELECT id FROM ads", query)
+		assert.Empty(t, args)
+	})
+	t.Run("All clauses", func(t *testing.T) {
+		query, args := newSelect(adColumns, "ads").
+			Where("price >= ?", 10).
+			Where("price BETWEEN ? AND ?", 1, 100).
+			OrderBy("price", "DESC").
+			OrderBy("id", "ASC").
+			Offset(20).
+			Limit(10).
+			SQL()
+		assert.Equal(t, "SELECT "+adColumns+" FROM ads WHERE price >= $1 AND price BETWEEN $2 AND $3 ORDER BY price DESC, id ASC OFFSET $4 LIMIT $5", query)
+		assert.Equal(t, []any{10, 1, 100, 20, 10}, args)
+	})
+	t.Run("Bound expressions", func(t *testing.T) {
+		q := newSelect("id", "ads").Where("price >= ?", 10)
+		query, args := q.OrderBy(q.Bind("ABS(price - ?)", 50), "ASC").SQL()
+		assert.Equal(t, "SELECT id FROM ads WHERE price >= $1 ORDER BY ABS(price - $2) ASC", query)
+		assert.Equal(t, []any{10, 50}, args)
+	})
+	t.Run("Argument count mismatch", func(t *testing.T) {
+		assert.Panics(t, func() { newSelect("id", "ads").Where("price >= ?") })
+	})
+}
+
+func TestSortOf(t *testing.T) {
+	columns, directions, err := sortOf(types.GetAdParams{SortBy: types.SORT_BY_DATE, OrderBy: types.ORDER_BY_DESC})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"created_at", "id"}, columns)
+	assert.Equal(t, []string{"DESC", "DESC"}, directions)
+	columns, directions, err = sortOf(types.GetAdParams{SortBy: "price:asc,created_at", OrderBy: types.ORDER_BY_DESC})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"price", "created_at", "id"}, columns)
+	assert.Equal(t, []string{"ASC", "DESC", "DESC"}, directions)
+	columns, directions, err = sortOf(types.GetAdParams{SortBy: "id:desc,price", OrderBy: types.ORDER_BY_ASC})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"id", "price"}, columns)
+	assert.Equal(t, []string{"DESC", "ASC"}, directions)
+	for _, sortBy := range []types.SORT_BY{"price; DROP TABLE ads", "price:sideways", "price,price:desc", "price,", ""} {
+		_, _, err = sortOf(types.GetAdParams{SortBy: sortBy, OrderBy: types.ORDER_BY_ASC})
+		assert.ErrorIs(t, err, ErrInvalidParams, sortBy)
+	}
+	_, _, err = sortOf(types.GetAdParams{SortBy: types.SORT_BY_PRICE})
+	assert.ErrorIs(t, err, ErrInvalidParams)
+}
+
+func TestOffsetOf(t *testing.T) {
+	offset, err := offsetOf(types.GetAdParams{Page: 3, PageSize: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, 30, offset)
+	offset, err = offsetOf(types.GetAdParams{Page: types.MaxOffset / 10, PageSize: 10})
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, offset, types.MaxOffset)
+	for _, page := range []int{-1, types.MaxOffset/10 + 1, 1844674407370955162, math.MaxInt} {
+		_, err := offsetOf(types.GetAdParams{Page: page, PageSize: 10})
+		assert.ErrorIs(t, err, ErrInvalidParams, page)
+	}
+}
+
+// fakeRows yields n rows of adColumns, then fails with err. Scanning the
+// row failAt fails.
+type fakeRows struct {
+	pgx.Rows
+	n, failAt, next int
+	err             error
+	closed          bool
+}
+
+func (r *fakeRows) Next() bool {
+	r.next++
+	return r.next <= r.n
+}
+
+func (r *fakeRows) Scan(dest ...any) error {
+	if r.next == r.failAt {
+		return errors.New("cannot scan")
+	}
+	*dest[0].(*int) = r.next
+	*dest[5].(*int) = 1
+	return nil
+}
+
+func (r *fakeRows) Err() error { return r.err }
+
+func (r *fakeRows) Close() { r.closed = true }
+
+func TestEachAd(t *testing.T) {
+	collect := func(rows *fakeRows) ([]int, error) {
+		var ids []int
+		err := eachAd(rows, 1, func(ad types.AdFeed) error {
+			assert.True(t, ad.IsYours)
+			ids = append(ids, ad.Id)
+			return nil
+		})
+		assert.True(t, rows.closed)
+		return ids, err
+	}
+	t.Run("OK", func(t *testing.T) {
+		ids, err := collect(&fakeRows{n: 3})
+		assert.NoError(t, err)
+		assert.Equal(t, []int{1, 2, 3}, ids)
+	})
+	t.Run("Scan fails", func(t *testing.T) {
+		_, err := collect(&fakeRows{n: 3, failAt: 2})
+		assert.EqualError(t, err, "cannot scan")
+	})
+	t.Run("Stream breaks", func(t *testing.T) {
+		_, err := collect(&fakeRows{n: 2, err: errors.New("connection reset")})
+		assert.EqualError(t, err, "connection reset")
+	})
+}
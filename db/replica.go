@@ -0,0 +1,215 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"vk-feed/config"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	log "github.com/sirupsen/logrus"
+)
+
+const replicaCheckTimeout = 5 * time.Second
+
+// querier is what reads need from a pool.
+type querier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// replica is a read-only copy of the database, out of rotation while its
+// health checks fail.
+type replica struct {
+	name    string
+	pool    *pgxpool.Pool
+	healthy atomic.Bool
+}
+
+func (r *replica) setHealthy(err error) {
+	if err == nil && !r.healthy.Swap(true) {
+		log.WithField("replica", r.name).Info("replica is in rotation")
+	} else if err != nil && r.healthy.Swap(false) {
+		log.WithField("replica", r.name).WithError(err).Warn("replica is out of rotation")
+	}
+}
+
+// replicaSet spreads reads over healthy replicas in turn. Whoever wrote
+// within the last window reads from the primary instead, so replication lag
+// never hides their own writes. The window is kept per process: with several
+// instances behind a balancer it only covers requests served by the one that
+// took the write.
+type replicaSet struct {
+	replicas []*replica
+	next     atomic.Uint64
+	window   time.Duration
+	now      func() time.Time
+
+	mu     sync.Mutex
+	writes map[string]time.Time
+	pruned time.Time
+
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+func newReplicaSet(replicas []*replica, window time.Duration) *replicaSet {
+	return &replicaSet{replicas: replicas, window: window, now: time.Now, writes: map[string]time.Time{}}
+}
+
+// userKey and nameKey identify whoever reads or writes, a user is known by
+// name before signing in.
+func userKey(id int) string      { return "id:" + strconv.Itoa(id) }
+func nameKey(name string) string { return "name:" + name }
+
+// wrote starts the read-your-writes window of keys.
+func (s *replicaSet) wrote(keys ...string) {
+	if s == nil || s.window <= 0 {
+		return
+	}
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		s.writes[key] = now
+	}
+	if now.Sub(s.pruned) > s.window {
+		for key, at := range s.writes {
+			if now.Sub(at) > s.window {
+				delete(s.writes, key)
+			}
+		}
+		s.pruned = now
+	}
+}
+
+// pick returns the replica to read from, nil means the primary.
+func (s *replicaSet) pick(keys ...string) *replica {
+	if s == nil || len(s.replicas) == 0 {
+		return nil
+	}
+	if s.window > 0 {
+		now := s.now()
+		s.mu.Lock()
+		for _, key := range keys {
+			if at, ok := s.writes[key]; ok && now.Sub(at) <= s.window {
+				s.mu.Unlock()
+				return nil
+			}
+		}
+		s.mu.Unlock()
+	}
+	start := s.next.Add(1)
+	for i := range s.replicas {
+		r := s.replicas[(start+uint64(i))%uint64(len(s.replicas))]
+		if r.healthy.Load() {
+			return r
+		}
+	}
+	return nil
+}
+
+func (s *replicaSet) check(ctx context.Context) {
+	for _, r := range s.replicas {
+		ctx, cancel := context.WithTimeout(ctx, replicaCheckTimeout)
+		r.setHealthy(r.pool.Ping(ctx))
+		cancel()
+	}
+}
+
+// watch checks the replicas every period until close.
+func (s *replicaSet) watch(period time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stop, s.done = cancel, make(chan struct{})
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.check(ctx)
+			}
+		}
+	}()
+}
+
+func (s *replicaSet) close() {
+	if s == nil {
+		return
+	}
+	if s.stop != nil {
+		s.stop()
+		<-s.done
+	}
+	for _, r := range s.replicas {
+		r.pool.Close()
+	}
+}
+
+// unreachable tells whether err means the server could not be talked to,
+// as opposed to the query itself failing.
+func unreachable(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// connection exception, operator intervention
+		return pgErr.Code[:2] == "08" || pgErr.Code[:2] == "57"
+	}
+	return false
+}
+
+// read runs fn against a replica, or the primary when keys wrote recently or
+// no replica is healthy. A replica that cannot be reached is taken out of
+// rotation and fn is run again against the primary, so fn must not have
+// side effects beyond its own results.
+func (conn PgxConnection) read(ctx context.Context, fn func(querier) error, keys ...string) error {
+	r := conn.replicas.pick(keys...)
+	if r == nil {
+		return fn(conn.Client)
+	}
+	err := fn(r.pool)
+	if err != nil && ctx.Err() == nil && unreachable(err) {
+		r.setHealthy(err)
+		return fn(conn.Client)
+	}
+	return err
+}
+
+func connectReplicas(ctx context.Context, urls []string, opts config.Db) (replicas []*replica, err error) {
+	defer func() {
+		if err != nil {
+			for _, r := range replicas {
+				r.pool.Close()
+			}
+		}
+	}()
+	for _, url := range urls {
+		cfg, err := poolConfig(url, opts)
+		if err != nil {
+			return replicas, fmt.Errorf("replica: %w", err)
+		}
+		// a replica that is down must not keep the service from starting
+		cfg.LazyConnect = true
+		pool, err := pgxpool.ConnectConfig(ctx, cfg)
+		if err != nil {
+			return replicas, fmt.Errorf("replica: %w", err)
+		}
+		name := cfg.ConnConfig.Host + ":" + strconv.Itoa(int(cfg.ConnConfig.Port))
+		replicas = append(replicas, &replica{name: name, pool: pool})
+	}
+	return replicas, nil
+}
@@ -0,0 +1,138 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+	"vk-feed/config"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/stretchr/testify/assert"
+)
+
+// closedUrl points at a port nothing listens on.
+func closedUrl(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	l.Close()
+	return fmt.Sprintf("postgres://postgres@%s/postgres?sslmode=disable&connect_timeout=1", l.Addr())
+}
+
+func lazyPool(t *testing.T, url string) *pgxpool.Pool {
+	cfg, err := poolConfig(url, config.Default().Db)
+	assert.NoError(t, err)
+	cfg.LazyConnect = true
+	pool, err := pgxpool.ConnectConfig(context.Background(), cfg)
+	assert.NoError(t, err)
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+func newTestReplicas(t *testing.T, n int) *replicaSet {
+	var replicas []*replica
+	for i := 0; i < n; i++ {
+		r := &replica{name: fmt.Sprint("replica", i), pool: lazyPool(t, closedUrl(t))}
+		r.healthy.Store(true)
+		replicas = append(replicas, r)
+	}
+	return newReplicaSet(replicas, time.Second)
+}
+
+func TestReplicaSetPick(t *testing.T) {
+	t.Run("round robin", func(t *testing.T) {
+		s := newTestReplicas(t, 3)
+		seen := map[*replica]int{}
+		for i := 0; i < 30; i++ {
+			seen[s.pick()]++
+		}
+		assert.Len(t, seen, 3)
+		for _, n := range seen {
+			assert.Equal(t, 10, n)
+		}
+	})
+	t.Run("unhealthy are skipped", func(t *testing.T) {
+		s := newTestReplicas(t, 3)
+		s.replicas[0].healthy.Store(false)
+		s.replicas[2].healthy.Store(false)
+		for i := 0; i < 5; i++ {
+			assert.Same(t, s.replicas[1], s.pick())
+		}
+		s.replicas[1].healthy.Store(false)
+		assert.Nil(t, s.pick(), "primary when none is healthy")
+	})
+	t.Run("read your writes", func(t *testing.T) {
+		s := newTestReplicas(t, 2)
+		now := time.Now()
+		s.now = func() time.Time { return now }
+		s.wrote(userKey(1), nameKey("mock_name"))
+		assert.Nil(t, s.pick(userKey(1)))
+		assert.Nil(t, s.pick(nameKey("mock_name")))
+		assert.NotNil(t, s.pick(userKey(2)))
+		assert.NotNil(t, s.pick())
+
+		now = now.Add(2 * time.Second)
+		assert.NotNil(t, s.pick(userKey(1)), "window is over")
+		s.wrote(userKey(2))
+		assert.NotContains(t, s.writes, userKey(1), "expired writes are pruned")
+	})
+	t.Run("no window", func(t *testing.T) {
+		s := newTestReplicas(t, 1)
+		s.window = 0
+		s.wrote(userKey(1))
+		assert.NotNil(t, s.pick(userKey(1)))
+	})
+	t.Run("no replicas", func(t *testing.T) {
+		var s *replicaSet
+		s.wrote(userKey(1))
+		assert.Nil(t, s.pick(userKey(1)))
+		s.close()
+	})
+}
+
+func TestUnreachable(t *testing.T) {
+	assert.True(t, unreachable(&net.OpError{Op: "dial", Err: errors.New("connection refused")}))
+	assert.True(t, unreachable(fmt.Errorf("read: %w", io.ErrUnexpectedEOF)))
+	assert.True(t, unreachable(&pgconn.PgError{Code: "57P01"}), "admin shutdown")
+	assert.False(t, unreachable(&pgconn.PgError{Code: "42P01"}), "undefined table")
+	assert.False(t, unreachable(pgx.ErrNoRows))
+}
+
+func TestRead(t *testing.T) {
+	ctx := context.Background()
+	conn := PgxConnection{Client: lazyPool(t, closedUrl(t)), replicas: newTestReplicas(t, 1)}
+	r := conn.replicas.replicas[0]
+
+	var used []querier
+	query := func(q querier) error {
+		used = append(used, q)
+		if q == querier(r.pool) {
+			var n int
+			return q.QueryRow(ctx, "SELECT 1").Scan(&n)
+		}
+		return nil
+	}
+	assert.NoError(t, conn.read(ctx, query))
+	assert.Equal(t, []querier{r.pool, conn.Client}, used, "fails over to the primary")
+	assert.False(t, r.healthy.Load())
+
+	used = nil
+	assert.NoError(t, conn.read(ctx, query))
+	assert.Equal(t, []querier{conn.Client}, used, "out of rotation")
+
+	r.healthy.Store(true)
+	used = nil
+	wantErr := errors.New("mock_error")
+	err := conn.read(ctx, func(q querier) error {
+		used = append(used, q)
+		return wantErr
+	})
+	assert.ErrorIs(t, err, wantErr)
+	assert.Len(t, used, 1, "query errors do not fail over")
+	assert.True(t, r.healthy.Load())
+}
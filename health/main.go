@@ -0,0 +1,111 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type Check func(ctx context.Context) error
+
+const (
+	StatusOk           = "ok"
+	StatusUnavailable  = "unavailable"
+	StatusShuttingDown = "shutting_down"
+)
+
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+type Health struct {
+	timeout  time.Duration
+	shutdown atomic.Bool
+	mu       sync.RWMutex
+	checks   map[string]Check
+}
+
+func New(timeout time.Duration) *Health {
+	return &Health{
+		timeout: timeout,
+		checks:  make(map[string]Check),
+	}
+}
+
+func (h *Health) Add(name string, check Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks[name] = check
+}
+
+// Shutdown makes readiness fail so the orchestrator stops routing traffic
+// while in-flight requests are drained.
+func (h *Health) Shutdown() {
+	h.shutdown.Store(true)
+}
+
+func (h *Health) Liveness(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, http.StatusOK, Report{Status: StatusOk})
+}
+
+func (h *Health) Readiness(w http.ResponseWriter, r *http.Request) {
+	if h.shutdown.Load() {
+		writeReport(w, http.StatusServiceUnavailable, Report{Status: StatusShuttingDown})
+		return
+	}
+	report := h.Run(r.Context())
+	if report.Status != StatusOk {
+		writeReport(w, http.StatusServiceUnavailable, report)
+		return
+	}
+	writeReport(w, http.StatusOK, report)
+}
+
+// Run executes all checks concurrently, each bounded by the health timeout.
+func (h *Health) Run(ctx context.Context) Report {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	report := Report{Status: StatusOk, Checks: make(map[string]string, len(h.checks))}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for name, check := range h.checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, h.timeout)
+			defer cancel()
+			result := StatusOk
+			if err := check(ctx); err != nil {
+				log.WithField("check", name).Warn(err)
+				result = err.Error()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[name] = result
+			if result != StatusOk {
+				report.Status = StatusUnavailable
+			}
+		}(name, check)
+	}
+	wg.Wait()
+	return report
+}
+
+func writeReport(w http.ResponseWriter, status int, report Report) {
+	payload, err := json.Marshal(report)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(payload)
+}
@@ -0,0 +1,67 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLiveness(t *testing.T) {
+	h := New(time.Second)
+	h.Add("failing", func(ctx context.Context) error { return errors.New("down") })
+	rr := httptest.NewRecorder()
+	h.Liveness(rr, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, 200, rr.Code)
+}
+
+func TestReadiness(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		h := New(time.Second)
+		h.Add("database", func(ctx context.Context) error { return nil })
+		rr := httptest.NewRecorder()
+		h.Readiness(rr, httptest.NewRequest("GET", "/readyz", nil))
+		assert.Equal(t, 200, rr.Code)
+		var report Report
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &report))
+		assert.Equal(t, Report{Status: StatusOk, Checks: map[string]string{"database": StatusOk}}, report)
+	})
+	t.Run("Degraded dependency", func(t *testing.T) {
+		h := New(time.Second)
+		h.Add("database", func(ctx context.Context) error { return nil })
+		h.Add("migrations", func(ctx context.Context) error { return errors.New("schema mismatch") })
+		rr := httptest.NewRecorder()
+		h.Readiness(rr, httptest.NewRequest("GET", "/readyz", nil))
+		assert.Equal(t, 503, rr.Code)
+		var report Report
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &report))
+		assert.Equal(t, StatusUnavailable, report.Status)
+		assert.Equal(t, "schema mismatch", report.Checks["migrations"])
+		assert.Equal(t, StatusOk, report.Checks["database"])
+	})
+	t.Run("Check times out", func(t *testing.T) {
+		h := New(10 * time.Millisecond)
+		h.Add("database", func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		rr := httptest.NewRecorder()
+		h.Readiness(rr, httptest.NewRequest("GET", "/readyz", nil))
+		assert.Equal(t, 503, rr.Code)
+	})
+	t.Run("Shutting down", func(t *testing.T) {
+		h := New(time.Second)
+		h.Add("database", func(ctx context.Context) error { return nil })
+		h.Shutdown()
+		rr := httptest.NewRecorder()
+		h.Readiness(rr, httptest.NewRequest("GET", "/readyz", nil))
+		assert.Equal(t, 503, rr.Code)
+		var report Report
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &report))
+		assert.Equal(t, StatusShuttingDown, report.Status)
+	})
+}
@@ -5,23 +5,38 @@ import (
 	"errors"
 	"net/http"
 	"strings"
+	"vk-feed/tracing"
+
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var ErrUrlUnavailable error = errors.New("image url unavailable")
 var ErrNotImage error = errors.New("image url leads to non-image content type")
 var ErrImageTooBig error = errors.New("image too big")
 
-type IC struct{}
+type IC struct {
+	MaxSize int64
+}
 
-func (ic IC) Check(ctx context.Context, url string) error {
+// Check sends a HEAD request to the user supplied url. The host is not
+// ours: the trace context is not propagated to it and only the scheme and
+// host are recorded, the rest of the url may carry secrets.
+func (ic IC) Check(ctx context.Context, url string) (err error) {
+	ctx, span := tracing.Tracer.Start(ctx, "imagechecker.Check",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.HTTPRequestMethodKey.String("HEAD")))
+	defer func() { tracing.EndSpan(span, err) }()
 	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
 	if err != nil {
 		return ErrUrlUnavailable
 	}
+	span.SetAttributes(semconv.URLScheme(req.URL.Scheme), semconv.ServerAddress(req.URL.Hostname()))
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return ErrUrlUnavailable
 	}
+	span.SetAttributes(semconv.HTTPResponseStatusCode(res.StatusCode))
 	contentType := res.Header.Get("content-type")
 	if contentType == "" {
 		return ErrNotImage
@@ -29,7 +44,7 @@ func (ic IC) Check(ctx context.Context, url string) error {
 	if strings.Split(contentType, "/")[0] != "image" {
 		return ErrNotImage
 	}
-	if res.ContentLength >= 5*10e6 {
+	if res.ContentLength >= ic.MaxSize {
 		return ErrImageTooBig
 	}
 	return nil
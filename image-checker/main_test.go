@@ -0,0 +1,53 @@
+package imagechecker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	nooptrace "go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestCheckDoesNotLeakTraces(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTracerProvider(nooptrace.NewTracerProvider())
+
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+		w.Header().Set("Content-Type", "image/png")
+	}))
+	defer srv.Close()
+
+	ctx, span := otel.Tracer("test").Start(context.Background(), "parent")
+	err := IC{MaxSize: 1 << 20}.Check(ctx, srv.URL+"/image.png?token=secret")
+	span.End()
+	assert.NoError(t, err)
+	assert.Empty(t, header.Get("traceparent"))
+
+	u, _ := url.Parse(srv.URL)
+	for _, s := range sr.Ended() {
+		if s.Name() != "imagechecker.Check" {
+			continue
+		}
+		attrs := map[string]string{}
+		for _, kv := range s.Attributes() {
+			attrs[string(kv.Key)] = kv.Value.Emit()
+			assert.NotContains(t, kv.Value.Emit(), "secret")
+		}
+		assert.Equal(t, "http", attrs["url.scheme"])
+		assert.Equal(t, u.Hostname(), attrs["server.address"])
+		assert.NotContains(t, attrs, "url.full")
+		return
+	}
+	t.Fatal("no imagechecker.Check span")
+}
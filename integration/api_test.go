@@ -0,0 +1,164 @@
+package integration
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"vk-feed/client"
+	"vk-feed/db"
+	"vk-feed/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignupSigninPost(t *testing.T) {
+	s := newStack(t)
+	ctx := context.Background()
+	c := s.client(t)
+
+	user, err := c.SignUp(ctx, "mock_name", "mock_password")
+	assert.NoError(t, err)
+	assert.Equal(t, "mock_name", user.Name)
+	_, err = c.SignUp(ctx, "mock_name", "other_password")
+	assert.ErrorIs(t, err, client.ErrConflict)
+
+	_, err = c.SignIn(ctx, "mock_name", "wrong_password")
+	assert.ErrorIs(t, err, client.ErrWrongCredentials)
+	_, err = c.SignIn(ctx, "wrong_name", "mock_password")
+	assert.ErrorIs(t, err, client.ErrWrongCredentials)
+	_, err = c.SignIn(ctx, "mock_name", "mock_password")
+	assert.NoError(t, err)
+
+	dto := types.AdDto{Title: "mock_title", Content: "mock_content", ImageUrl: s.imageUrl, Price: 6969}
+	ad, err := c.CreateAd(ctx, dto)
+	assert.NoError(t, err)
+	assert.NotZero(t, ad.Id)
+
+	feed, err := c.ListAds(ctx, types.GetAdParams{})
+	assert.NoError(t, err)
+	if assert.Len(t, feed, 1) {
+		assert.Equal(t, ad.Id, feed[0].Id)
+		assert.Equal(t, s.imageUrl, feed[0].ImageUrl)
+		assert.Equal(t, user.Id, feed[0].AuthorId)
+		assert.True(t, feed[0].IsYours)
+	}
+	anonymous, err := s.client(t).ListAds(ctx, types.GetAdParams{})
+	assert.NoError(t, err)
+	assert.False(t, anonymous[0].IsYours)
+
+	_, err = s.client(t).CreateAd(ctx, dto)
+	assert.ErrorIs(t, err, client.ErrNoCredentials)
+}
+
+func TestFeed(t *testing.T) {
+	s := newStack(t)
+	ctx := context.Background()
+	users := map[string]*client.Client{}
+	for _, name := range []string{"alice_name", "bob_the_name"} {
+		users[name] = s.client(t, client.WithCredentials(name, "mock_password"))
+		_, err := users[name].SignUp(ctx, name, "mock_password")
+		assert.NoError(t, err)
+	}
+	alice, bob := users["alice_name"], users["bob_the_name"]
+
+	type posted struct {
+		id, price, order int
+		yours            bool
+	}
+	var ads []posted
+	for i, price := range []int{500, 100, 300, 900, 700, 200, 600, 800} {
+		author := alice
+		if i%3 == 2 {
+			author = bob
+		}
+		ad, err := author.CreateAd(ctx, types.AdDto{Title: "mock_title", Content: "mock_content", ImageUrl: s.imageUrl, Price: price})
+		if !assert.NoError(t, err) {
+			return
+		}
+		ads = append(ads, posted{id: ad.Id, price: price, order: i, yours: author == alice})
+	}
+
+	ranges := []struct{ min, max int }{{0, 0}, {300, 0}, {0, 600}, {200, 700}, {1000, 0}}
+	for _, sortBy := range []types.SORT_BY{types.SORT_BY_DATE, types.SORT_BY_PRICE} {
+		for _, orderBy := range []types.ORDER_BY{types.ORDER_BY_ASC, types.ORDER_BY_DESC} {
+			for _, r := range ranges {
+				name := fmt.Sprintf("%s %s %d-%d", sortBy, orderBy, r.min, r.max)
+				t.Run(name, func(t *testing.T) {
+					var want []posted
+					for _, ad := range ads {
+						if (r.min == 0 || ad.price >= r.min) && (r.max == 0 || ad.price <= r.max) {
+							want = append(want, ad)
+						}
+					}
+					slices.SortFunc(want, func(a, b posted) int {
+						c := cmp.Compare(a.order, b.order)
+						if sortBy == types.SORT_BY_PRICE {
+							c = cmp.Compare(a.price, b.price)
+						}
+						if orderBy == types.ORDER_BY_DESC {
+							return -c
+						}
+						return c
+					})
+
+					var got []types.AdFeed
+					for page := 0; page <= len(want)/pageSize; page++ {
+						feed, err := alice.ListAds(ctx, types.GetAdParams{Page: page, SortBy: sortBy, OrderBy: orderBy, MinPrice: r.min, MaxPrice: r.max})
+						if !assert.NoError(t, err) {
+							return
+						}
+						assert.LessOrEqual(t, len(feed), pageSize)
+						got = append(got, feed...)
+					}
+					if !assert.Len(t, got, len(want)) {
+						return
+					}
+					for i := range want {
+						assert.Equal(t, want[i].id, got[i].Id, "position %d", i)
+						assert.Equal(t, want[i].price, got[i].Price)
+						assert.Equal(t, want[i].yours, got[i].IsYours)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	s := newStack(t)
+	ctx := context.Background()
+	status, err := s.migrator.Status(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, s.migrator.Latest(), status.Version)
+	assert.Empty(t, status.Pending)
+
+	reverted, err := s.migrator.Down(ctx, s.migrator.Latest())
+	assert.NoError(t, err)
+	assert.Equal(t, s.migrator.Latest(), reverted)
+	assert.ErrorIs(t, s.migrator.Check(ctx), db.ErrSchemaMismatch)
+
+	applied, err := s.migrator.Up(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, s.migrator.Latest(), applied)
+	assert.NoError(t, s.migrator.Check(ctx))
+}
+
+func TestAccountDeletion(t *testing.T) {
+	s := newStack(t)
+	ctx := context.Background()
+	c := s.client(t)
+	user, _ := c.SignUp(ctx, "mock_name", "mock_password")
+	_, err := c.SignIn(ctx, "mock_name", "mock_password")
+	assert.NoError(t, err)
+	_, err = c.CreateAd(ctx, types.AdDto{Title: "mock_title", Content: "mock_content", ImageUrl: s.imageUrl, Price: 1})
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.conn.DeleteUser(ctx, user.Id))
+	feed, err := c.ListAds(ctx, types.GetAdParams{})
+	assert.NoError(t, err)
+	assert.Empty(t, feed, "ads are deleted with their author")
+	_, err = c.CreateAd(ctx, types.AdDto{Title: "mock_title", Content: "mock_content", ImageUrl: s.imageUrl, Price: 1})
+	assert.ErrorIs(t, err, client.ErrNotFound)
+}
@@ -0,0 +1,3 @@
+// Package integration runs the whole HTTP stack against Postgres with the
+// migrations applied. Every test gets a schema of its own, see pgtest.
+package integration
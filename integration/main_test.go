@@ -0,0 +1,68 @@
+package integration
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"vk-feed/client"
+	"vk-feed/config"
+	"vk-feed/db"
+	"vk-feed/migrations"
+	"vk-feed/pgtest"
+	"vk-feed/service"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(pgtest.Run(m))
+}
+
+type stack struct {
+	conn     db.PgxConnection
+	migrator db.Migrator
+	srv      *httptest.Server
+	// imageUrl is served with an image content type, so the real image
+	// checker passes it
+	imageUrl string
+}
+
+const pageSize = 3
+
+// newStack migrates a fresh schema and serves the API on top of it.
+func newStack(t *testing.T) stack {
+	t.Helper()
+	conn := db.PgxConnection{Client: pgtest.Pool(t)}
+	migrator, err := db.NewMigrator(conn, migrations.FS)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	if _, err := migrator.Up(context.Background()); !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	images := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+	}))
+	t.Cleanup(images.Close)
+
+	cfg := config.Default()
+	cfg.JwtSecret = strings.Repeat("s", 32)
+	cfg.Feed.PageSize = pageSize
+	h, err := service.NewHandler(service.WithDB(conn), service.WithConfig(cfg))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return stack{conn: conn, migrator: migrator, srv: srv, imageUrl: images.URL + "/image.png"}
+}
+
+func (s stack) client(t *testing.T, opts ...client.Option) *client.Client {
+	c, err := client.New(s.srv.URL, opts...)
+	assert.NoError(t, err)
+	return c
+}
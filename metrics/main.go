@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "vkfeed"
+
+var Registry = prometheus.NewRegistry()
+
+var (
+	HttpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of handled HTTP requests.",
+	}, []string{"route", "status"})
+
+	HttpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of handled HTTP requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "status"})
+
+	ImageChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "image_checks_total",
+		Help:      "Number of image url checks by outcome.",
+	}, []string{"outcome"})
+
+	ImageCheckDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "image_check_duration_seconds",
+		Help:      "Latency of image url checks.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10},
+	})
+
+	Signups = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "signups_total",
+		Help:      "Number of registered users.",
+	})
+
+	Signins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "signins_total",
+		Help:      "Number of sign in attempts by result.",
+	}, []string{"result"})
+
+	AdsCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ads_created_total",
+		Help:      "Number of created ads.",
+	})
+
+	FeedCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "feed_cache_requests_total",
+		Help:      "Number of anonymous feed cache lookups by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HttpRequests,
+		HttpDuration,
+		ImageChecks,
+		ImageCheckDuration,
+		Signups,
+		Signins,
+		AdsCreated,
+		FeedCacheRequests,
+	)
+}
+
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
@@ -1,2 +1,2 @@
+DROP TABLE ads;
 DROP TABLE usrs;
-DROP TABLE ads;
\ No newline at end of file
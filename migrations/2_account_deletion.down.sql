@@ -0,0 +1 @@
+ALTER TABLE usrs DROP COLUMN delete_at;
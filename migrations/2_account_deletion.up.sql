@@ -0,0 +1 @@
+ALTER TABLE usrs ADD COLUMN delete_at TIMESTAMP;
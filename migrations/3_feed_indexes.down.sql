@@ -0,0 +1,4 @@
+DROP INDEX ads_with_image_created_at_idx;
+DROP INDEX ads_user_id_created_at_idx;
+DROP INDEX ads_price_idx;
+DROP INDEX ads_created_at_idx;
@@ -0,0 +1,5 @@
+CREATE INDEX ads_created_at_idx ON ads (created_at);
+CREATE INDEX ads_price_idx ON ads (price);
+-- author filter, own ads and the cascade from usrs
+CREATE INDEX ads_user_id_created_at_idx ON ads (user_id, created_at);
+CREATE INDEX ads_with_image_created_at_idx ON ads (created_at) WHERE image_url IS NOT NULL AND image_url <> '';
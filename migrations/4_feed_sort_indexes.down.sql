@@ -0,0 +1,5 @@
+DROP INDEX ads_price_created_at_id_idx;
+DROP INDEX ads_price_id_idx;
+DROP INDEX ads_created_at_id_idx;
+CREATE INDEX ads_price_idx ON ads (price);
+CREATE INDEX ads_created_at_idx ON ads (created_at);
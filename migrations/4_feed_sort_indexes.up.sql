@@ -0,0 +1,6 @@
+-- every feed order ends with id, so the sort columns are indexed with it
+DROP INDEX ads_created_at_idx;
+DROP INDEX ads_price_idx;
+CREATE INDEX ads_created_at_id_idx ON ads (created_at, id);
+CREATE INDEX ads_price_id_idx ON ads (price, id);
+CREATE INDEX ads_price_created_at_id_idx ON ads (price, created_at, id);
@@ -0,0 +1,5 @@
+DROP INDEX ads_location_idx;
+ALTER TABLE ads
+    DROP COLUMN city,
+    DROP COLUMN longitude,
+    DROP COLUMN latitude;
@@ -0,0 +1,8 @@
+ALTER TABLE ads
+    ADD COLUMN latitude DOUBLE PRECISION CHECK(latitude >= -90 AND latitude <= 90),
+    ADD COLUMN longitude DOUBLE PRECISION CHECK(longitude >= -180 AND longitude <= 180),
+    ADD COLUMN city VARCHAR(100),
+    ADD CONSTRAINT ads_location_check CHECK((latitude IS NULL) = (longitude IS NULL));
+
+-- bounding box prefilter of the radius search
+CREATE INDEX ads_location_idx ON ads (latitude, longitude) WHERE latitude IS NOT NULL;
@@ -0,0 +1,217 @@
+// Package pgtest gives tests a Postgres schema of their own. The server is
+// the one at TEST_DB_URL or, when that is not set, a throwaway one started
+// from the initdb and postgres binaries found in PGTEST_BIN, on PATH or in
+// /usr/lib/postgresql. Tests are skipped when there is neither, unless
+// PGTEST_REQUIRED=1 makes them fail, as the integration target does.
+package pgtest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+var (
+	once     sync.Once
+	baseUrl  string
+	startErr error
+	explicit bool
+	required = os.Getenv("PGTEST_REQUIRED") == "1"
+	stop     = func() {}
+)
+
+// Run runs the tests of the package and stops the server started for them.
+// Call it from TestMain:
+//
+//	func TestMain(m *testing.M) { os.Exit(pgtest.Run(m)) }
+func Run(m *testing.M) int {
+	code := m.Run()
+	stop()
+	return code
+}
+
+// Pool connects to a new empty schema, dropped when the test ends. Objects
+// created without a schema name end up in it, so migrations can be applied
+// as is.
+func Pool(t testing.TB) *pgxpool.Pool {
+	t.Helper()
+	once.Do(start)
+	if startErr != nil {
+		unavailable(t)
+	}
+	ctx := context.Background()
+	admin, err := pgx.Connect(ctx, baseUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	suffix := make([]byte, 6)
+	rand.Read(suffix)
+	schema := "test_" + hex.EncodeToString(suffix)
+	if _, err := admin.Exec(ctx, "CREATE SCHEMA "+schema); err != nil {
+		admin.Close(ctx)
+		t.Fatal(err)
+	}
+
+	cfg, err := pgxpool.ParseConfig(baseUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ConnConfig.RuntimeParams["search_path"] = schema
+	pool, err := pgxpool.ConnectConfig(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		pool.Close()
+		if _, err := admin.Exec(ctx, "DROP SCHEMA "+schema+" CASCADE"); err != nil {
+			t.Error(err)
+		}
+		admin.Close(ctx)
+	})
+	return pool
+}
+
+func start() {
+	if url := os.Getenv("TEST_DB_URL"); url != "" {
+		baseUrl, explicit = url, true
+		startErr = ping(url)
+		return
+	}
+	baseUrl, startErr = startLocal()
+}
+
+func ping(url string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := pgx.Connect(ctx, url)
+	if err != nil {
+		return err
+	}
+	return conn.Close(ctx)
+}
+
+func findBin() (string, error) {
+	if dir := os.Getenv("PGTEST_BIN"); dir != "" {
+		return dir, nil
+	}
+	if path, err := exec.LookPath("initdb"); err == nil {
+		return filepath.Dir(path), nil
+	}
+	// Debian keeps the server binaries off PATH, the newest version wins
+	matches, _ := filepath.Glob("/usr/lib/postgresql/*/bin/initdb")
+	if len(matches) > 0 {
+		sort.Strings(matches)
+		return filepath.Dir(matches[len(matches)-1]), nil
+	}
+	return "", errors.New("no initdb found, install Postgres or set TEST_DB_URL")
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// startLocal initializes a cluster in a temporary directory and starts it
+// with durability off, it is thrown away anyway.
+func startLocal() (string, error) {
+	bin, err := findBin()
+	if err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp("", "pgtest")
+	if err != nil {
+		return "", err
+	}
+	data := filepath.Join(dir, "data")
+	initdb := exec.Command(filepath.Join(bin, "initdb"), "-D", data, "-U", "postgres", "-A", "trust", "-E", "UTF8", "--no-sync")
+	if out, err := initdb.CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("initdb: %w: %s", err, bytes.TrimSpace(out))
+	}
+	port, err := freePort()
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	var logs bytes.Buffer
+	server := exec.Command(filepath.Join(bin, "postgres"), "-D", data, "-p", fmt.Sprint(port), "-k", dir,
+		"-c", "listen_addresses=127.0.0.1", "-c", "fsync=off", "-c", "synchronous_commit=off", "-c", "full_page_writes=off")
+	server.Stdout, server.Stderr = &logs, &logs
+	if err := server.Start(); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	exited := make(chan struct{})
+	go func() {
+		server.Wait()
+		close(exited)
+	}()
+	stop = func() {
+		server.Process.Signal(os.Interrupt)
+		select {
+		case <-exited:
+		case <-time.After(10 * time.Second):
+			server.Process.Kill()
+			<-exited
+		}
+		os.RemoveAll(dir)
+	}
+
+	url := fmt.Sprintf("postgres://postgres@127.0.0.1:%d/postgres?sslmode=disable", port)
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		err := ping(url)
+		if err == nil {
+			return url, nil
+		}
+		select {
+		case <-exited:
+			stop()
+			return "", fmt.Errorf("postgres exited: %s", bytes.TrimSpace(logs.Bytes()))
+		case <-time.After(100 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			stop()
+			return "", fmt.Errorf("postgres did not start: %w", err)
+		}
+	}
+}
+
+// Require skips the test when there is no Postgres to run against.
+func Require(t testing.TB) {
+	t.Helper()
+	once.Do(start)
+	if startErr != nil && !explicit {
+		unavailable(t)
+	}
+}
+
+func unavailable(t testing.TB) {
+	t.Helper()
+	switch {
+	case explicit:
+		t.Fatalf("TEST_DB_URL: %s", startErr)
+	case required:
+		t.Fatalf("postgres is unavailable and PGTEST_REQUIRED=1: %s", startErr)
+	default:
+		t.Skipf("postgres is unavailable: %s", startErr)
+	}
+}
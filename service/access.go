@@ -0,0 +1,108 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+const requestIdHeader = "X-Request-ID"
+
+const maxRequestIdLen = 128
+
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+func (rec *responseRecorder) Status() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
+
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// requestIdFrom returns the client supplied request id if it looks sane,
+// otherwise a freshly generated one.
+func requestIdFrom(r *http.Request) string {
+	id := r.Header.Get(requestIdHeader)
+	if id != "" && len(id) <= maxRequestIdLen && isPrintableASCII(id) {
+		return id
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func isPrintableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x21 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// clientIP resolves the address of the client. Forwarding headers are only
+// honored when the request came from one of the trusted proxies, in which
+// case X-Forwarded-For is walked from the right skipping trusted hops.
+func (lc loggerConfig) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remote, err := netip.ParseAddr(host)
+	if err != nil || !lc.isTrustedProxy(remote) {
+		return host
+	}
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) != 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			if !lc.isTrustedProxy(hop) || i == 0 {
+				return hop.String()
+			}
+		}
+	}
+	if realIp, err := netip.ParseAddr(r.Header.Get("X-Real-IP")); err == nil {
+		return realIp.String()
+	}
+	return host
+}
+
+func (lc loggerConfig) isTrustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range lc.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	assert.NoError(t, err)
+	lc := loggerConfig{trustedProxies: trusted}
+	cases := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		realIp     string
+		out        string
+	}{
+		{name: "no proxy", remoteAddr: "1.2.3.4:5678", out: "1.2.3.4"},
+		{name: "untrusted proxy", remoteAddr: "1.2.3.4:5678", xff: "5.6.7.8", out: "1.2.3.4"},
+		{name: "trusted proxy", remoteAddr: "10.1.2.3:5678", xff: "5.6.7.8", out: "5.6.7.8"},
+		{name: "chain of trusted proxies", remoteAddr: "192.168.1.1:5678", xff: "6.6.6.6, 5.6.7.8, 10.0.0.1", out: "5.6.7.8"},
+		{name: "only trusted hops", remoteAddr: "10.1.2.3:5678", xff: "10.0.0.2, 10.0.0.1", out: "10.0.0.2"},
+		{name: "X-Real-IP", remoteAddr: "10.1.2.3:5678", realIp: "5.6.7.8", out: "5.6.7.8"},
+		{name: "garbage header", remoteAddr: "10.1.2.3:5678", xff: "monke", out: "10.1.2.3"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/ads", nil)
+			req.RemoteAddr = c.remoteAddr
+			if c.xff != "" {
+				req.Header.Set("X-Forwarded-For", c.xff)
+			}
+			if c.realIp != "" {
+				req.Header.Set("X-Real-IP", c.realIp)
+			}
+			assert.Equal(t, c.out, lc.clientIP(req))
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	prefixes, err := parseTrustedProxies("")
+	assert.NoError(t, err)
+	assert.Empty(t, prefixes)
+	prefixes, err = parseTrustedProxies("127.0.0.1,::1, 10.0.0.0/8")
+	assert.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("127.0.0.1/32"),
+		netip.MustParsePrefix("::1/128"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+	}, prefixes)
+	_, err = parseTrustedProxies("monke")
+	assert.Error(t, err)
+}
+
+func TestAccessLog(t *testing.T) {
+	hook := test.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": 1,
+		"exp": time.Now().UTC().Add(time.Hour).Unix(),
+	}).SignedString(d.jwtSecret)
+
+	t.Run("Response is recorded", func(t *testing.T) {
+		hook.Reset()
+		req := httptest.NewRequest("GET", "/ads", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		chain(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("mock"))
+		}, loggerMiddleware(defaultLoggerConfig, false), authMiddleware(d, true))(rr, req)
+		assert.Len(t, hook.AllEntries(), 1)
+		entry := hook.LastEntry()
+		assert.Equal(t, 201, entry.Data["status"])
+		assert.Equal(t, 4, entry.Data["bytes"])
+		assert.Equal(t, "1", entry.Data["user_id"])
+		assert.Contains(t, entry.Data, "latency_ms")
+		assert.Equal(t, "192.0.2.1", entry.Data["remote_ip"])
+		assert.Equal(t, log.InfoLevel, entry.Level)
+	})
+	t.Run("User id is taken from the token only", func(t *testing.T) {
+		hook.Reset()
+		req := httptest.NewRequest("GET", "/ads", nil)
+		req.Header.Set("userid", "2")
+		rr := httptest.NewRecorder()
+		chain(mockFunc, loggerMiddleware(defaultLoggerConfig, false), authMiddleware(d, true))(rr, req)
+		assert.NotContains(t, hook.LastEntry().Data, "user_id")
+
+		hook.Reset()
+		req.Header.Set("Authorization", "Bearer "+token)
+		chain(mockFunc, loggerMiddleware(defaultLoggerConfig, false), authMiddleware(d, true))(rr, req)
+		assert.Equal(t, "1", hook.LastEntry().Data["user_id"])
+	})
+	t.Run("Request id is generated", func(t *testing.T) {
+		hook.Reset()
+		req := httptest.NewRequest("GET", "/ads", nil)
+		rr := httptest.NewRecorder()
+		loggerMiddleware(defaultLoggerConfig, false)(mockFunc)(rr, req)
+		id := rr.Header().Get(requestIdHeader)
+		assert.Len(t, id, 32)
+		assert.Equal(t, id, hook.LastEntry().Data["request_id"])
+		assert.Equal(t, id, req.Header.Get(requestIdHeader))
+	})
+	t.Run("Request id is propagated", func(t *testing.T) {
+		hook.Reset()
+		req := httptest.NewRequest("GET", "/ads", nil)
+		req.Header.Set(requestIdHeader, "mock-request-id")
+		rr := httptest.NewRecorder()
+		loggerMiddleware(defaultLoggerConfig, false)(mockFunc)(rr, req)
+		assert.Equal(t, "mock-request-id", rr.Header().Get(requestIdHeader))
+		assert.Equal(t, "mock-request-id", hook.LastEntry().Data["request_id"])
+	})
+	t.Run("Server errors are logged as errors", func(t *testing.T) {
+		hook.Reset()
+		req := httptest.NewRequest("GET", "/ads", nil)
+		rr := httptest.NewRecorder()
+		loggerMiddleware(defaultLoggerConfig, false)(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		})(rr, req)
+		assert.Equal(t, log.ErrorLevel, hook.LastEntry().Level)
+		assert.Equal(t, 500, hook.LastEntry().Data["status"])
+	})
+}
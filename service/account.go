@@ -0,0 +1,207 @@
+package service
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+	"vk-feed/types"
+
+	"github.com/go-playground/validator/v10"
+)
+
+func newExportHandler(d dependencies) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "json"
+		}
+		if format != "json" && format != "csv" {
+			writeApiError(w, r, http.StatusBadRequest, types.ApiError{
+				Code:    types.API_ERROR_INVALID_PARAMS,
+				Message: "format must be json or csv",
+				Errors:  []types.ApiFieldError{{Field: "format", Message: "must be json or csv"}},
+			})
+			return
+		}
+		userId, ok := userIdFrom(r.Context())
+		if !ok {
+			loggerFrom(r.Context()).Error("user is not authenticated, yet fell into handler")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		user, err := d.getUser(r.Context(), userId)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		filename := fmt.Sprintf("vk-feed-export-%d", userId)
+		if format == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			filename += ".json"
+		} else {
+			w.Header().Set("Content-Type", "application/zip")
+			filename += ".zip"
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		w.WriteHeader(http.StatusOK)
+		// the status is sent already, a failure can only cut the body short
+		if format == "json" {
+			err = writeJSONExport(r.Context(), w, d, user)
+		} else {
+			err = writeCSVExport(r.Context(), w, d, user)
+		}
+		if err != nil {
+			loggerFrom(r.Context()).Error(err)
+		}
+	}
+}
+
+// writeJSONExport writes {"profile": ..., "ads": [...]}, ads in the v2
+// format.
+func writeJSONExport(ctx context.Context, w io.Writer, d dependencies, user types.User) error {
+	profile, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, `{"profile":%s,"ads":[`, profile); err != nil {
+		return err
+	}
+	first := true
+	err = d.forEachUserAd(ctx, user.Id, func(ad types.AdFeed) error {
+		payload, err := json.Marshal(ad.V2())
+		if err != nil {
+			return err
+		}
+		if !first {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		first = false
+		_, err = w.Write(payload)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "]}\n")
+	return err
+}
+
+// writeCSVExport writes a zip archive of profile.csv and ads.csv.
+func writeCSVExport(ctx context.Context, w io.Writer, d dependencies, user types.User) error {
+	archive := zip.NewWriter(w)
+	f, err := archive.Create("profile.csv")
+	if err != nil {
+		return err
+	}
+	deleteAt := ""
+	if user.DeleteAt != nil {
+		deleteAt = user.DeleteAt.UTC().Format(time.RFC3339)
+	}
+	profile := csv.NewWriter(f)
+	profile.WriteAll([][]string{
+		{"id", "name", "deleteAt"},
+		{strconv.Itoa(user.Id), user.Name, deleteAt},
+	})
+	if err := profile.Error(); err != nil {
+		return err
+	}
+
+	f, err = archive.Create("ads.csv")
+	if err != nil {
+		return err
+	}
+	ads := csv.NewWriter(f)
+	ads.Write([]string{"id", "title", "content", "imageUrl", "price", "createdAt", "latitude", "longitude", "city"})
+	err = d.forEachUserAd(ctx, user.Id, func(ad types.AdFeed) error {
+		return ads.Write([]string{
+			strconv.Itoa(ad.Id), ad.Title, ad.Content, ad.ImageUrl,
+			strconv.Itoa(ad.Price), ad.CreatedAt.Format(time.RFC3339),
+			formatCoordinate(ad.Latitude), formatCoordinate(ad.Longitude), ad.City,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	ads.Flush()
+	if err := ads.Error(); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// formatCoordinate leaves the cell empty for ads without a location.
+func formatCoordinate(c *float64) string {
+	if c == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*c, 'f', -1, 64)
+}
+
+func newDeleteMeHandler(d dependencies, valid *validator.Validate) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength == 0 {
+			writeBodyError(w, r, nil, errEmptyBody)
+			return
+		}
+		content, err := io.ReadAll(r.Body)
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			loggerFrom(r.Context()).Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var dto types.DeleteAccountDto
+		if err := json.Unmarshal(content, &dto); err != nil {
+			writeBodyError(w, r, dto, err)
+			return
+		}
+		if err := valid.Struct(dto); err != nil {
+			writeBodyError(w, r, dto, err)
+			return
+		}
+		userId, ok := userIdFrom(r.Context())
+		if !ok {
+			loggerFrom(r.Context()).Error("user is not authenticated, yet fell into handler")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		deleteAt, err := d.deleteUser(r.Context(), userId, dto.Password)
+		if err == ErrWrongCreds {
+			writeApiError(w, r, http.StatusForbidden, types.ApiError{Code: types.API_ERROR_WRONG_CREDENTIALS, Message: err.Error(), Field: "password"})
+			return
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if deleteAt == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		payload, err := json.Marshal(struct {
+			DeleteAt time.Time `json:"deleteAt"`
+		}{*deleteAt})
+		if err != nil {
+			loggerFrom(r.Context()).Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(payload)
+	}
+}
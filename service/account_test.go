@@ -0,0 +1,180 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"vk-feed/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewExportHandler(t *testing.T) {
+	do := func(query string, userId int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/me/export"+query, nil)
+		req = signedIn(req, userId)
+		rr := httptest.NewRecorder()
+		newExportHandler(m)(rr, req)
+		return rr
+	}
+	t.Run("JSON", func(t *testing.T) {
+		rr := do("", 1)
+		assert.Equal(t, 200, rr.Code)
+		assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+		assert.Equal(t, `attachment; filename="vk-feed-export-1.json"`, rr.Header().Get("Content-Disposition"))
+		var export struct {
+			Profile types.User
+			Ads     []types.AdFeedV2
+		}
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &export))
+		assert.Equal(t, types.User{Id: 1, Name: "mock_name"}, export.Profile)
+		assert.Len(t, export.Ads, 1)
+		assert.Equal(t, "mock_title", export.Ads[0].Title)
+	})
+	t.Run("CSV", func(t *testing.T) {
+		rr := do("?format=csv", 1)
+		assert.Equal(t, 200, rr.Code)
+		assert.Equal(t, "application/zip", rr.Header().Get("Content-Type"))
+		archive, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+		assert.NoError(t, err)
+		files := map[string][][]string{}
+		for _, f := range archive.File {
+			r, err := f.Open()
+			assert.NoError(t, err)
+			files[f.Name], err = csv.NewReader(r).ReadAll()
+			assert.NoError(t, err)
+			r.Close()
+		}
+		assert.Equal(t, [][]string{{"id", "name", "deleteAt"}, {"1", "mock_name", ""}}, files["profile.csv"])
+		assert.Len(t, files["ads.csv"], 2)
+		assert.Equal(t, []string{"1", "mock_title", "mock_content", "http://mocksite.com/image.jpg", "6969"}, files["ads.csv"][1][:5])
+	})
+	t.Run("Bad format", func(t *testing.T) {
+		rr := do("?format=xml", 1)
+		assert.Equal(t, 400, rr.Code)
+		assert.JSONEq(t, `{"code":"invalid_params","message":"format must be json or csv","errors":[{"field":"format","message":"must be json or csv"}]}`, rr.Body.String())
+	})
+	t.Run("User not found", func(t *testing.T) {
+		rr := do("", 2)
+		assert.Equal(t, 404, rr.Code)
+	})
+}
+
+func TestNewDeleteMeHandler(t *testing.T) {
+	do := func(body any, userId int) *httptest.ResponseRecorder {
+		req := newRequest("DELETE", "/me", body)
+		if body == nil {
+			req = httptest.NewRequest("DELETE", "/me", nil)
+		}
+		req = signedIn(req, userId)
+		rr := httptest.NewRecorder()
+		newDeleteMeHandler(m, valid)(rr, req)
+		return rr
+	}
+	t.Run("Deleted", func(t *testing.T) {
+		rr := do(types.DeleteAccountDto{Password: "mock_password"}, 1)
+		assert.Equal(t, 204, rr.Code)
+		assert.Empty(t, rr.Body.Bytes())
+	})
+	t.Run("Wrong password", func(t *testing.T) {
+		rr := do(types.DeleteAccountDto{Password: "wrong_password"}, 1)
+		assert.Equal(t, 403, rr.Code)
+		assert.JSONEq(t, `{"code":"wrong_credentials","message":"wrong credentials","field":"password"}`, rr.Body.String())
+	})
+	t.Run("User not found", func(t *testing.T) {
+		rr := do(types.DeleteAccountDto{Password: "mock_password"}, 2)
+		assert.Equal(t, 404, rr.Code)
+	})
+	t.Run("No body provided", func(t *testing.T) {
+		rr := do(nil, 1)
+		assert.Equal(t, 400, rr.Code)
+	})
+	t.Run("Password too short", func(t *testing.T) {
+		rr := do(types.DeleteAccountDto{Password: "mock"}, 1)
+		assert.Equal(t, 400, rr.Code)
+	})
+}
+
+func TestExportIgnoresUserIdHeader(t *testing.T) {
+	h := newMemoryHandler(t, "mock_victim", "mock_name")
+	req := httptest.NewRequest("GET", "/v1/me/export", nil)
+	req.Header.Set("Authorization", "Bearer "+signin(t, h))
+	req.Header.Set("userid", "1")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, 200, rr.Code)
+	assert.Equal(t, `attachment; filename="vk-feed-export-2.json"`, rr.Header().Get("Content-Disposition"))
+	assert.NotContains(t, rr.Body.String(), "mock_victim")
+}
+
+// scheduleDB records the scheduled deletion.
+type scheduleDB struct {
+	mockDBConnection
+	at *time.Time
+}
+
+func (db scheduleDB) ScheduleUserDeletion(ctx context.Context, id int, at time.Time) error {
+	*db.at = at
+	return nil
+}
+
+func TestDeleteUser(t *testing.T) {
+	d := deps{client: mockDBConnection{}}
+	t.Run("Deleted at once", func(t *testing.T) {
+		deleteAt, err := d.deleteUser(context.Background(), 1, "mock_password")
+		assert.NoError(t, err)
+		assert.Nil(t, deleteAt)
+	})
+	t.Run("Scheduled", func(t *testing.T) {
+		var scheduled time.Time
+		d := deps{client: scheduleDB{at: &scheduled}, deletionGrace: time.Hour}
+		deleteAt, err := d.deleteUser(context.Background(), 1, "mock_password")
+		assert.NoError(t, err)
+		assert.Equal(t, scheduled, *deleteAt)
+		assert.WithinDuration(t, time.Now().Add(time.Hour), *deleteAt, time.Minute)
+	})
+	t.Run("Wrong password", func(t *testing.T) {
+		_, err := d.deleteUser(context.Background(), 1, "wrong_password")
+		assert.Equal(t, ErrWrongCreds, err)
+	})
+	t.Run("User not found", func(t *testing.T) {
+		_, err := d.deleteUser(context.Background(), 2, "mock_password")
+		assert.Equal(t, ErrUserNotFound, err)
+	})
+}
+
+func TestGetUser(t *testing.T) {
+	d := deps{client: mockDBConnection{}}
+	user, err := d.getUser(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, types.User{Id: 1, Name: "mock_name"}, user)
+	_, err = d.getUser(context.Background(), 2)
+	assert.Equal(t, ErrUserNotFound, err)
+}
+
+// cancelDB records whose deletion was cancelled.
+type cancelDB struct {
+	mockDBConnection
+	cancelled *int
+}
+
+func (db cancelDB) CancelUserDeletion(ctx context.Context, id int) error {
+	*db.cancelled = id
+	return nil
+}
+
+func TestSigninCancelsDeletion(t *testing.T) {
+	var cancelled int
+	d := deps{client: cancelDB{cancelled: &cancelled}, jwtSecret: []byte("mock_jwt_secret")}
+	_, err := d.signIn(context.Background(), "mock_name", "wrong_password")
+	assert.Equal(t, ErrWrongCreds, err)
+	assert.Equal(t, 0, cancelled)
+	_, err = d.signIn(context.Background(), "mock_name", "mock_password")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, cancelled)
+}
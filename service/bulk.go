@@ -0,0 +1,247 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"vk-feed/config"
+	"vk-feed/types"
+
+	"github.com/go-playground/validator/v10"
+)
+
+var (
+	errUnsupportedFormat = errors.New("unsupported format, use text/csv or application/x-ndjson")
+	errNoRows            = errors.New("no rows to import")
+)
+
+// bulkRow is a parsed row of an import. Row numbers are 1-based and count
+// data rows for CSV and lines for JSONL.
+type bulkRow struct {
+	row int
+	dto types.AdDto
+	err error
+}
+
+func newCreateAdsBulkHandler(d dependencies, valid *validator.Validate, bc config.Bulk) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var atomic bool
+		switch r.URL.Query().Get("mode") {
+		case "", "atomic":
+			atomic = true
+		case "partial":
+		default:
+			writeApiError(w, r, http.StatusBadRequest, types.ApiError{
+				Code:    types.API_ERROR_INVALID_PARAMS,
+				Message: "mode must be atomic or partial",
+				Errors:  []types.ApiFieldError{{Field: "mode", Message: "must be atomic or partial"}},
+			})
+			return
+		}
+		content, err := io.ReadAll(r.Body)
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			loggerFrom(r.Context()).Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rows, err := parseBulk(r.Header.Get("Content-Type"), content)
+		if err == errUnsupportedFormat {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err == nil && len(rows) == 0 {
+			err = errNoRows
+		}
+		if err == nil && len(rows) > bc.MaxRows {
+			err = fmt.Errorf("too many rows: %d, at most %d are allowed", len(rows), bc.MaxRows)
+		}
+		if err != nil {
+			writeBodyError(w, r, nil, err)
+			return
+		}
+		userId, ok := userIdFrom(r.Context())
+		if !ok {
+			loggerFrom(r.Context()).Error("user is not authenticated, yet fell into handler")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		results := make([]types.BulkAdResult, len(rows))
+		var dtos []types.AdDto
+		var idx []int
+		for i, row := range rows {
+			results[i].Row = row.row
+			if row.err == nil {
+				row.err = valid.Struct(row.dto)
+			}
+			if row.err != nil {
+				results[i].Status = types.BULK_AD_INVALID
+				results[i].Error = row.err.Error()
+				continue
+			}
+			dtos = append(dtos, row.dto)
+			idx = append(idx, i)
+		}
+		if atomic && len(dtos) < len(rows) {
+			// nothing is inserted, so the images are not worth checking
+			for _, i := range idx {
+				results[i].Status = types.BULK_AD_SKIPPED
+			}
+		} else if len(dtos) > 0 {
+			created, err := d.createAds(r.Context(), dtos, userId, atomic)
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			for j, res := range created {
+				res.Row = results[idx[j]].Row
+				results[idx[j]] = res
+			}
+		}
+
+		report := types.BulkAdReport{Results: results}
+		for _, res := range results {
+			if res.Status == types.BULK_AD_CREATED {
+				report.Created++
+			} else {
+				report.Failed++
+			}
+		}
+		payload, err := json.Marshal(report)
+		if err != nil {
+			loggerFrom(r.Context()).Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case report.Failed == 0:
+			w.WriteHeader(http.StatusCreated)
+		case report.Created == 0:
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		default:
+			w.WriteHeader(http.StatusMultiStatus)
+		}
+		w.Write(payload)
+	}
+}
+
+func parseBulk(contentType string, content []byte) ([]bulkRow, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, errUnsupportedFormat
+	}
+	switch mediaType {
+	case "text/csv":
+		return parseCSV(content)
+	case "application/x-ndjson", "application/jsonl", "application/x-jsonlines":
+		return parseJSONL(content)
+	default:
+		return nil, errUnsupportedFormat
+	}
+}
+
+// parseCSV expects a header naming the columns title, content, imageUrl
+// (or image_url) and price in any order. The latitude, longitude and city
+// columns are optional, other columns are ignored.
+func parseCSV(content []byte) ([]bulkRow, error) {
+	r := csv.NewReader(bytes.NewReader(content))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, errNoRows
+	}
+	if err != nil {
+		return nil, err
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if name == "image_url" {
+			name = "imageurl"
+		}
+		columns[name] = i
+	}
+	for _, name := range []string{"title", "content", "imageurl", "price"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("csv header has no %s column", name)
+		}
+	}
+
+	var rows []bulkRow
+	for n := 1; ; n++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		row := bulkRow{row: n, dto: types.AdDto{
+			Title:    field("title"),
+			Content:  field("content"),
+			ImageUrl: field("imageurl"),
+		}}
+		if row.dto.Price, err = strconv.Atoi(field("price")); err != nil {
+			row.err = fmt.Errorf("price %q is not an integer", field("price"))
+		}
+		row.dto.City = field("city")
+		for _, name := range []string{"latitude", "longitude"} {
+			raw := field(name)
+			if raw == "" {
+				continue
+			}
+			f, err := parseFloat(raw)
+			if err != nil && row.err == nil {
+				row.err = fmt.Errorf("%s %q is not a number", name, raw)
+			}
+			if name == "latitude" {
+				row.dto.Latitude = &f
+			} else {
+				row.dto.Longitude = &f
+			}
+		}
+		if (row.dto.Latitude == nil) != (row.dto.Longitude == nil) && row.err == nil {
+			row.err = errors.New("latitude and longitude must be given together")
+		}
+		rows = append(rows, row)
+	}
+}
+
+// parseJSONL reads an ad per line, empty lines are skipped.
+func parseJSONL(content []byte) ([]bulkRow, error) {
+	s := bufio.NewScanner(bytes.NewReader(content))
+	s.Buffer(nil, len(content)+1)
+	var rows []bulkRow
+	for n := 1; s.Scan(); n++ {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		row := bulkRow{row: n}
+		row.err = json.Unmarshal(line, &row.dto)
+		rows = append(rows, row)
+	}
+	return rows, s.Err()
+}
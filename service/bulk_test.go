@@ -0,0 +1,276 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"vk-feed/config"
+	imgC "vk-feed/image-checker"
+	"vk-feed/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const bulkCSV = `title,content,imageUrl,price
+mock_title,mock_content,http://mocksite.com/image.jpg,6969
+"title, with comma",mock_content,http://mocksite.com/image.jpg,100
+`
+
+const bulkJSONL = `{"title": "mock_title", "content": "mock_content", "imageUrl": "http://mocksite.com/image.jpg", "price": 6969}
+
+{"title": "mock_title", "content": "mock_content", "imageUrl": "http://mocksite.com/image.jpg", "price": 100}
+`
+
+func TestParseBulk(t *testing.T) {
+	t.Run("CSV", func(t *testing.T) {
+		rows, err := parseBulk("text/csv; charset=utf-8", []byte(bulkCSV))
+		assert.NoError(t, err)
+		assert.Equal(t, []bulkRow{
+			{row: 1, dto: types.AdDto{Title: "mock_title", Content: "mock_content", ImageUrl: "http://mocksite.com/image.jpg", Price: 6969}},
+			{row: 2, dto: types.AdDto{Title: "title, with comma", Content: "mock_content", ImageUrl: "http://mocksite.com/image.jpg", Price: 100}},
+		}, rows)
+	})
+	t.Run("CSV columns in any order", func(t *testing.T) {
+		rows, err := parseBulk("text/csv", []byte("price,image_url,extra,content,title\n5,http://a.b/c.jpg,x,mock_content,mock_title\n"))
+		assert.NoError(t, err)
+		assert.Equal(t, types.AdDto{Title: "mock_title", Content: "mock_content", ImageUrl: "http://a.b/c.jpg", Price: 5}, rows[0].dto)
+	})
+	t.Run("CSV bad price", func(t *testing.T) {
+		rows, err := parseBulk("text/csv", []byte("title,content,imageUrl,price\nmock_title,mock_content,http://a.b/c.jpg,cheap\n"))
+		assert.NoError(t, err)
+		assert.EqualError(t, rows[0].err, `price "cheap" is not an integer`)
+	})
+	t.Run("CSV location", func(t *testing.T) {
+		rows, err := parseBulk("text/csv", []byte("title,content,imageUrl,price,latitude,longitude,city\n"+
+			"mock_title,mock_content,http://a.b/c.jpg,5,55.7558,37.6173,Москва\n"+
+			"mock_title,mock_content,http://a.b/c.jpg,5,,,\n"+
+			"mock_title,mock_content,http://a.b/c.jpg,5,north,37.6173,\n"+
+			"mock_title,mock_content,http://a.b/c.jpg,5,NaN,37.6173,\n"+
+			"mock_title,mock_content,http://a.b/c.jpg,5,55.7558,-Inf,\n"+
+			"mock_title,mock_content,http://a.b/c.jpg,5,55.7558,,\n"+
+			"mock_title,mock_content,http://a.b/c.jpg,5,,37.6173,Москва\n"))
+		assert.NoError(t, err)
+		lat, lon := 55.7558, 37.6173
+		assert.Equal(t, types.AdDto{Title: "mock_title", Content: "mock_content", ImageUrl: "http://a.b/c.jpg", Price: 5, Latitude: &lat, Longitude: &lon, City: "Москва"}, rows[0].dto)
+		assert.Nil(t, rows[1].dto.Latitude)
+		assert.NoError(t, rows[1].err)
+		assert.EqualError(t, rows[2].err, `latitude "north" is not a number`)
+		assert.EqualError(t, rows[3].err, `latitude "NaN" is not a number`)
+		assert.EqualError(t, rows[4].err, `longitude "-Inf" is not a number`)
+		assert.EqualError(t, rows[5].err, "latitude and longitude must be given together")
+		assert.EqualError(t, rows[6].err, "latitude and longitude must be given together")
+	})
+	t.Run("CSV short row", func(t *testing.T) {
+		rows, err := parseBulk("text/csv", []byte("title,content,imageUrl,price\nmock_title\n"))
+		assert.NoError(t, err)
+		assert.Equal(t, "mock_title", rows[0].dto.Title)
+		assert.Error(t, rows[0].err)
+	})
+	t.Run("CSV missing column", func(t *testing.T) {
+		_, err := parseBulk("text/csv", []byte("title,content,price\n"))
+		assert.EqualError(t, err, "csv header has no imageurl column")
+	})
+	t.Run("JSONL", func(t *testing.T) {
+		rows, err := parseBulk("application/x-ndjson", []byte(bulkJSONL))
+		assert.NoError(t, err)
+		assert.Len(t, rows, 2)
+		assert.Equal(t, 1, rows[0].row)
+		assert.Equal(t, 3, rows[1].row)
+		assert.Equal(t, 100, rows[1].dto.Price)
+	})
+	t.Run("JSONL bad line", func(t *testing.T) {
+		rows, err := parseBulk("application/jsonl", []byte(`{"title": 1}`+"\n"+`{"title"`))
+		assert.NoError(t, err)
+		assert.Error(t, rows[0].err)
+		assert.Error(t, rows[1].err)
+	})
+	t.Run("Unsupported", func(t *testing.T) {
+		_, err := parseBulk("application/json", []byte(`[]`))
+		assert.Equal(t, errUnsupportedFormat, err)
+		_, err = parseBulk("", []byte(bulkCSV))
+		assert.Equal(t, errUnsupportedFormat, err)
+	})
+}
+
+func TestNewCreateAdsBulkHandler(t *testing.T) {
+	bc := config.Default().Bulk
+	do := func(query, contentType, body string) (*httptest.ResponseRecorder, types.BulkAdReport) {
+		req := httptest.NewRequest("POST", "/ads/bulk"+query, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req = signedIn(req, 1)
+		rr := httptest.NewRecorder()
+		newCreateAdsBulkHandler(m, valid, bc)(rr, req)
+		var report types.BulkAdReport
+		json.Unmarshal(rr.Body.Bytes(), &report)
+		return rr, report
+	}
+	withInvalid := bulkCSV + "a,mock_content,http://mocksite.com/image.jpg,1\n"
+	withBadImage := bulkCSV + "mock_title,mock_content,http://othersite.com/image.jpg,1\n"
+
+	t.Run("All created", func(t *testing.T) {
+		rr, report := do("", "text/csv", bulkCSV)
+		assert.Equal(t, 201, rr.Code)
+		assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+		assert.Equal(t, types.BulkAdReport{Created: 2, Results: []types.BulkAdResult{
+			{Row: 1, Status: types.BULK_AD_CREATED, Id: 1},
+			{Row: 2, Status: types.BULK_AD_CREATED, Id: 2},
+		}}, report)
+	})
+	t.Run("JSONL", func(t *testing.T) {
+		rr, report := do("?mode=partial", "application/x-ndjson", bulkJSONL)
+		assert.Equal(t, 201, rr.Code)
+		assert.Equal(t, 3, report.Results[1].Row)
+	})
+	t.Run("Atomic with invalid row", func(t *testing.T) {
+		rr, report := do("", "text/csv", withInvalid)
+		assert.Equal(t, 422, rr.Code)
+		assert.Equal(t, 0, report.Created)
+		assert.Equal(t, 3, report.Failed)
+		assert.Equal(t, types.BULK_AD_SKIPPED, report.Results[0].Status)
+		assert.Equal(t, types.BULK_AD_INVALID, report.Results[2].Status)
+		assert.Contains(t, report.Results[2].Error, "Title")
+	})
+	t.Run("Atomic with bad image", func(t *testing.T) {
+		rr, report := do("?mode=atomic", "text/csv", withBadImage)
+		assert.Equal(t, 422, rr.Code)
+		assert.Equal(t, types.BULK_AD_SKIPPED, report.Results[0].Status)
+		assert.Equal(t, types.BulkAdResult{Row: 3, Status: types.BULK_AD_INVALID, Error: imgC.ErrUrlUnavailable.Error()}, report.Results[2])
+	})
+	t.Run("Partial", func(t *testing.T) {
+		rr, report := do("?mode=partial", "text/csv", withInvalid)
+		assert.Equal(t, 207, rr.Code)
+		assert.Equal(t, 2, report.Created)
+		assert.Equal(t, 1, report.Failed)
+		assert.Equal(t, types.BULK_AD_INVALID, report.Results[2].Status)
+	})
+	t.Run("Partial with NaN location", func(t *testing.T) {
+		rr, report := do("?mode=partial", "text/csv", "title,content,imageUrl,price,latitude,longitude\n"+
+			"mock_title,mock_content,http://mocksite.com/image.jpg,1,55.7558,37.6173\n"+
+			"mock_title,mock_content,http://mocksite.com/image.jpg,1,NaN,NaN\n")
+		assert.Equal(t, 207, rr.Code)
+		assert.Equal(t, types.BULK_AD_INVALID, report.Results[1].Status)
+	})
+	t.Run("Partial none created", func(t *testing.T) {
+		rr, report := do("?mode=partial", "text/csv", "title,content,imageUrl,price\na,b,c,d\n")
+		assert.Equal(t, 422, rr.Code)
+		assert.Equal(t, 1, report.Failed)
+	})
+	t.Run("Bad mode", func(t *testing.T) {
+		rr, _ := do("?mode=monke", "text/csv", bulkCSV)
+		assert.Equal(t, 400, rr.Code)
+	})
+	t.Run("Unsupported format", func(t *testing.T) {
+		rr, _ := do("", "application/json", `[]`)
+		assert.Equal(t, 415, rr.Code)
+	})
+	t.Run("No rows", func(t *testing.T) {
+		rr, _ := do("", "text/csv", "title,content,imageUrl,price\n")
+		assert.Equal(t, 400, rr.Code)
+		assert.JSONEq(t, `{"code":"invalid_body","message":"no rows to import"}`, rr.Body.String())
+	})
+	t.Run("Too many rows", func(t *testing.T) {
+		bc := bc
+		bc.MaxRows = 1
+		req := httptest.NewRequest("POST", "/ads/bulk", strings.NewReader(bulkCSV))
+		req.Header.Set("Content-Type", "text/csv")
+		req = signedIn(req, 1)
+		rr := httptest.NewRecorder()
+		newCreateAdsBulkHandler(m, valid, bc)(rr, req)
+		assert.Equal(t, 400, rr.Code)
+		assert.JSONEq(t, `{"code":"invalid_body","message":"too many rows: 2, at most 1 are allowed"}`, rr.Body.String())
+	})
+}
+
+func TestBulkIgnoresUserIdHeader(t *testing.T) {
+	h := newMemoryHandler(t, "mock_victim", "mock_name")
+	req := httptest.NewRequest("POST", "/v1/ads/bulk", strings.NewReader(bulkCSV))
+	req.Header.Set("Content-Type", "text/csv")
+	req.Header.Set("Authorization", "Bearer "+signin(t, h))
+	req.Header.Set("userid", "1")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, 201, rr.Code)
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/ads", nil))
+	var feed []types.AdFeed
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &feed))
+	assert.Len(t, feed, 2)
+	for _, ad := range feed {
+		assert.Equal(t, 2, ad.AuthorId)
+	}
+}
+
+// slowIC counts how many checks run at the same time.
+type slowIC struct {
+	running, peak *atomic.Int32
+}
+
+func (ic slowIC) Check(ctx context.Context, url string) error {
+	n := ic.running.Add(1)
+	defer ic.running.Add(-1)
+	for {
+		peak := ic.peak.Load()
+		if n <= peak || ic.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	return mockIC{}.Check(ctx, url)
+}
+
+func TestCreateAds(t *testing.T) {
+	ok := types.AdDto{Title: "mock_title", Content: "mock_content", ImageUrl: "OK", Price: 6969}
+	bad := ok
+	bad.ImageUrl = "NOT OK"
+	d := deps{client: mockDBConnection{}, ic: mockIC{}, imageTimeout: time.Second, bulkParallelism: 2}
+
+	t.Run("Atomic", func(t *testing.T) {
+		results, err := d.createAds(context.Background(), []types.AdDto{ok, ok}, 1, true)
+		assert.NoError(t, err)
+		assert.Equal(t, []types.BulkAdResult{
+			{Status: types.BULK_AD_CREATED, Id: 1},
+			{Status: types.BULK_AD_CREATED, Id: 2},
+		}, results)
+	})
+	t.Run("Atomic with bad image", func(t *testing.T) {
+		results, err := d.createAds(context.Background(), []types.AdDto{ok, bad}, 1, true)
+		assert.NoError(t, err)
+		assert.Equal(t, []types.BulkAdResult{
+			{Status: types.BULK_AD_SKIPPED},
+			{Status: types.BULK_AD_INVALID, Error: imgC.ErrUrlUnavailable.Error()},
+		}, results)
+	})
+	t.Run("Atomic insert fails", func(t *testing.T) {
+		_, err := d.createAds(context.Background(), []types.AdDto{ok}, 0, true)
+		assert.Error(t, err)
+	})
+	t.Run("Partial", func(t *testing.T) {
+		results, err := d.createAds(context.Background(), []types.AdDto{bad, ok}, 1, false)
+		assert.NoError(t, err)
+		assert.Equal(t, types.BULK_AD_INVALID, results[0].Status)
+		assert.Equal(t, types.BulkAdResult{Status: types.BULK_AD_CREATED, Id: 1}, results[1])
+	})
+	t.Run("Partial insert fails", func(t *testing.T) {
+		results, err := d.createAds(context.Background(), []types.AdDto{ok}, 0, false)
+		assert.NoError(t, err)
+		assert.Equal(t, types.BULK_AD_FAILED, results[0].Status)
+	})
+	t.Run("Bounded parallelism", func(t *testing.T) {
+		var running, peak atomic.Int32
+		d := d
+		d.ic = slowIC{&running, &peak}
+		dtos := make([]types.AdDto, 10)
+		for i := range dtos {
+			dtos[i] = ok
+		}
+		_, err := d.createAds(context.Background(), dtos, 1, true)
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, peak.Load(), int32(2))
+		assert.Equal(t, int32(2), peak.Load())
+	})
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"sync"
+	"time"
+	"vk-feed/metrics"
+	"vk-feed/types"
+)
+
+// feedCache keeps anonymous feed pages, the only ones shared by everybody.
+// Writes going through the service drop it all; writes it does not see,
+// made by other instances or by the purge of deleted accounts, show up
+// after ttl at the latest.
+type feedCache struct {
+	ttl        time.Duration
+	maxEntries int
+	// how long after a write a page read from a replica may miss it
+	settle time.Duration
+	now    func() time.Time
+
+	mu            sync.Mutex
+	entries       map[types.GetAdParams]feedCacheEntry
+	generation    uint64
+	invalidatedAt time.Time
+}
+
+type feedCacheEntry struct {
+	feed    []types.AdFeed
+	expires time.Time
+}
+
+// newFeedCache returns nil, a cache that never hits, when ttl is zero.
+// Pages are not stored for settle after a write, as reads may go to a
+// replica that has not caught up yet.
+func newFeedCache(ttl time.Duration, maxEntries int, settle time.Duration) *feedCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &feedCache{ttl: ttl, maxEntries: maxEntries, settle: settle, now: time.Now, entries: map[types.GetAdParams]feedCacheEntry{}}
+}
+
+// get returns the cached page and, on a miss, the generation to pass to put
+// once the page is loaded.
+func (c *feedCache) get(params types.GetAdParams) (feed []types.AdFeed, generation uint64, ok bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[params]
+	if ok && c.now().Before(entry.expires) {
+		metrics.FeedCacheRequests.WithLabelValues("hit").Inc()
+		return entry.feed, c.generation, true
+	}
+	metrics.FeedCacheRequests.WithLabelValues("miss").Inc()
+	return nil, c.generation, false
+}
+
+// put stores a page loaded at generation, unless a write invalidated the
+// cache since or too recently and the page may already be stale.
+func (c *feedCache) put(params types.GetAdParams, generation uint64, feed []types.AdFeed) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if generation != c.generation || now.Before(c.invalidatedAt.Add(c.settle)) {
+		return
+	}
+	if len(c.entries) >= c.maxEntries {
+		for key, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+	}
+	if len(c.entries) >= c.maxEntries {
+		// map order is random enough to pick a victim
+		for key := range c.entries {
+			delete(c.entries, key)
+			break
+		}
+	}
+	c.entries[params] = feedCacheEntry{feed: feed, expires: now.Add(c.ttl)}
+}
+
+func (c *feedCache) invalidate() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.invalidatedAt = c.now()
+	clear(c.entries)
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"testing"
+	"time"
+	"vk-feed/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFeedCache(t *testing.T) {
+	page := func(n int) types.GetAdParams {
+		return types.GetAdParams{Page: n, PageSize: 10, SortBy: types.SORT_BY_DATE, OrderBy: types.ORDER_BY_ASC}
+	}
+	feed := []types.AdFeed{{Id: 1, Price: 6969}}
+
+	t.Run("hit until expired", func(t *testing.T) {
+		c := newFeedCache(time.Second, 10, 0)
+		now := time.Now()
+		c.now = func() time.Time { return now }
+		_, generation, ok := c.get(page(0))
+		assert.False(t, ok)
+		c.put(page(0), generation, feed)
+		got, _, ok := c.get(page(0))
+		assert.True(t, ok)
+		assert.Equal(t, feed, got)
+		_, _, ok = c.get(page(1))
+		assert.False(t, ok, "params are the key")
+
+		now = now.Add(time.Second)
+		_, _, ok = c.get(page(0))
+		assert.False(t, ok)
+	})
+	t.Run("invalidate", func(t *testing.T) {
+		c := newFeedCache(time.Minute, 10, 0)
+		_, generation, _ := c.get(page(0))
+		c.put(page(0), generation, feed)
+		c.invalidate()
+		_, _, ok := c.get(page(0))
+		assert.False(t, ok)
+	})
+	t.Run("pages loaded before a write are not stored", func(t *testing.T) {
+		c := newFeedCache(time.Minute, 10, 0)
+		_, generation, _ := c.get(page(0))
+		c.invalidate()
+		c.put(page(0), generation, feed)
+		_, _, ok := c.get(page(0))
+		assert.False(t, ok)
+	})
+	t.Run("pages are not stored while replicas settle", func(t *testing.T) {
+		c := newFeedCache(time.Minute, 10, 5*time.Second)
+		now := time.Now()
+		c.now = func() time.Time { return now }
+		c.invalidate()
+		_, generation, _ := c.get(page(0))
+		c.put(page(0), generation, feed)
+		_, _, ok := c.get(page(0))
+		assert.False(t, ok)
+
+		now = now.Add(5 * time.Second)
+		_, generation, _ = c.get(page(0))
+		c.put(page(0), generation, feed)
+		_, _, ok = c.get(page(0))
+		assert.True(t, ok)
+	})
+	t.Run("size is bounded", func(t *testing.T) {
+		c := newFeedCache(time.Minute, 3, 0)
+		for i := 0; i < 10; i++ {
+			c.put(page(i), 0, feed)
+		}
+		assert.Len(t, c.entries, 3)
+		_, _, ok := c.get(page(9))
+		assert.True(t, ok, "the newest page is kept")
+	})
+	t.Run("disabled", func(t *testing.T) {
+		c := newFeedCache(0, 10, 0)
+		assert.Nil(t, c)
+		c.put(page(0), 0, feed)
+		_, _, ok := c.get(page(0))
+		assert.False(t, ok)
+		c.invalidate()
+	})
+}
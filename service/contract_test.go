@@ -0,0 +1,251 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"vk-feed/config"
+	"vk-feed/db"
+	"vk-feed/openapi"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/stretchr/testify/assert"
+)
+
+type contractIC struct{}
+
+func (contractIC) Check(ctx context.Context, url string) error { return nil }
+
+func newContractHandler(t *testing.T) (http.Handler, *openapi3.T) {
+	cfg := config.Default()
+	cfg.JwtSecret = strings.Repeat("s", 32)
+	cfg.Http.MaxBodySize = 256
+	h, err := NewHandler(WithDB(mockDBConnection{}), WithImageChecker(contractIC{}), WithConfig(cfg))
+	assert.NoError(t, err)
+	doc, err := openapi.Load(context.Background())
+	assert.NoError(t, err)
+	return h, doc
+}
+
+// validateContract serves the request and checks the response against the
+// operation documented for its path and method.
+func validateContract(t *testing.T, h http.Handler, doc *openapi3.T, r *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+
+	pathItem := doc.Paths.Find(r.URL.Path)
+	if !assert.NotNil(t, pathItem, "path %s is not documented", r.URL.Path) {
+		return rr
+	}
+	op := pathItem.GetOperation(r.Method)
+	if !assert.NotNil(t, op, "operation %s %s is not documented", r.Method, r.URL.Path) {
+		return rr
+	}
+	input := &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: &openapi3filter.RequestValidationInput{
+			Request: r,
+			Route:   &routers.Route{Spec: doc, Path: r.URL.Path, PathItem: pathItem, Method: r.Method, Operation: op},
+		},
+		Status:  rr.Code,
+		Header:  rr.Header(),
+		Body:    io.NopCloser(bytes.NewReader(rr.Body.Bytes())),
+		Options: &openapi3filter.Options{IncludeResponseStatus: true},
+	}
+	assert.NoError(t, openapi3filter.ValidateResponse(context.Background(), input), "%s %s", r.Method, r.URL.Path)
+	return rr
+}
+
+func TestContract(t *testing.T) {
+	h, doc := newContractHandler(t)
+	ad := map[string]any{
+		"title":    "mock_title",
+		"content":  "mock_content",
+		"imageUrl": "http://mocksite.com/image.jpg",
+		"price":    6969,
+	}
+	located := map[string]any{
+		"title":     "mock_title",
+		"content":   "mock_content",
+		"imageUrl":  "http://mocksite.com/image.jpg",
+		"price":     6969,
+		"latitude":  55.7558,
+		"longitude": 37.6173,
+		"city":      "Москва",
+	}
+	for _, version := range []apiVersion{apiLegacy, apiV1, apiV2} {
+		prefix := version.prefix()
+		rr := validateContract(t, h, doc, newRequest("POST", prefix+"/signin", map[string]any{"name": "mock_name", "password": "mock_password"}))
+		var token struct{ Token string }
+		json.Unmarshal(rr.Body.Bytes(), &token)
+		withToken := func(r *http.Request) *http.Request {
+			r.Header.Set("Authorization", "Bearer "+token.Token)
+			return r
+		}
+
+		bulk := func(contentType, body string) *http.Request {
+			r := httptest.NewRequest("POST", prefix+"/ads/bulk?mode=partial", strings.NewReader(body))
+			r.Header.Set("Content-Type", contentType)
+			return withToken(r)
+		}
+
+		strict := func(r *http.Request) *http.Request {
+			r.Header.Set("Prefer", "handling=strict")
+			return r
+		}
+
+		cases := []struct {
+			name   string
+			req    *http.Request
+			status int
+		}{
+			{"Signup", newRequest("POST", prefix+"/signup", map[string]any{"name": "mock_name", "password": "mock_password"}), 201},
+			{"Signup invalid", newRequest("POST", prefix+"/signup", map[string]any{"name": "mock", "password": "mock_password"}), 400},
+			{"Signup empty", httptest.NewRequest("POST", prefix+"/signup", nil), 400},
+			{"Signup too large", newRequest("POST", prefix+"/signup", map[string]any{"name": strings.Repeat("a", 512)}), 413},
+			{"Signin wrong credentials", newRequest("POST", prefix+"/signin", map[string]any{"name": "wrong_name", "password": "mock_password"}), 404},
+			{"Create ad", withToken(newRequest("POST", prefix+"/ads", ad)), 201},
+			{"Create ad with location", withToken(newRequest("POST", prefix+"/ads", located)), 201},
+			{"Create ad invalid", withToken(newRequest("POST", prefix+"/ads", map[string]any{"title": "mock_title"})), 400},
+			{"Create ad unauthorized", newRequest("POST", prefix+"/ads", ad), 401},
+			{"Bulk import", bulk("text/csv", bulkCSV), 201},
+			{"Bulk import partially", bulk("text/csv", bulkCSV+"a,b,c,d\n"), 207},
+			{"Bulk import nothing valid", bulk("application/x-ndjson", `{"title": 1}`), 422},
+			{"Bulk import unsupported", bulk("application/json", `[]`), 415},
+			{"Get ads", httptest.NewRequest("GET", prefix+"/ads?sort_by=price&order_by=desc", nil), 200},
+			{"Get ads authorized", withToken(httptest.NewRequest("GET", prefix+"/ads", nil)), 200},
+			{"Get ads strict", strict(httptest.NewRequest("GET", prefix+"/ads?page=1&sort_by=price", nil)), 200},
+			{"Get ads near", httptest.NewRequest("GET", prefix+"/ads?lat=55.75&lon=37.62&radius_km=50&sort_by=distance", nil), 200},
+			{"Get ads strict invalid", strict(httptest.NewRequest("GET", prefix+"/ads?page=-1&sort_by=monke", nil)), 400},
+		}
+		for _, c := range cases {
+			t.Run(prefix+" "+c.name, func(t *testing.T) {
+				rr := validateContract(t, h, doc, c.req)
+				assert.Equal(t, c.status, rr.Code)
+			})
+		}
+		t.Run(prefix+" Get ads not modified", func(t *testing.T) {
+			rr := validateContract(t, h, doc, httptest.NewRequest("GET", prefix+"/ads", nil))
+			req := httptest.NewRequest("GET", prefix+"/ads", nil)
+			req.Header.Set("If-None-Match", rr.Header().Get("ETag"))
+			rr = validateContract(t, h, doc, req)
+			assert.Equal(t, 304, rr.Code)
+		})
+	}
+	t.Run("Spec", func(t *testing.T) {
+		rr := validateContract(t, h, doc, httptest.NewRequest("GET", "/openapi.yaml", nil))
+		assert.Equal(t, 200, rr.Code)
+		assert.Equal(t, openapi.Spec, rr.Body.Bytes())
+	})
+}
+
+// TestContractErrors runs on the in-memory database, the mock cannot tell
+// existing users from new ones.
+func TestContractErrors(t *testing.T) {
+	cfg := config.Default()
+	cfg.JwtSecret = strings.Repeat("s", 32)
+	h, err := NewHandler(WithDB(db.NewMemoryConnection()), WithImageChecker(contractIC{}), WithConfig(cfg))
+	assert.NoError(t, err)
+	doc, err := openapi.Load(context.Background())
+	assert.NoError(t, err)
+
+	sign := map[string]any{"name": "mock_name", "password": "mock_password"}
+	rr := validateContract(t, h, doc, newRequest("POST", "/v1/signup", sign))
+	assert.Equal(t, 201, rr.Code)
+	rr = validateContract(t, h, doc, newRequest("POST", "/v1/signup", sign))
+	assert.Equal(t, 409, rr.Code)
+
+	token := signin(t, h)
+	withToken := func(r *http.Request) *http.Request {
+		r.Header.Set("Authorization", "Bearer "+token)
+		return r
+	}
+	rr = validateContract(t, h, doc, withToken(newRequest("DELETE", "/v1/me", map[string]any{"password": "mock_password"})))
+	assert.Equal(t, 204, rr.Code)
+
+	// the token outlives the account
+	ad := map[string]any{"title": "mock_title", "content": "mock_content", "imageUrl": "http://mocksite.com/image.jpg", "price": 6969}
+	rr = validateContract(t, h, doc, withToken(newRequest("POST", "/v1/ads", ad)))
+	assert.Equal(t, 404, rr.Code)
+	r := httptest.NewRequest("POST", "/v1/ads/bulk", strings.NewReader(bulkCSV))
+	r.Header.Set("Content-Type", "text/csv")
+	rr = validateContract(t, h, doc, withToken(r))
+	assert.Equal(t, 404, rr.Code)
+	rr = validateContract(t, h, doc, withToken(httptest.NewRequest("GET", "/v1/me/export", nil)))
+	assert.Equal(t, 404, rr.Code)
+	rr = validateContract(t, h, doc, withToken(newRequest("DELETE", "/v1/me", map[string]any{"password": "mock_password"})))
+	assert.Equal(t, 404, rr.Code)
+}
+
+// newMemoryHandler serves the API on the in-memory database with the given
+// users signed up, the ids follow the order of names.
+func newMemoryHandler(t *testing.T, names ...string) http.Handler {
+	cfg := config.Default()
+	cfg.JwtSecret = strings.Repeat("s", 32)
+	h, err := NewHandler(WithDB(db.NewMemoryConnection()), WithImageChecker(contractIC{}), WithConfig(cfg))
+	assert.NoError(t, err)
+	for _, name := range names {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, newRequest("POST", "/v1/signup", map[string]any{"name": name, "password": "mock_password"}))
+		assert.Equal(t, 201, rr.Code)
+	}
+	return h
+}
+
+func signin(t *testing.T, h http.Handler) string {
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, newRequest("POST", "/v1/signin", map[string]any{"name": "mock_name", "password": "mock_password"}))
+	var token struct{ Token string }
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &token))
+	return token.Token
+}
+
+func TestContractRoutesServed(t *testing.T) {
+	h, doc := newContractHandler(t)
+	for path, item := range doc.Paths {
+		for method := range item.Operations() {
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest(method, path, nil))
+			assert.NotContains(t, []int{404, 405}, rr.Code, "%s %s is documented but not served", method, path)
+		}
+	}
+}
+
+func TestValidationMiddleware(t *testing.T) {
+	h, _ := newContractHandler(t)
+	t.Run("Wrong type", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, newRequest("POST", "/v1/signup", map[string]any{"name": 1, "password": "mock_password"}))
+		assert.Equal(t, 400, rr.Code)
+		assert.JSONEq(t, `{"code":"invalid_body","message":"request body: /name: value must be a string"}`, rr.Body.String())
+	})
+	t.Run("Content-Type is not required", func(t *testing.T) {
+		r := newRequest("POST", "/v1/signup", map[string]any{"name": "mock_name", "password": "mock_password"})
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, r)
+		assert.Equal(t, 201, rr.Code)
+	})
+	t.Run("Bulk import has its own body limit", func(t *testing.T) {
+		body := bulkCSV + strings.Repeat("mock_title,mock_content,http://mocksite.com/image.jpg,1\n", 10)
+		r := httptest.NewRequest("POST", "/v1/ads/bulk", strings.NewReader(body))
+		r.Header.Set("Content-Type", "text/csv")
+		r.Header.Set("Authorization", "Bearer "+signin(t, h))
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, r)
+		assert.Greater(t, len(body), 256)
+		assert.Equal(t, 201, rr.Code)
+	})
+	t.Run("Authorization comes first", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, newRequest("POST", "/v1/ads", map[string]any{"title": 1}))
+		assert.Equal(t, 401, rr.Code)
+	})
+}
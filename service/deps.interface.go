@@ -1,12 +1,18 @@
 package service
 
 import (
+	"context"
+	"time"
 	"vk-feed/types"
 )
 
 type dependencies interface {
-	createUser(name, password string) (types.User, error)
-	signIn(name, password string) (types.Token, error)
-	createAd(dto types.AdDto, userId int) (types.Ad, error)
-	getAds(userId int, params types.GetAdParams) ([]types.AdFeed, error)
+	createUser(ctx context.Context, name, password string) (types.User, error)
+	signIn(ctx context.Context, name, password string) (types.Token, error)
+	createAd(ctx context.Context, dto types.AdDto, userId int) (types.Ad, error)
+	createAds(ctx context.Context, dtos []types.AdDto, userId int, atomic bool) ([]types.BulkAdResult, error)
+	getAds(ctx context.Context, userId int, params types.GetAdParams) ([]types.AdFeed, error)
+	getUser(ctx context.Context, userId int) (types.User, error)
+	forEachUserAd(ctx context.Context, userId int, fn func(types.AdFeed) error) error
+	deleteUser(ctx context.Context, userId int, password string) (*time.Time, error)
 }
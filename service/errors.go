@@ -0,0 +1,121 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"vk-feed/db"
+	"vk-feed/types"
+
+	"github.com/go-playground/validator/v10"
+)
+
+var ErrWrongCreds error = errors.New("wrong credentials")
+var ErrUserNotFound error = errors.New("user not found")
+var ErrUserExists error = errors.New("user already exists")
+
+var errEmptyBody = errors.New("request body is empty")
+
+// fieldNames maps database columns to the JSON fields of the API.
+var fieldNames = map[string]string{
+	"image_url": "imageUrl",
+	"user_id":   "authorId",
+}
+
+// writeError answers with a structured body for the domain errors and the
+// database errors the service passes through, anything else is logged and
+// answered with 500.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var status int
+	apiErr := types.ApiError{Message: err.Error()}
+	var constraintErr *db.ConstraintError
+	switch {
+	case errors.Is(err, ErrUserExists):
+		status, apiErr.Code, apiErr.Field = http.StatusConflict, types.API_ERROR_CONFLICT, "name"
+	case errors.Is(err, ErrUserNotFound), errors.Is(err, db.ErrNotFound):
+		status, apiErr.Code = http.StatusNotFound, types.API_ERROR_NOT_FOUND
+	case errors.As(err, &constraintErr) && errors.Is(err, db.ErrConflict):
+		status, apiErr.Code = http.StatusConflict, types.API_ERROR_CONFLICT
+	case errors.As(err, &constraintErr) && errors.Is(err, db.ErrInvalid):
+		status, apiErr.Code = http.StatusUnprocessableEntity, types.API_ERROR_INVALID
+	default:
+		loggerFrom(r.Context()).Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if constraintErr != nil && constraintErr.Column != "" {
+		apiErr.Field = constraintErr.Column
+		if name, ok := fieldNames[apiErr.Field]; ok {
+			apiErr.Field = name
+		}
+	}
+	writeApiError(w, r, status, apiErr)
+}
+
+func writeApiError(w http.ResponseWriter, r *http.Request, status int, apiErr types.ApiError) {
+	payload, err := json.Marshal(apiErr)
+	if err != nil {
+		loggerFrom(r.Context()).Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(payload)
+}
+
+// writeBodyError answers 400 for a request body of dto that cannot be
+// decoded or does not pass validation, naming the fields as they are in JSON.
+func writeBodyError(w http.ResponseWriter, r *http.Request, dto any, err error) {
+	apiErr := types.ApiError{Code: types.API_ERROR_INVALID_BODY, Message: err.Error()}
+	var typeErr *json.UnmarshalTypeError
+	var validationErrs validator.ValidationErrors
+	switch {
+	case errors.As(err, &typeErr):
+		apiErr.Field = typeErr.Field
+		apiErr.Message = fmt.Sprintf("%s cannot be a %s", typeErr.Field, typeErr.Value)
+	case errors.As(err, &validationErrs):
+		messages := make([]string, len(validationErrs))
+		for i, fe := range validationErrs {
+			field := jsonName(dto, fe.StructField())
+			apiErr.Errors = append(apiErr.Errors, types.ApiFieldError{Field: field, Message: bodyFieldMessage(dto, fe)})
+			messages[i] = field + " " + apiErr.Errors[i].Message
+		}
+		apiErr.Field = apiErr.Errors[0].Field
+		apiErr.Message = strings.Join(messages, ", ")
+	}
+	writeApiError(w, r, http.StatusBadRequest, apiErr)
+}
+
+func bodyFieldMessage(dto any, fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "min":
+		if fe.Kind() == reflect.String {
+			return "must be at least " + fe.Param() + " characters long"
+		}
+	case "max":
+		if fe.Kind() == reflect.String {
+			return "must be at most " + fe.Param() + " characters long"
+		}
+	case "url":
+		return "must be a URL"
+	case "required_with":
+		return "must be given along with " + jsonName(dto, fe.Param())
+	}
+	return fieldErrorMessage(fe)
+}
+
+// jsonName returns the JSON name of a field of dto.
+func jsonName(dto any, field string) string {
+	f, ok := reflect.TypeOf(dto).FieldByName(field)
+	if !ok {
+		return field
+	}
+	if name, _, _ := strings.Cut(f.Tag.Get("json"), ","); name != "" {
+		return name
+	}
+	return field
+}
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"vk-feed/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteError(t *testing.T) {
+	cases := []struct {
+		name   string
+		err    error
+		status int
+		body   string
+	}{
+		{"User exists", ErrUserExists, 409, `{"code": "conflict", "message": "user already exists", "field": "name"}`},
+		{"User not found", ErrUserNotFound, 404, `{"code": "not_found", "message": "user not found"}`},
+		{"Not found", fmt.Errorf("ad: %w", db.ErrNotFound), 404, `{"code": "not_found", "message": "ad: not found"}`},
+		{
+			"Conflict",
+			&db.ConstraintError{Kind: db.ErrConflict, Table: "usrs", Column: "name"},
+			409, `{"code": "conflict", "message": "usrs.name already exists", "field": "name"}`,
+		},
+		{
+			"Invalid",
+			&db.ConstraintError{Kind: db.ErrInvalid, Table: "ads", Column: "image_url"},
+			422, `{"code": "invalid", "message": "ads.image_url violates a constraint", "field": "imageUrl"}`,
+		},
+		{"Other", errors.New("connection refused"), 500, ``},
+		{"Bare sentinel", db.ErrInvalid, 500, ``},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			writeError(rr, httptest.NewRequest("GET", "/", nil), c.err)
+			assert.Equal(t, c.status, rr.Code)
+			if c.body == "" {
+				assert.Empty(t, rr.Body.String())
+				return
+			}
+			assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+			assert.JSONEq(t, c.body, rr.Body.String())
+		})
+	}
+}
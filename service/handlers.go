@@ -1,59 +1,65 @@
 package service
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"slices"
-	"strconv"
+	"strings"
+	"vk-feed/config"
 	imgC "vk-feed/image-checker"
 	"vk-feed/types"
 
-	log "github.com/sirupsen/logrus"
-
 	"github.com/go-playground/validator/v10"
 )
 
 func newSignupHandler(d dependencies, valid *validator.Validate) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.ContentLength == 0 {
-			w.WriteHeader(http.StatusBadRequest)
+			writeBodyError(w, r, nil, errEmptyBody)
 			return
 		}
 		content, err := io.ReadAll(r.Body)
 		if err != nil {
-			log.Error(err)
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			loggerFrom(r.Context()).Error(err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 		var dto types.SignDto
 		if err := json.Unmarshal(content, &dto); err != nil {
-			if typeError, ok := err.(*json.UnmarshalTypeError); ok {
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte(typeError.Error()))
+			if _, ok := err.(*json.UnmarshalTypeError); ok {
+				writeBodyError(w, r, dto, err)
 				return
 			}
-			log.Error(err)
+			loggerFrom(r.Context()).Error(err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 		if err := valid.Struct(dto); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(err.Error()))
+			writeBodyError(w, r, dto, err)
 			return
 		}
-		user, err := d.createUser(dto.Name, dto.Password)
+		user, err := d.createUser(r.Context(), dto.Name, dto.Password)
 		if err != nil {
-			log.Error(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
 		payload, err := json.Marshal(user)
 		if err != nil {
-			log.Error(err)
+			loggerFrom(r.Context()).Error(err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
 		w.Write(payload)
 	}
@@ -62,47 +68,51 @@ func newSignupHandler(d dependencies, valid *validator.Validate) func(w http.Res
 func newSigninHandler(d dependencies, valid *validator.Validate) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.ContentLength == 0 {
-			w.WriteHeader(http.StatusBadRequest)
+			writeBodyError(w, r, nil, errEmptyBody)
 			return
 		}
 		content, err := io.ReadAll(r.Body)
 		if err != nil {
-			log.Error(err)
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			loggerFrom(r.Context()).Error(err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 		var dto types.SignDto
 		if err := json.Unmarshal(content, &dto); err != nil {
-			if typeError, ok := err.(*json.UnmarshalTypeError); ok {
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte(typeError.Error()))
+			if _, ok := err.(*json.UnmarshalTypeError); ok {
+				writeBodyError(w, r, dto, err)
 				return
 			}
-			log.Error(err)
+			loggerFrom(r.Context()).Error(err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 		if err := valid.Struct(dto); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(err.Error()))
+			writeBodyError(w, r, dto, err)
 			return
 		}
-		token, err := d.signIn(dto.Name, dto.Password)
+		token, err := d.signIn(r.Context(), dto.Name, dto.Password)
 		if err != nil {
 			if err == ErrWrongCreds {
-				w.WriteHeader(http.StatusNotFound)
+				writeApiError(w, r, http.StatusNotFound, types.ApiError{Code: types.API_ERROR_WRONG_CREDENTIALS, Message: err.Error()})
 				return
 			}
-			log.Error(err)
+			loggerFrom(r.Context()).Error(err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 		payload, err := json.Marshal(token)
 		if err != nil {
-			log.Error(err)
+			loggerFrom(r.Context()).Error(err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
 		w.Write(payload)
 	}
@@ -111,135 +121,133 @@ func newSigninHandler(d dependencies, valid *validator.Validate) func(w http.Res
 func newCreateAdHandler(d dependencies, valid *validator.Validate) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.ContentLength == 0 {
-			log.Error("Content-Length is 0")
-			w.WriteHeader(http.StatusBadRequest)
+			writeBodyError(w, r, nil, errEmptyBody)
 			return
 		}
 		content, err := io.ReadAll(r.Body)
 		if err != nil {
-			log.Error(err)
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			loggerFrom(r.Context()).Error(err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 		var dto types.AdDto
 		if err := json.Unmarshal(content, &dto); err != nil {
-			if typeError, ok := err.(*json.UnmarshalTypeError); ok {
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte(typeError.Error()))
+			if _, ok := err.(*json.UnmarshalTypeError); ok {
+				writeBodyError(w, r, dto, err)
 				return
 			}
-			log.Error(err)
+			loggerFrom(r.Context()).Error(err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 		if err := valid.Struct(dto); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(err.Error()))
+			writeBodyError(w, r, dto, err)
 			return
 		}
-		userIdString := r.Header.Get("userid")
-		if userIdString == "" {
-			log.Error("UserId is not provided, yet fell into handler")
+		userId, ok := userIdFrom(r.Context())
+		if !ok {
+			loggerFrom(r.Context()).Error("user is not authenticated, yet fell into handler")
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		userId, err := strconv.Atoi(userIdString)
-		if err != nil {
-			log.Error("userId is not of type int, yet fell into handler")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		ad, err := d.createAd(dto, userId)
+		ad, err := d.createAd(r.Context(), dto, userId)
 		if err != nil {
 			if slices.Contains([]error{imgC.ErrNotImage, imgC.ErrUrlUnavailable, imgC.ErrImageTooBig}, err) {
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte(err.Error()))
+				writeApiError(w, r, http.StatusBadRequest, types.ApiError{Code: types.API_ERROR_INVALID_BODY, Message: err.Error(), Field: "imageUrl"})
 				return
 			}
-			log.Error(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
 		payload, err := json.Marshal(ad)
 		if err != nil {
-			log.Error(err)
+			loggerFrom(r.Context()).Error(err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
 		w.Write(payload)
 	}
 }
 
-func newGetAdsHanlder(d dependencies, _ *validator.Validate) func(w http.ResponseWriter, r *http.Request) {
+func newGetAdsHanlder(d dependencies, valid *validator.Validate, fc config.Feed, version apiVersion) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		userId, _ := userIdFrom(r.Context())
+		w.Header().Set("Vary", "Authorization, Prefer")
 		var params types.GetAdParams
-		q := r.URL.Query()
-		if sortByStr := q.Get("sort_by"); sortByStr != string(types.SORT_BY_PRICE) {
-			params.SortBy = types.SORT_BY_DATE
-		} else {
-			params.SortBy = types.SORT_BY_PRICE
-		}
-		if orderByStr := q.Get("order_by"); orderByStr != string(types.ORDER_BY_DESC) {
-			params.OrderBy = types.ORDER_BY_ASC
-		} else {
-			params.OrderBy = types.ORDER_BY_DESC
-		}
-		maxPriceStr := q.Get("max_price")
-		if maxPrice, err := strconv.Atoi(maxPriceStr); err != nil {
-			params.MaxPrice = 1e6
-		} else {
-			if maxPrice < 1 {
-				maxPrice = 1
-			} else if maxPrice > 1e6 {
-				maxPrice = 1e6
-			}
-			params.MaxPrice = maxPrice
-		}
-		minPriceStr := q.Get("min_price")
-		if minPrice, err := strconv.Atoi(minPriceStr); err != nil {
-			params.MinPrice = 1
-		} else {
-			if minPrice < 1 {
-				minPrice = 1
-			} else if minPrice > 1e6 {
-				minPrice = 1e6
-			}
-			params.MinPrice = minPrice
-		}
-		pageStr := r.URL.Query().Get("page")
-		if page, err := strconv.Atoi(pageStr); err != nil {
-			params.Page = 0
-		} else {
-			if page < 0 {
-				page = 0
-			}
-			params.Page = page
-		}
-		userIdStr := r.Header.Get("userid")
-		var userId int
-		if userIdStr != "" {
-			var err error
-			userId, err = strconv.Atoi(userIdStr)
-			if err != nil {
-				log.Error("userid is not int, yet fell into handler")
-				w.WriteHeader(http.StatusInternalServerError)
+		if strictParams(r, fc) {
+			var errs []types.ApiFieldError
+			params, errs = parseStrictParams(r.URL.Query(), fc, valid, userId != 0)
+			w.Header().Set("Preference-Applied", "handling=strict")
+			if len(errs) > 0 {
+				writeApiError(w, r, http.StatusBadRequest, types.ApiError{
+					Code:    types.API_ERROR_INVALID_PARAMS,
+					Message: "invalid query parameters",
+					Errors:  errs,
+				})
 				return
 			}
+		} else {
+			params = parseLenientParams(r.URL.Query(), fc, userId != 0)
 		}
-		feed, err := d.getAds(userId, params)
+		// the parameters the page was actually built with
+		w.Header().Set("Content-Location", r.URL.Path+"?"+encodeParams(params))
+		feed, err := d.getAds(r.Context(), userId, params)
 		if err != nil {
-			log.Error(err)
+			loggerFrom(r.Context()).Error(err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		payload, err := json.Marshal(feed)
+		var out any = feed
+		if version >= apiV2 {
+			feedV2 := make([]types.AdFeedV2, len(feed))
+			for i, ad := range feed {
+				feedV2[i] = ad.V2()
+			}
+			out = feedV2
+		}
+		payload, err := json.Marshal(out)
 		if err != nil {
-			log.Error(err)
+			loggerFrom(r.Context()).Error(err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		etag := etagOf(payload)
+		w.Header().Set("ETag", etag)
+		if userId == 0 && fc.CacheTTL > 0 {
+			w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(fc.CacheTTL.Seconds())))
+		} else {
+			w.Header().Set("Cache-Control", "private, no-cache")
+		}
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		w.Write(payload)
 	}
 }
+
+// etagOf returns a strong ETag, the same for byte-identical payloads.
+func etagOf(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches implements the weak comparison If-None-Match calls for.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -2,29 +2,34 @@ package service
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"slices"
 	"strings"
 	"testing"
 	"time"
+	"vk-feed/config"
 	imgC "vk-feed/image-checker"
 	"vk-feed/types"
 
 	"github.com/go-playground/validator/v10"
-	"github.com/jackc/pgx/v4"
 	"github.com/stretchr/testify/assert"
 )
 
 type mockDeps struct{}
 
-func (m mockDeps) createUser(name, password string) (types.User, error) {
+func (m mockDeps) createUser(ctx context.Context, name, password string) (types.User, error) {
+	if name == "existing_name" {
+		return types.User{}, ErrUserExists
+	}
 	return types.User{Id: 1, Name: name}, nil
 }
 
-func (m mockDeps) signIn(name, password string) (types.Token, error) {
+func (m mockDeps) signIn(ctx context.Context, name, password string) (types.Token, error) {
 	if name == "mock_name" && password == "mock_password" {
 		return types.Token{Token: "mock_token"}, nil
 	} else {
@@ -32,11 +37,11 @@ func (m mockDeps) signIn(name, password string) (types.Token, error) {
 	}
 }
 
-func (m mockDeps) createAd(dto types.AdDto, userId int) (types.Ad, error) {
+func (m mockDeps) createAd(ctx context.Context, dto types.AdDto, userId int) (types.Ad, error) {
 	if dto.ImageUrl != "http://mocksite.com/image.jpg" {
 		return types.Ad{}, imgC.ErrUrlUnavailable
 	} else if userId == 0 {
-		return types.Ad{}, pgx.ErrNoRows
+		return types.Ad{}, ErrUserNotFound
 	} else {
 		return types.Ad{
 			Id:       1,
@@ -48,9 +53,28 @@ func (m mockDeps) createAd(dto types.AdDto, userId int) (types.Ad, error) {
 	}
 }
 
+func (m mockDeps) createAds(ctx context.Context, dtos []types.AdDto, userId int, atomic bool) ([]types.BulkAdResult, error) {
+	results := make([]types.BulkAdResult, len(dtos))
+	for i, dto := range dtos {
+		if dto.ImageUrl != "http://mocksite.com/image.jpg" {
+			results[i] = types.BulkAdResult{Status: types.BULK_AD_INVALID, Error: imgC.ErrUrlUnavailable.Error()}
+			continue
+		}
+		results[i] = types.BulkAdResult{Status: types.BULK_AD_CREATED, Id: i + 1}
+	}
+	if atomic {
+		for i := range results {
+			if results[i].Status == types.BULK_AD_CREATED && slices.ContainsFunc(results, func(r types.BulkAdResult) bool { return r.Status != types.BULK_AD_CREATED }) {
+				results[i] = types.BulkAdResult{Status: types.BULK_AD_SKIPPED}
+			}
+		}
+	}
+	return results, nil
+}
+
 var outParams types.GetAdParams
 
-func (m mockDeps) getAds(userId int, params types.GetAdParams) ([]types.AdFeed, error) {
+func (m mockDeps) getAds(ctx context.Context, userId int, params types.GetAdParams) ([]types.AdFeed, error) {
 	outParams = params
 	return []types.AdFeed{
 		{
@@ -59,13 +83,40 @@ func (m mockDeps) getAds(userId int, params types.GetAdParams) ([]types.AdFeed,
 			Content:   "mock_content",
 			ImageUrl:  "http://mocksite.com/image.jpg",
 			Price:     6969,
-			CreatedAt: time.Now(),
+			CreatedAt: time.Date(2024, 6, 9, 0, 0, 0, 0, time.UTC),
 			AuthorId:  1,
 			IsYours:   false,
 		},
 	}, nil
 }
 
+func (m mockDeps) getUser(ctx context.Context, userId int) (types.User, error) {
+	if userId != 1 {
+		return types.User{}, ErrUserNotFound
+	}
+	return types.User{Id: 1, Name: "mock_name"}, nil
+}
+
+func (m mockDeps) forEachUserAd(ctx context.Context, userId int, fn func(types.AdFeed) error) error {
+	ads, _ := m.getAds(ctx, userId, types.GetAdParams{})
+	for _, ad := range ads {
+		if err := fn(ad); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m mockDeps) deleteUser(ctx context.Context, userId int, password string) (*time.Time, error) {
+	if password != "mock_password" {
+		return nil, ErrWrongCreds
+	}
+	if userId != 1 {
+		return nil, ErrUserNotFound
+	}
+	return nil, nil
+}
+
 var m mockDeps
 var valid *validator.Validate = validator.New()
 
@@ -76,6 +127,11 @@ func newRequest(method, path string, body any) *http.Request {
 	return httptest.NewRequest(method, path, &b)
 }
 
+// signedIn marks req as made by userId, as authMiddleware does.
+func signedIn(req *http.Request, userId int) *http.Request {
+	return req.WithContext(withUserId(req.Context(), userId))
+}
+
 func TestNewSignupHandler(t *testing.T) {
 	t.Run("OK", func(t *testing.T) {
 		req := newRequest("POST", "/signup", types.SignDto{Name: "mock_name", Password: "mock_password"})
@@ -91,6 +147,7 @@ func TestNewSignupHandler(t *testing.T) {
 		rr := httptest.NewRecorder()
 		newSignupHandler(m, valid)(rr, req)
 		assert.Equal(t, 400, rr.Code)
+		assert.JSONEq(t, `{"code":"invalid_body","message":"request body is empty"}`, rr.Body.String())
 	})
 	t.Run("No name provided", func(t *testing.T) {
 		req := newRequest("POST", "/signup", types.SignDto{Name: "mock_name"})
@@ -115,6 +172,14 @@ func TestNewSignupHandler(t *testing.T) {
 		rr := httptest.NewRecorder()
 		newSignupHandler(m, valid)(rr, req)
 		assert.Equal(t, 400, rr.Code)
+		var apiErr types.ApiError
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &apiErr))
+		assert.Equal(t, types.ApiError{
+			Code:    types.API_ERROR_INVALID_BODY,
+			Message: "name must be at least 8 characters long",
+			Field:   "name",
+			Errors:  []types.ApiFieldError{{Field: "name", Message: "must be at least 8 characters long"}},
+		}, apiErr)
 	})
 	t.Run("password too short", func(t *testing.T) {
 		req := newRequest("POST", "/signup", types.SignDto{Name: "mock_name", Password: "a"})
@@ -136,6 +201,14 @@ func TestNewSignupHandler(t *testing.T) {
 		rr := httptest.NewRecorder()
 		newSignupHandler(m, valid)(rr, req)
 		assert.Equal(t, 400, rr.Code)
+		assert.JSONEq(t, `{"code":"invalid_body","message":"name cannot be a number","field":"name"}`, rr.Body.String())
+	})
+	t.Run("name taken", func(t *testing.T) {
+		req := newRequest("POST", "/signup", types.SignDto{Name: "existing_name", Password: "mock_password"})
+		rr := httptest.NewRecorder()
+		newSignupHandler(m, valid)(rr, req)
+		assert.Equal(t, 409, rr.Code)
+		assert.JSONEq(t, `{"code": "conflict", "message": "user already exists", "field": "name"}`, rr.Body.String())
 	})
 }
 
@@ -204,6 +277,7 @@ func TestNewSigninHandler(t *testing.T) {
 		rr := httptest.NewRecorder()
 		newSigninHandler(m, valid)(rr, req)
 		assert.Equal(t, 404, rr.Code)
+		assert.JSONEq(t, `{"code":"wrong_credentials","message":"wrong credentials"}`, rr.Body.String())
 	})
 	t.Run("wrong password", func(t *testing.T) {
 		req := newRequest("POST", "/signin", types.SignDto{Name: "mock_name", Password: "wrong_password"})
@@ -223,7 +297,7 @@ func TestNewCreateAdHandler(t *testing.T) {
 			Price:    6969,
 		}
 		req := newRequest("POST", "/ads", dto)
-		req.Header.Add("userid", "1")
+		req = signedIn(req, 1)
 		rr := httptest.NewRecorder()
 		newCreateAdHandler(m, valid)(rr, req)
 		ad := types.Ad{
@@ -240,7 +314,7 @@ func TestNewCreateAdHandler(t *testing.T) {
 	})
 	t.Run("No body provided", func(t *testing.T) {
 		req := httptest.NewRequest("POST", "/ads", nil)
-		req.Header.Add("userid", "1")
+		req = signedIn(req, 1)
 		rr := httptest.NewRecorder()
 		newCreateAdHandler(m, valid)(rr, req)
 		assert.Equal(t, 400, rr.Code)
@@ -253,10 +327,19 @@ func TestNewCreateAdHandler(t *testing.T) {
 			ImageUrl int    `json:"imageUrl"`
 			Price    string `json:"price"`
 		}{"1", 1, 1, 1, "1"})
-		req.Header.Add("userid", "1")
+		req = signedIn(req, 1)
+		rr := httptest.NewRecorder()
+		newCreateAdHandler(m, valid)(rr, req)
+		assert.Equal(t, 400, rr.Code)
+	})
+	t.Run("Latitude without longitude", func(t *testing.T) {
+		lat := 55.7558
+		req := newRequest("POST", "/ads", types.AdDto{Title: "mock_title", Content: "mock_content", ImageUrl: mockImageUrl, Price: 1, Latitude: &lat})
+		req = signedIn(req, 1)
 		rr := httptest.NewRecorder()
 		newCreateAdHandler(m, valid)(rr, req)
 		assert.Equal(t, 400, rr.Code)
+		assert.JSONEq(t, `{"code":"invalid_body","message":"longitude must be given along with latitude","field":"longitude","errors":[{"field":"longitude","message":"must be given along with latitude"}]}`, rr.Body.String())
 	})
 	t.Run("Partial DTO provided", func(t *testing.T) {
 		cases := []struct {
@@ -299,7 +382,7 @@ func TestNewCreateAdHandler(t *testing.T) {
 		for _, c := range cases {
 			t.Run(c.name, func(t *testing.T) {
 				req := newRequest("POST", "/ads", c.in)
-				req.Header.Add("userid", "1")
+				req = signedIn(req, 1)
 				rr := httptest.NewRecorder()
 				newCreateAdHandler(m, valid)(rr, req)
 				assert.Equal(t, 400, rr.Code, c.name)
@@ -307,6 +390,7 @@ func TestNewCreateAdHandler(t *testing.T) {
 		}
 	})
 	t.Run("validation test", func(t *testing.T) {
+		lat, farLon := 55.7558, 181.0
 		cases := []struct {
 			name string
 			in   types.AdDto
@@ -374,11 +458,42 @@ func TestNewCreateAdHandler(t *testing.T) {
 					Price:    1e7,
 				},
 			},
+			{
+				name: "latitude without longitude",
+				in: types.AdDto{
+					Title:    "mock_title",
+					Content:  "mock_content",
+					ImageUrl: mockImageUrl,
+					Price:    6969,
+					Latitude: &lat,
+				},
+			},
+			{
+				name: "longitude out of range",
+				in: types.AdDto{
+					Title:     "mock_title",
+					Content:   "mock_content",
+					ImageUrl:  mockImageUrl,
+					Price:     6969,
+					Latitude:  &lat,
+					Longitude: &farLon,
+				},
+			},
+			{
+				name: "city too long",
+				in: types.AdDto{
+					Title:    "mock_title",
+					Content:  "mock_content",
+					ImageUrl: mockImageUrl,
+					Price:    6969,
+					City:     strings.Repeat("a", 101),
+				},
+			},
 		}
 		for _, c := range cases {
 			t.Run(c.name, func(t *testing.T) {
 				req := newRequest("POST", "/ads", c.in)
-				req.Header.Add("userid", "1")
+				req = signedIn(req, 1)
 				rr := httptest.NewRecorder()
 				newCreateAdHandler(m, valid)(rr, req)
 				assert.Equal(t, 400, rr.Code, c.name)
@@ -392,10 +507,11 @@ func TestNewGetAdsHandler(t *testing.T) {
 		var m mockDeps
 		req := httptest.NewRequest("GET", "/ads", nil)
 		rr := httptest.NewRecorder()
-		newGetAdsHanlder(m, valid)(rr, req)
+		newGetAdsHanlder(m, valid, config.Default().Feed, apiV1)(rr, req)
 		assert.Equal(t, 200, rr.Code)
 		defaultParams := types.GetAdParams{
 			Page:     0,
+			PageSize: 10,
 			MinPrice: 1,
 			MaxPrice: 1e6,
 			SortBy:   types.SORT_BY_DATE,
@@ -426,6 +542,7 @@ func TestNewGetAdsHandler(t *testing.T) {
 			},
 			out: types.GetAdParams{
 				Page:     1,
+				PageSize: 10,
 				MinPrice: 100,
 				MaxPrice: 10000,
 				SortBy:   types.SORT_BY_PRICE,
@@ -443,6 +560,7 @@ func TestNewGetAdsHandler(t *testing.T) {
 			},
 			out: types.GetAdParams{
 				Page:     0,
+				PageSize: 10,
 				MinPrice: 1,
 				MaxPrice: 1e6,
 				SortBy:   types.SORT_BY_DATE,
@@ -460,6 +578,7 @@ func TestNewGetAdsHandler(t *testing.T) {
 			},
 			out: types.GetAdParams{
 				Page:     0,
+				PageSize: 10,
 				MinPrice: 1,
 				MaxPrice: 1e6,
 				SortBy:   types.SORT_BY_DATE,
@@ -484,9 +603,94 @@ func TestNewGetAdsHandler(t *testing.T) {
 			urlStr := fmt.Sprint(u)
 			req := httptest.NewRequest("GET", urlStr, nil)
 			rr := httptest.NewRecorder()
-			newGetAdsHanlder(m, valid)(rr, req)
+			newGetAdsHanlder(m, valid, config.Default().Feed, apiV1)(rr, req)
 			assert.Equal(t, 200, rr.Code)
 			assert.Equal(t, c.out, outParams)
 		})
 	}
+	t.Run("conditional", func(t *testing.T) {
+		var m mockDeps
+		get := func(userId int, ifNoneMatch string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", "/ads", nil)
+			if userId != 0 {
+				req = signedIn(req, userId)
+			}
+			if ifNoneMatch != "" {
+				req.Header.Set("If-None-Match", ifNoneMatch)
+			}
+			rr := httptest.NewRecorder()
+			newGetAdsHanlder(m, valid, config.Default().Feed, apiV1)(rr, req)
+			return rr
+		}
+		rr := get(0, "")
+		assert.Equal(t, 200, rr.Code)
+		etag := rr.Header().Get("ETag")
+		assert.Regexp(t, `^"[0-9a-f]{32}"$`, etag)
+		assert.Equal(t, "public, max-age=5", rr.Header().Get("Cache-Control"))
+		assert.Equal(t, "Authorization, Prefer", rr.Header().Get("Vary"))
+		assert.Equal(t, etag, get(0, "").Header().Get("ETag"), "the same page has the same tag")
+
+		for _, ifNoneMatch := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+			rr := get(0, ifNoneMatch)
+			assert.Equal(t, 304, rr.Code, ifNoneMatch)
+			assert.Empty(t, rr.Body.Bytes())
+			assert.Equal(t, etag, rr.Header().Get("ETag"))
+		}
+		assert.Equal(t, 200, get(0, `"other"`).Code)
+
+		rr = get(1, "")
+		assert.Equal(t, 200, rr.Code)
+		assert.Equal(t, "private, no-cache", rr.Header().Get("Cache-Control"))
+		assert.Equal(t, 304, get(1, rr.Header().Get("ETag")).Code)
+	})
+	t.Run("strict", func(t *testing.T) {
+		var m mockDeps
+		get := func(query, prefer string, fc config.Feed) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", "/v1/ads?"+query, nil)
+			if prefer != "" {
+				req.Header.Set("Prefer", prefer)
+			}
+			rr := httptest.NewRecorder()
+			newGetAdsHanlder(m, valid, fc, apiV1)(rr, req)
+			return rr
+		}
+		fc := config.Default().Feed
+		rr := get("sort_by=foo&min_price=abc", "", fc)
+		assert.Equal(t, 200, rr.Code, "lenient by default")
+		assert.Equal(t, "/v1/ads?max_price=1000000&min_price=1&order_by=asc&page=0&sort_by=created_at", rr.Header().Get("Content-Location"))
+		assert.Empty(t, rr.Header().Get("Preference-Applied"))
+
+		rr = get("sort_by=foo&min_price=abc", "handling=strict", fc)
+		assert.Equal(t, 400, rr.Code)
+		assert.Equal(t, "handling=strict", rr.Header().Get("Preference-Applied"))
+		var apiErr types.ApiError
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &apiErr))
+		assert.Equal(t, types.API_ERROR_INVALID_PARAMS, apiErr.Code)
+		assert.Equal(t, []types.ApiFieldError{
+			{Field: "min_price", Message: "must be an integer"},
+			{Field: "sort_by", Message: `unknown sort key "foo", must be one of created_at, price, id, distance`},
+		}, apiErr.Errors)
+
+		fc.StrictParams = true
+		assert.Equal(t, 400, get("page=-1", "", fc).Code, "strict by config")
+		assert.Equal(t, 200, get("page=-1", "handling=lenient", fc).Code)
+		rr = get("page=3&sort_by=price", "", fc)
+		assert.Equal(t, 200, rr.Code)
+		assert.Equal(t, "/v1/ads?max_price=1000000&min_price=1&order_by=asc&page=3&sort_by=price", rr.Header().Get("Content-Location"))
+		assert.Equal(t, types.GetAdParams{Page: 3, PageSize: 10, MinPrice: 1, MaxPrice: 1e6, SortBy: types.SORT_BY_PRICE, OrderBy: types.ORDER_BY_ASC}, outParams)
+	})
+	t.Run("own ads", func(t *testing.T) {
+		var m mockDeps
+		for _, userId := range []int{0, 1} {
+			req := httptest.NewRequest("GET", "/v1/ads?only_mine=true&author_id=2", nil)
+			if userId != 0 {
+				req = signedIn(req, userId)
+			}
+			rr := httptest.NewRecorder()
+			newGetAdsHanlder(m, valid, config.Default().Feed, apiV1)(rr, req)
+			assert.Equal(t, 200, rr.Code)
+			assert.Equal(t, userId != 0, outParams.OnlyMine, "only for signed in users")
+			assert.Equal(t, 2, outParams.AuthorId)
+		}
+	})
 }
@@ -1,46 +1,186 @@
 package service
 
 import (
+	"context"
+	"errors"
 	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+	"vk-feed/config"
 	"vk-feed/db"
 	imgC "vk-feed/image-checker"
+	"vk-feed/openapi"
 
 	"github.com/go-playground/validator/v10"
+	log "github.com/sirupsen/logrus"
 )
 
+var ErrNoDB error = errors.New("database connection is not provided")
+
 type deps struct {
-	client    db.DBConnection
-	jwtSecret []byte
-	ic        imgC.ImageChecker
+	client       db.DBConnection
+	jwtSecret    []byte
+	tokenTTL     time.Duration
+	ic           imgC.ImageChecker
+	imageTimeout time.Duration
+	// number of images checked at the same time by bulk imports
+	bulkParallelism int
+	deletionGrace   time.Duration
+	feed            *feedCache
+}
+
+type options struct {
+	conn   db.DBConnection
+	ic     imgC.ImageChecker
+	cfg    config.Config
+	logger *log.Logger
+}
+
+type Option func(o *options)
+
+func WithDB(conn db.DBConnection) Option {
+	return func(o *options) { o.conn = conn }
+}
+
+func WithImageChecker(ic imgC.ImageChecker) Option {
+	return func(o *options) { o.ic = ic }
 }
 
-func Register(conn db.DBConnection, jwtSecret []byte) {
+func WithConfig(cfg config.Config) Option {
+	return func(o *options) { o.cfg = cfg }
+}
+
+func WithLogger(logger *log.Logger) Option {
+	return func(o *options) { o.logger = logger }
+}
+
+// NewHandler builds the API. Config defaults to config.Default, the image
+// checker to imgC.IC and the logger to the logrus standard logger; the
+// database connection is mandatory.
+func NewHandler(opts ...Option) (http.Handler, error) {
+	o := options{cfg: config.Default(), logger: log.StandardLogger()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.conn == nil {
+		return nil, ErrNoDB
+	}
+	if o.ic == nil {
+		o.ic = imgC.IC{MaxSize: o.cfg.Image.MaxSize}
+	}
+	cfg := o.cfg
+	trustedProxies, err := parseTrustedProxies(strings.Join(cfg.Http.TrustedProxies, ","))
+	if err != nil {
+		return nil, err
+	}
+	// replicas may lag behind a write for as long as its author reads from
+	// the primary
+	var feedSettle time.Duration
+	if len(cfg.Db.ReplicaUrls) > 0 {
+		feedSettle = cfg.Db.ReadYourWritesWindow
+	}
 	d := deps{
-		client:    conn,
-		jwtSecret: jwtSecret,
-		ic:        imgC.IC{},
+		client:          o.conn,
+		jwtSecret:       []byte(cfg.JwtSecret),
+		tokenTTL:        cfg.TokenTTL,
+		ic:              o.ic,
+		imageTimeout:    cfg.Image.Timeout,
+		bulkParallelism: cfg.Bulk.Parallelism,
+		deletionGrace:   cfg.Account.DeletionGracePeriod,
+		feed:            newFeedCache(cfg.Feed.CacheTTL, cfg.Feed.CacheSize, feedSettle),
 	}
 	valid := validator.New()
-	http.HandleFunc("POST /signup",
-		loggerMiddleware(
-			newSignupHandler(d, valid),
-		))
-
-	http.HandleFunc("POST /signin",
-		loggerMiddleware(
-			newSigninHandler(d, valid),
-		))
-
-	http.HandleFunc("POST /ads",
-		loggerMiddleware(
-			authMiddleware(d,
-				newCreateAdHandler(d, valid),
-				false)),
-	)
-	http.HandleFunc("GET /ads",
-		loggerMiddleware(
-			authMiddleware(d,
-				newGetAdsHanlder(d, valid),
-				true)),
-	)
+	lc := loggerConfig{
+		logger:         o.logger,
+		maxBodyLog:     cfg.Http.MaxBodyLog,
+		redactFields:   cfg.Http.RedactFields,
+		trustedProxies: trustedProxies,
+	}
+	// routes taking larger bodies than cfg.Http.MaxBodySize
+	bodyLimits := map[string]int64{"/ads/bulk": cfg.Bulk.MaxBodySize}
+	common := func(route, path string, logBody bool) []middleware {
+		limit, ok := bodyLimits[path]
+		if !ok {
+			limit = cfg.Http.MaxBodySize
+		}
+		return []middleware{
+			metricsMiddleware(route),
+			tracingMiddleware(route),
+			bodyLimitMiddleware(limit),
+			loggerMiddleware(lc, logBody),
+		}
+	}
+
+	var sunset time.Time
+	if cfg.Http.LegacySunset != "" {
+		sunset, err = time.Parse(time.DateOnly, cfg.Http.LegacySunset)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	doc, err := openapi.Load(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /openapi.yaml", newSpecHandler(openapi.Spec))
+	var routeErr error
+	for _, version := range []apiVersion{apiLegacy, apiV1, apiV2} {
+		handle := func(method, path string, h http.HandlerFunc, logBody bool, mws ...middleware) {
+			pattern := method + " " + version.prefix() + path
+			all := common(pattern, path, logBody)
+			if version == apiLegacy {
+				all = append(all, deprecationMiddleware(sunset, apiV1.prefix()+path))
+			}
+			// the body is validated after authorization so that
+			// unauthorized requests keep getting 401
+			validate, err := validationMiddleware(doc, method, version.prefix()+path)
+			if err != nil {
+				routeErr = errors.Join(routeErr, err)
+				return
+			}
+			all = append(append(all, mws...), validate)
+			mux.HandleFunc(pattern, chain(h, all...))
+		}
+		handle("POST", "/signup", newSignupHandler(d, valid), true)
+		handle("POST", "/signin", newSigninHandler(d, valid), true)
+		handle("POST", "/ads", newCreateAdHandler(d, valid), true, authMiddleware(d, false))
+		handle("POST", "/ads/bulk", newCreateAdsBulkHandler(d, valid, cfg.Bulk), false, authMiddleware(d, false))
+		handle("GET", "/ads", newGetAdsHanlder(d, valid, cfg.Feed, version), false, authMiddleware(d, true))
+		handle("GET", "/me/export", newExportHandler(d), false, authMiddleware(d, false))
+		handle("DELETE", "/me", newDeleteMeHandler(d, valid), true, authMiddleware(d, false))
+	}
+	if routeErr != nil {
+		return nil, routeErr
+	}
+	return mux, nil
+}
+
+// parseTrustedProxies parses a comma separated list of IP addresses and CIDR
+// ranges of the reverse proxies whose forwarding headers can be trusted.
+func parseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if strings.Contains(part, "/") {
+			prefix, err := netip.ParsePrefix(part)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(part)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return out, nil
 }
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"vk-feed/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewHandler(t *testing.T) {
+	t.Run("No DB provided", func(t *testing.T) {
+		_, err := NewHandler()
+		assert.Equal(t, ErrNoDB, err)
+	})
+	t.Run("Bad config", func(t *testing.T) {
+		cfg := config.Default()
+		cfg.Http.TrustedProxies = []string{"monke"}
+		_, err := NewHandler(WithDB(mockDBConnection{}), WithConfig(cfg))
+		assert.Error(t, err)
+	})
+	t.Run("Independent instances", func(t *testing.T) {
+		first, err := NewHandler(WithDB(mockDBConnection{}), WithImageChecker(mockIC{}))
+		assert.NoError(t, err)
+		second, err := NewHandler(WithDB(mockDBConnection{}), WithImageChecker(mockIC{}))
+		assert.NoError(t, err)
+		for _, h := range []http.Handler{first, second} {
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest("GET", "/ads", nil))
+			assert.Equal(t, 200, rr.Code)
+		}
+	})
+	t.Run("Mounted under prefix", func(t *testing.T) {
+		h, err := NewHandler(WithDB(mockDBConnection{}), WithImageChecker(mockIC{}))
+		assert.NoError(t, err)
+		mux := http.NewServeMux()
+		mux.Handle("/api/", http.StripPrefix("/api", h))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/ads", nil))
+		assert.Equal(t, 200, rr.Code)
+		rr = httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/ads", nil))
+		assert.Equal(t, 401, rr.Code)
+	})
+}
+
+func TestVersions(t *testing.T) {
+	h, err := NewHandler(WithDB(mockDBConnection{}), WithImageChecker(mockIC{}))
+	assert.NoError(t, err)
+	t.Run("Legacy routes are deprecated", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", "/ads", nil))
+		assert.Equal(t, 200, rr.Code)
+		assert.Equal(t, "@1792368000", rr.Header().Get("Deprecation"))
+		assert.Equal(t, "Wed, 30 Jun 2027 00:00:00 GMT", rr.Header().Get("Sunset"))
+		assert.Equal(t, `</v1/ads>; rel="successor-version"`, rr.Header().Get("Link"))
+	})
+	t.Run("v1 is not deprecated", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/ads", nil))
+		assert.Equal(t, 200, rr.Code)
+		assert.Empty(t, rr.Header().Get("Deprecation"))
+		var feed []map[string]any
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &feed))
+		assert.Contains(t, feed[0], "iamgeUrl")
+	})
+	t.Run("v2 uses corrected field names", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", "/v2/ads", nil))
+		assert.Equal(t, 200, rr.Code)
+		var feed []map[string]any
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &feed))
+		assert.Contains(t, feed[0], "imageUrl")
+		assert.NotContains(t, feed[0], "iamgeUrl")
+	})
+	t.Run("All routes are versioned", func(t *testing.T) {
+		for _, prefix := range []string{"", "/v1", "/v2"} {
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest("POST", prefix+"/signup", nil))
+			assert.Equal(t, 400, rr.Code, prefix)
+		}
+	})
+}
@@ -2,99 +2,355 @@ package service
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
+	"vk-feed/metrics"
+	"vk-feed/tracing"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/golang-jwt/jwt/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func authMiddleware(d deps, next func(w http.ResponseWriter, r *http.Request), isOpt bool) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			if isOpt {
-				next(w, r)
+// middleware wraps a handler with cross-cutting behavior.
+type middleware func(next http.HandlerFunc) http.HandlerFunc
+
+// chain applies middlewares to h so that the first one is the outermost.
+func chain(h http.HandlerFunc, mws ...middleware) http.HandlerFunc {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+func authMiddleware(d deps, isOpt bool) middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			authHeader := r.Header.Get("Authorization")
+			if authHeader == "" {
+				if isOpt {
+					next(w, r)
+					return
+				}
+				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-		authParts := strings.Split(authHeader, " ")
-		if len(authParts) != 2 {
-			if isOpt {
-				next(w, r)
+			authParts := strings.Split(authHeader, " ")
+			if len(authParts) != 2 {
+				if isOpt {
+					next(w, r)
+					return
+				}
+				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-		if authParts[0] != "Bearer" {
-			if isOpt {
-				next(w, r)
+			if authParts[0] != "Bearer" {
+				if isOpt {
+					next(w, r)
+					return
+				}
+				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-		token, err := jwt.Parse(authParts[1], func(t *jwt.Token) (interface{}, error) {
-			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+			token, err := jwt.Parse(authParts[1], func(t *jwt.Token) (interface{}, error) {
+				if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+					return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+				}
+				return []byte(d.jwtSecret), nil
+			}, jwt.WithExpirationRequired())
+			if err != nil {
+				loggerFrom(r.Context()).Error(err)
+				if isOpt {
+					next(w, r)
+					return
+				}
+				w.WriteHeader(http.StatusUnauthorized)
+				return
 			}
-			return []byte(d.jwtSecret), nil
-		}, jwt.WithExpirationRequired())
-		if err != nil {
-			log.Error(err)
-			if isOpt {
-				next(w, r)
+
+			claims, ok := token.Claims.(jwt.MapClaims)
+			if !ok {
+				if isOpt {
+					next(w, r)
+					return
+				}
+				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
-			w.WriteHeader(http.StatusUnauthorized)
-			return
+			userId, ok := subject(claims)
+			if !ok {
+				if isOpt {
+					next(w, r)
+					return
+				}
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			expiresAt := int64(claims["exp"].(float64))
+			if expiresAt < time.Now().UTC().Unix() {
+				if isOpt {
+					next(w, r)
+					return
+				}
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if logged, ok := r.Context().Value(loggedUserKey{}).(*int); ok {
+				*logged = userId
+			}
+			next(w, r.WithContext(withUserId(r.Context(), userId)))
 		}
+	}
+}
 
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			if isOpt {
-				next(w, r)
-				return
+// subject reads the user id from the sub claim, which is a number in the
+// tokens issued by signin.
+func subject(claims jwt.MapClaims) (int, bool) {
+	switch sub := claims["sub"].(type) {
+	case float64:
+		return int(sub), sub == float64(int(sub)) && sub > 0
+	case string:
+		id, err := strconv.Atoi(sub)
+		return id, err == nil && id > 0
+	}
+	return 0, false
+}
+
+type userIdKey struct{}
+
+func withUserId(ctx context.Context, userId int) context.Context {
+	return context.WithValue(ctx, userIdKey{}, userId)
+}
+
+// userIdFrom returns the id of the user authenticated by authMiddleware.
+func userIdFrom(ctx context.Context) (int, bool) {
+	userId, ok := ctx.Value(userIdKey{}).(int)
+	return userId, ok
+}
+
+// loggedUserKey holds where authMiddleware reports the user to
+// loggerMiddleware, which wraps it and cannot see the context it derives.
+type loggedUserKey struct{}
+
+type loggerConfig struct {
+	logger         *log.Logger
+	maxBodyLog     int
+	redactFields   []string
+	trustedProxies []netip.Prefix
+}
+
+var redactedHeaders = []string{"Authorization", "Cookie", "Set-Cookie"}
+
+const redacted = "[REDACTED]"
+
+func loggerMiddleware(lc loggerConfig, logBody bool) middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			requestId := requestIdFrom(r)
+			r.Header.Set(requestIdHeader, requestId)
+			w.Header().Set(requestIdHeader, requestId)
+			logger := lc.logger
+			if logger == nil {
+				logger = log.StandardLogger()
+			}
+			reqLog := logger.WithContext(r.Context()).WithField("request_id", requestId)
+			var userId int
+			r = r.WithContext(context.WithValue(withLogger(r.Context(), reqLog), loggedUserKey{}, &userId))
+			rec := &responseRecorder{ResponseWriter: w}
+			fields := log.Fields{
+				"remote_ip": lc.clientIP(r),
+				"headers":   redactHeaders(r.Header),
+			}
+			if logBody && r.Body != nil && r.Body != http.NoBody {
+				rBody, err := io.ReadAll(r.Body)
+				r.Body.Close()
+				r.Body = io.NopCloser(bytes.NewReader(rBody))
+				r.ContentLength = int64(len(rBody))
+				fields["body"] = lc.formatBody(r.Header.Get("Content-Type"), rBody)
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(err, &maxBytesErr) {
+					rec.WriteHeader(http.StatusRequestEntityTooLarge)
+				} else if err != nil {
+					reqLog.Warn(err)
+				}
+			}
+			if rec.status == 0 {
+				next(rec, r)
+			}
+			if userId != 0 {
+				fields["user_id"] = strconv.Itoa(userId)
+			}
+			fields["status"] = rec.Status()
+			fields["bytes"] = rec.bytes
+			fields["latency_ms"] = float64(time.Since(start).Microseconds()) / 1000
+			entry := reqLog.WithFields(fields)
+			msg := fmt.Sprintf("%s %s", r.Method, r.URL.String())
+			if rec.Status() >= http.StatusInternalServerError {
+				entry.Error(msg)
+			} else {
+				entry.Info(msg)
 			}
-			w.WriteHeader(http.StatusUnauthorized)
-			return
 		}
-		userId := claims["sub"]
-		expiresAt := int64(claims["exp"].(float64))
-		if expiresAt < time.Now().UTC().Unix() {
-			if isOpt {
-				next(w, r)
+	}
+}
+
+func metricsMiddleware(route string) middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := &responseRecorder{ResponseWriter: w}
+			next(rec, r)
+			status := strconv.Itoa(rec.Status())
+			metrics.HttpRequests.WithLabelValues(route, status).Inc()
+			metrics.HttpDuration.WithLabelValues(route, status).Observe(time.Since(start).Seconds())
+		}
+	}
+}
+
+func tracingMiddleware(route string) middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			ctx, span := tracing.Tracer.Start(ctx, route,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					semconv.HTTPRequestMethodKey.String(r.Method),
+					semconv.HTTPRoute(route),
+				))
+			defer span.End()
+			rec := &responseRecorder{ResponseWriter: w}
+			next(rec, r.WithContext(ctx))
+			span.SetAttributes(semconv.HTTPResponseStatusCode(rec.Status()))
+			if rec.Status() >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(rec.Status()))
+			}
+		}
+	}
+}
+
+type loggerKey struct{}
+
+func withLogger(ctx context.Context, entry *log.Entry) context.Context {
+	return context.WithValue(ctx, loggerKey{}, entry)
+}
+
+// loggerFrom returns the request scoped logger set up by loggerMiddleware,
+// falling back to the standard logger.
+func loggerFrom(ctx context.Context) *log.Entry {
+	if entry, ok := ctx.Value(loggerKey{}).(*log.Entry); ok {
+		return entry
+	}
+	return log.WithContext(ctx)
+}
+
+func bodyLimitMiddleware(limit int64) middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > limit {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
 				return
 			}
-			w.WriteHeader(http.StatusUnauthorized)
-			return
+			if r.Body != nil {
+				r.Body = http.MaxBytesReader(w, r.Body, limit)
+			}
+			next(w, r)
 		}
-		r.Header.Add("userid", fmt.Sprint(userId))
-		next(w, r)
 	}
 }
 
-func loggerMiddleware(next func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var b bytes.Buffer
-		tee := io.TeeReader(r.Body, &b)
-		rBody, err := io.ReadAll(tee)
-		copiedBody := io.NopCloser(&b)
-		r.Body = copiedBody
-		r.ContentLength = int64(b.Len())
+func redactHeaders(h http.Header) map[string]string {
+	out := make(map[string]string, len(h))
+	for k, v := range h {
+		if slices.Contains(redactedHeaders, http.CanonicalHeaderKey(k)) {
+			out[k] = redacted
+			continue
+		}
+		out[k] = strings.Join(v, ", ")
+	}
+	return out
+}
+
+func (lc loggerConfig) formatBody(contentType string, body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	var out string
+	switch {
+	// handlers decode JSON whatever the declared type, so any body that
+	// parses as JSON is redacted as JSON
+	case mediaType == "application/json" || json.Valid(body):
+		var v any
+		if err := json.Unmarshal(body, &v); err != nil {
+			return fmt.Sprintf("[invalid json, %d bytes]", len(body))
+		}
+		content, err := json.Marshal(lc.redactJSON(v))
 		if err != nil {
-			log.Warn(err)
+			return fmt.Sprintf("[invalid json, %d bytes]", len(body))
+		}
+		out = string(content)
+	case mediaType == "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return fmt.Sprintf("[invalid form, %d bytes]", len(body))
+		}
+		for k := range values {
+			if lc.isRedacted(k) {
+				values[k] = []string{redacted}
+			}
+		}
+		out = values.Encode()
+	case strings.HasPrefix(mediaType, "text/"):
+		out = string(body)
+	default:
+		if mediaType == "" {
+			mediaType = "unknown"
 		}
-		log.WithFields(log.Fields{
-			"body": string(rBody),
-		}).Info(fmt.Sprintf("%s %s", r.Method, r.URL.String()))
-		next(w, r)
+		return fmt.Sprintf("[%s, %d bytes]", mediaType, len(body))
 	}
+	if len(out) > lc.maxBodyLog {
+		out = out[:lc.maxBodyLog] + "...(truncated)"
+	}
+	return out
+}
+
+func (lc loggerConfig) redactJSON(v any) any {
+	switch val := v.(type) {
+	case map[string]any:
+		for k, field := range val {
+			if lc.isRedacted(k) {
+				val[k] = redacted
+			} else {
+				val[k] = lc.redactJSON(field)
+			}
+		}
+	case []any:
+		for i, item := range val {
+			val[i] = lc.redactJSON(item)
+		}
+	}
+	return v
+}
+
+func (lc loggerConfig) isRedacted(field string) bool {
+	return slices.ContainsFunc(lc.redactFields, func(f string) bool {
+		return strings.EqualFold(f, field)
+	})
 }
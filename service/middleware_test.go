@@ -1,17 +1,35 @@
 package service
 
 import (
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
+	"vk-feed/metrics"
+	"vk-feed/tracing"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	nooptrace "go.opentelemetry.io/otel/trace/noop"
 )
 
 var d deps = deps{jwtSecret: []byte("some-jwt-secret")}
 
+var defaultLoggerConfig = loggerConfig{
+	maxBodyLog:   2048,
+	redactFields: []string{"password", "pass", "token", "secret"},
+}
+
 func mockFunc(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
@@ -31,50 +49,220 @@ func TestAuthMiddleware(t *testing.T) {
 		"exp": time.Now().UTC().Add(time.Hour * -1).Unix(),
 	}).SignedString(d.jwtSecret)
 
+	// serve runs the middleware and returns the user id the handler sees
+	serve := func(isOpt bool, req *http.Request) (*httptest.ResponseRecorder, int) {
+		var userId int
+		rr := httptest.NewRecorder()
+		authMiddleware(d, isOpt)(func(w http.ResponseWriter, r *http.Request) {
+			userId, _ = userIdFrom(r.Context())
+			w.WriteHeader(http.StatusOK)
+		})(rr, req)
+		return rr, userId
+	}
+
 	t.Run("OK if mandatory", func(t *testing.T) {
 		req := httptest.NewRequest("POST", "/signup", nil)
 		req.Header.Set("Authorization", "Bearer "+token)
-		rr := httptest.NewRecorder()
-		authMiddleware(d, mockFunc, false)(rr, req)
+		rr, userId := serve(false, req)
 		assert.Equal(t, 200, rr.Code)
-		assert.Equal(t, "1", req.Header.Get("userid"))
+		assert.Equal(t, 1, userId)
 	})
 	t.Run("OK if optional", func(t *testing.T) {
 		req := httptest.NewRequest("POST", "/signup", nil)
 		req.Header.Set("Authorization", "Bearer "+token)
-		rr := httptest.NewRecorder()
-		authMiddleware(d, mockFunc, true)(rr, req)
+		rr, userId := serve(true, req)
 		assert.Equal(t, 200, rr.Code)
-		assert.Equal(t, "1", req.Header.Get("userid"))
+		assert.Equal(t, 1, userId)
 	})
 	t.Run("Wrong token", func(t *testing.T) {
 		req := httptest.NewRequest("POST", "/signup", nil)
 		req.Header.Set("Authorization", "Bearer "+wrongToken)
-		rr := httptest.NewRecorder()
-		authMiddleware(d, mockFunc, false)(rr, req)
+		rr, _ := serve(false, req)
 		assert.Equal(t, 401, rr.Code)
 	})
 	t.Run("Wrong token, but it's optional so OK", func(t *testing.T) {
 		req := httptest.NewRequest("POST", "/signup", nil)
 		req.Header.Set("Authorization", "Bearer "+wrongToken)
-		rr := httptest.NewRecorder()
-		authMiddleware(d, mockFunc, true)(rr, req)
+		rr, userId := serve(true, req)
 		assert.Equal(t, 200, rr.Code)
-		assert.Equal(t, "", req.Header.Get("userid"))
+		assert.Equal(t, 0, userId)
 	})
 	t.Run("Expired token", func(t *testing.T) {
 		req := httptest.NewRequest("POST", "/signup", nil)
 		req.Header.Set("Authorization", "Bearer "+expiredToken)
-		rr := httptest.NewRecorder()
-		authMiddleware(d, mockFunc, false)(rr, req)
+		rr, _ := serve(false, req)
 		assert.Equal(t, 401, rr.Code)
 	})
 	t.Run("Expired token, but it's optional so OK", func(t *testing.T) {
 		req := httptest.NewRequest("POST", "/signup", nil)
 		req.Header.Set("Authorization", "Bearer "+expiredToken)
+		rr, userId := serve(true, req)
+		assert.Equal(t, 200, rr.Code)
+		assert.Equal(t, 0, userId)
+	})
+	t.Run("Spoofed userid header", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/ads", nil)
+		req.Header.Set("userid", "2")
+		_, userId := serve(true, req)
+		assert.Equal(t, 0, userId)
+
+		req = httptest.NewRequest("GET", "/ads", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("userid", "2")
+		_, userId = serve(true, req)
+		assert.Equal(t, 1, userId)
+	})
+}
+
+func TestLoggerMiddleware(t *testing.T) {
+	hook := test.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	echoFunc := func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+	}
+
+	t.Run("Secrets are redacted", func(t *testing.T) {
+		hook.Reset()
+		body := `{"name":"mock_name","password":"mock_password","nested":{"token":"mock_token"}}`
+		req := httptest.NewRequest("POST", "/signup", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer mock_token")
+		rr := httptest.NewRecorder()
+		loggerMiddleware(defaultLoggerConfig, true)(echoFunc)(rr, req)
+		assert.Equal(t, 200, rr.Code)
+		assert.Equal(t, body, rr.Body.String(), "handler must still see the original body")
+		entry := hook.LastEntry()
+		assert.NotNil(t, entry)
+		logged := entry.Data["body"].(string)
+		assert.NotContains(t, logged, "mock_password")
+		assert.NotContains(t, logged, "mock_token")
+		assert.Contains(t, logged, "mock_name")
+		assert.Equal(t, redacted, entry.Data["headers"].(map[string]string)["Authorization"])
+	})
+	t.Run("Secrets are redacted whatever the content type", func(t *testing.T) {
+		for _, contentType := range []string{"text/plain", "application/x-www-form-urlencoded", "application/octet-stream"} {
+			hook.Reset()
+			body := `{"name":"mock_name","password":"mock_password"}`
+			req := httptest.NewRequest("POST", "/signup", strings.NewReader(body))
+			req.Header.Set("Content-Type", contentType)
+			rr := httptest.NewRecorder()
+			loggerMiddleware(defaultLoggerConfig, true)(echoFunc)(rr, req)
+			assert.Equal(t, body, rr.Body.String())
+			logged := hook.LastEntry().Data["body"].(string)
+			assert.NotContains(t, logged, "mock_password", contentType)
+			assert.Contains(t, logged, "mock_name", contentType)
+		}
+	})
+	t.Run("Body is truncated", func(t *testing.T) {
+		hook.Reset()
+		lc := loggerConfig{maxBodyLog: 10}
+		req := httptest.NewRequest("POST", "/ads", strings.NewReader(strings.Repeat("a", 100)))
+		req.Header.Set("Content-Type", "text/plain")
+		rr := httptest.NewRecorder()
+		loggerMiddleware(lc, true)(echoFunc)(rr, req)
+		assert.Equal(t, strings.Repeat("a", 100), rr.Body.String())
+		assert.Equal(t, strings.Repeat("a", 10)+"...(truncated)", hook.LastEntry().Data["body"])
+	})
+	t.Run("Binary body is not logged", func(t *testing.T) {
+		hook.Reset()
+		req := httptest.NewRequest("POST", "/ads", strings.NewReader("\x89PNG"))
+		req.Header.Set("Content-Type", "image/png")
 		rr := httptest.NewRecorder()
-		authMiddleware(d, mockFunc, true)(rr, req)
+		loggerMiddleware(defaultLoggerConfig, true)(echoFunc)(rr, req)
+		assert.Equal(t, "[image/png, 4 bytes]", hook.LastEntry().Data["body"])
+	})
+	t.Run("Body logging disabled", func(t *testing.T) {
+		hook.Reset()
+		req := httptest.NewRequest("POST", "/signin", strings.NewReader(`{"password":"mock_password"}`))
+		rr := httptest.NewRecorder()
+		loggerMiddleware(defaultLoggerConfig, false)(echoFunc)(rr, req)
+		assert.Equal(t, `{"password":"mock_password"}`, rr.Body.String())
+		_, ok := hook.LastEntry().Data["body"]
+		assert.False(t, ok)
+	})
+}
+
+func TestBodyLimitMiddleware(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/ads", strings.NewReader("aaaa"))
+		rr := httptest.NewRecorder()
+		bodyLimitMiddleware(4)(mockFunc)(rr, req)
 		assert.Equal(t, 200, rr.Code)
-		assert.Equal(t, "", req.Header.Get("userid"))
 	})
+	t.Run("Content-Length too big", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/ads", strings.NewReader("aaaaa"))
+		rr := httptest.NewRecorder()
+		bodyLimitMiddleware(4)(mockFunc)(rr, req)
+		assert.Equal(t, 413, rr.Code)
+	})
+	t.Run("Unknown length body too big", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/signup", io.NopCloser(strings.NewReader(`{"password":"mock_password"}`)))
+		req.ContentLength = -1
+		rr := httptest.NewRecorder()
+		chain(mockFunc,
+			bodyLimitMiddleware(4),
+			loggerMiddleware(defaultLoggerConfig, true),
+		)(rr, req)
+		assert.Equal(t, 413, rr.Code)
+	})
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	before := testutil.ToFloat64(metrics.HttpRequests.WithLabelValues("GET /mock", "418"))
+	req := httptest.NewRequest("GET", "/mock", nil)
+	rr := httptest.NewRecorder()
+	metricsMiddleware("GET /mock")(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})(rr, req)
+	assert.Equal(t, 418, rr.Code)
+	assert.Equal(t, before+1, testutil.ToFloat64(metrics.HttpRequests.WithLabelValues("GET /mock", "418")))
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTracerProvider(nooptrace.NewTracerProvider())
+	hook := test.NewGlobal()
+	log.AddHook(tracing.LogHook{})
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	req := httptest.NewRequest("GET", "/ads", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rr := httptest.NewRecorder()
+	failingFunc := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	chain(failingFunc,
+		tracingMiddleware("GET /ads"),
+		loggerMiddleware(defaultLoggerConfig, false),
+	)(rr, req)
+
+	spans := sr.Ended()
+	assert.Len(t, spans, 1)
+	assert.Equal(t, "GET /ads", spans[0].Name())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[0].SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", spans[0].Parent().SpanID().String())
+	assert.Equal(t, codes.Error, spans[0].Status().Code)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", hook.LastEntry().Data["trace_id"])
+}
+
+func TestChain(t *testing.T) {
+	var calls []string
+	mw := func(name string) middleware {
+		return func(next http.HandlerFunc) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				calls = append(calls, name)
+				next(w, r)
+			}
+		}
+	}
+	req := httptest.NewRequest("GET", "/ads", nil)
+	rr := httptest.NewRecorder()
+	chain(mockFunc, mw("outer"), mw("inner"))(rr, req)
+	assert.Equal(t, []string{"outer", "inner"}, calls)
+	assert.Equal(t, 200, rr.Code)
 }
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"vk-feed/types"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+)
+
+func newSpecHandler(spec []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/yaml")
+		w.WriteHeader(http.StatusOK)
+		w.Write(spec)
+	}
+}
+
+// validationMiddleware checks JSON request bodies against the operation
+// the route is documented by. Query parameters are not checked since the
+// feed falls back to defaults on invalid values. The body is treated as
+// JSON whatever Content-Type the client sends, the same way the handlers
+// do.
+func validationMiddleware(doc *openapi3.T, method, path string) (middleware, error) {
+	pathItem := doc.Paths.Find(path)
+	if pathItem == nil {
+		return nil, fmt.Errorf("openapi: path %s is not documented", path)
+	}
+	op := pathItem.GetOperation(method)
+	if op == nil {
+		return nil, fmt.Errorf("openapi: operation %s %s is not documented", method, path)
+	}
+	route := &routers.Route{Spec: doc, Path: path, PathItem: pathItem, Method: method, Operation: op}
+	options := &openapi3filter.Options{SkipSettingDefaults: true}
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		if op.RequestBody == nil || op.RequestBody.Value == nil || op.RequestBody.Value.Content.Get("application/json") == nil {
+			return next
+		}
+		return func(w http.ResponseWriter, r *http.Request) {
+			content, err := io.ReadAll(r.Body)
+			if err != nil {
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(err, &maxBytesErr) {
+					w.WriteHeader(http.StatusRequestEntityTooLarge)
+					return
+				}
+				loggerFrom(r.Context()).Error(err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(content))
+
+			vr := r.Clone(r.Context())
+			vr.Header.Set("Content-Type", "application/json")
+			vr.Body = io.NopCloser(bytes.NewReader(content))
+			vr.GetBody = nil
+			input := &openapi3filter.RequestValidationInput{Request: vr, Route: route, Options: options}
+			if err := openapi3filter.ValidateRequestBody(r.Context(), input, op.RequestBody.Value); err != nil {
+				writeApiError(w, r, http.StatusBadRequest, types.ApiError{Code: types.API_ERROR_INVALID_BODY, Message: validationMessage(err)})
+				return
+			}
+			next(w, r)
+		}
+	}, nil
+}
+
+// validationMessage keeps only the failing field and the reason, without
+// the schema and value dump kin-openapi appends by default.
+func validationMessage(err error) string {
+	var schemaErr *openapi3.SchemaError
+	if errors.As(err, &schemaErr) && schemaErr.Reason != "" {
+		return fmt.Sprintf("request body: /%s: %s", strings.Join(schemaErr.JSONPointer(), "/"), schemaErr.Reason)
+	}
+	var reqErr *openapi3filter.RequestError
+	if errors.As(err, &reqErr) && reqErr.Err != nil {
+		return fmt.Sprintf("request body: %s", reqErr.Err.Error())
+	}
+	return err.Error()
+}
@@ -0,0 +1,319 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"vk-feed/config"
+	"vk-feed/types"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// strictParams tells whether the feed query is parsed strictly: the
+// Prefer header (RFC 7240) handling=strict or handling=lenient wins over the
+// configured default.
+func strictParams(r *http.Request, fc config.Feed) bool {
+	for _, value := range r.Header.Values("Prefer") {
+		for _, pref := range strings.Split(value, ",") {
+			switch strings.ToLower(strings.TrimSpace(pref)) {
+			case "handling=strict":
+				return true
+			case "handling=lenient":
+				return false
+			}
+		}
+	}
+	return fc.StrictParams
+}
+
+func defaultParams(fc config.Feed) types.GetAdParams {
+	return types.GetAdParams{
+		PageSize: fc.PageSize,
+		MinPrice: fc.MinPrice,
+		MaxPrice: fc.MaxPrice,
+		SortBy:   types.SORT_BY_DATE,
+		OrderBy:  types.ORDER_BY_ASC,
+	}
+}
+
+// maxRadiusKm is the tag limit of types.GetAdParams.RadiusKm, about half
+// of the equator.
+const maxRadiusKm = 20000
+
+// parseFloat rejects NaN and infinities along with what ParseFloat does.
+func parseFloat(raw string) (float64, error) {
+	f, err := strconv.ParseFloat(raw, 64)
+	if err == nil && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		return 0, errors.New("not a finite number")
+	}
+	return f, err
+}
+
+// parseTime accepts RFC 3339 date-times and plain dates, taken as UTC
+// midnight.
+func parseTime(raw string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, raw)
+	if err != nil {
+		t, err = time.Parse(time.DateOnly, raw)
+	}
+	return t.UTC(), err
+}
+
+// parseLenientParams never fails: unknown values, an invalid sort_by list
+// as a whole, fall back to the defaults and prices are clamped to the
+// allowed range. The own ads filters are ignored for anonymous requests and
+// when they contradict each other, the point unless both lat and lon are
+// valid and radius_km without the point.
+func parseLenientParams(q url.Values, fc config.Feed, authenticated bool) types.GetAdParams {
+	params := defaultParams(fc)
+	if q.Get("order_by") == string(types.ORDER_BY_DESC) {
+		params.OrderBy = types.ORDER_BY_DESC
+	}
+	if maxPrice, err := strconv.Atoi(q.Get("max_price")); err == nil {
+		params.MaxPrice = min(max(maxPrice, fc.MinPrice), fc.MaxPrice)
+	}
+	if minPrice, err := strconv.Atoi(q.Get("min_price")); err == nil {
+		params.MinPrice = min(max(minPrice, fc.MinPrice), fc.MaxPrice)
+	}
+	if page, err := strconv.Atoi(q.Get("page")); err == nil {
+		params.Page = min(max(page, 0), params.MaxPage())
+	}
+	if t, err := parseTime(q.Get("created_after")); err == nil {
+		params.CreatedAfter = t
+	}
+	if t, err := parseTime(q.Get("created_before")); err == nil {
+		params.CreatedBefore = t
+	}
+	if authorId, err := strconv.Atoi(q.Get("author_id")); err == nil && authorId > 0 {
+		params.AuthorId = authorId
+	}
+	if hasImage, err := strconv.ParseBool(q.Get("has_image")); err == nil {
+		params.HasImage = types.IMAGE_WITHOUT
+		if hasImage {
+			params.HasImage = types.IMAGE_WITH
+		}
+	}
+	lat, latErr := parseFloat(q.Get("lat"))
+	lon, lonErr := parseFloat(q.Get("lon"))
+	if latErr == nil && lonErr == nil && math.Abs(lat) <= 90 && math.Abs(lon) <= 180 {
+		params.Lat, params.Lon, params.Near = lat, lon, true
+		if radius, err := parseFloat(q.Get("radius_km")); err == nil && radius > 0 {
+			params.RadiusKm = min(radius, maxRadiusKm)
+		}
+	}
+	onlyMine, _ := strconv.ParseBool(q.Get("only_mine"))
+	excludeMine, _ := strconv.ParseBool(q.Get("exclude_mine"))
+	if authenticated && onlyMine != excludeMine {
+		params.OnlyMine, params.ExcludeMine = onlyMine, excludeMine
+	}
+	// distance is only a valid key with the point
+	if raw := q.Get("sort_by"); raw != "" {
+		sorted := params
+		sorted.SortBy = types.SORT_BY(raw)
+		if _, err := sorted.SortKeys(); err == nil {
+			params.SortBy = sorted.SortBy
+		}
+	}
+	return params
+}
+
+// parseStrictParams returns an error for every parameter that is present
+// but invalid, absent ones take the defaults.
+func parseStrictParams(q url.Values, fc config.Feed, valid *validator.Validate, authenticated bool) (types.GetAdParams, []types.ApiFieldError) {
+	params := defaultParams(fc)
+	errs := map[string]string{}
+	ints := map[string]*int{"page": &params.Page, "min_price": &params.MinPrice, "max_price": &params.MaxPrice, "author_id": &params.AuthorId}
+	for name, field := range ints {
+		if raw := q.Get(name); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil {
+				errs[name] = "must be an integer"
+				continue
+			}
+			*field = n
+		}
+	}
+	times := map[string]*time.Time{"created_after": &params.CreatedAfter, "created_before": &params.CreatedBefore}
+	for name, field := range times {
+		if raw := q.Get(name); raw != "" {
+			t, err := parseTime(raw)
+			if err != nil {
+				errs[name] = "must be an RFC 3339 date-time or a date"
+				continue
+			}
+			*field = t
+		}
+	}
+	bools := map[string]*bool{"only_mine": &params.OnlyMine, "exclude_mine": &params.ExcludeMine}
+	for name, field := range bools {
+		if raw := q.Get(name); raw != "" {
+			b, err := strconv.ParseBool(raw)
+			if err != nil {
+				errs[name] = "must be true or false"
+				continue
+			}
+			if b && !authenticated {
+				errs[name] = "requires authorization"
+				continue
+			}
+			*field = b
+		}
+	}
+	floats := map[string]*float64{"lat": &params.Lat, "lon": &params.Lon, "radius_km": &params.RadiusKm}
+	for name, field := range floats {
+		if raw := q.Get(name); raw != "" {
+			f, err := parseFloat(raw)
+			if err != nil {
+				errs[name] = "must be a number"
+				continue
+			}
+			*field = f
+		}
+	}
+	switch hasLat, hasLon := q.Get("lat") != "", q.Get("lon") != ""; {
+	case hasLat && hasLon:
+		params.Near = true
+	case hasLat:
+		errs["lon"] = "is required with lat"
+	case hasLon:
+		errs["lat"] = "is required with lon"
+	case q.Get("radius_km") != "":
+		errs["radius_km"] = "requires lat and lon"
+	}
+	if raw := q.Get("has_image"); raw != "" {
+		if b, err := strconv.ParseBool(raw); err != nil {
+			errs["has_image"] = "must be true or false"
+		} else {
+			params.HasImage = types.IMAGE_FILTER(strconv.FormatBool(b))
+		}
+	}
+	if raw := q.Get("sort_by"); raw != "" {
+		params.SortBy = types.SORT_BY(raw)
+	}
+	if raw := q.Get("order_by"); raw != "" {
+		params.OrderBy = types.ORDER_BY(raw)
+	}
+
+	var validationErrs validator.ValidationErrors
+	if err := valid.Struct(params); errors.As(err, &validationErrs) {
+		for _, fe := range validationErrs {
+			name := queryName(fe.StructField())
+			if _, ok := errs[name]; !ok {
+				errs[name] = fieldErrorMessage(fe)
+			}
+		}
+	}
+	if _, ok := errs["sort_by"]; !ok {
+		sorted := params
+		if _, ok := errs["order_by"]; ok {
+			// a bad order_by is reported on its own
+			sorted.OrderBy = types.ORDER_BY_ASC
+		}
+		if _, err := sorted.SortKeys(); err != nil {
+			errs["sort_by"] = err.Error()
+		}
+	}
+	if _, ok := errs["page"]; !ok && params.Page > params.MaxPage() {
+		errs["page"] = fmt.Sprintf("must be at most %d", params.MaxPage())
+	}
+	for _, name := range []string{"min_price", "max_price"} {
+		price := params.MinPrice
+		if name == "max_price" {
+			price = params.MaxPrice
+		}
+		if _, ok := errs[name]; !ok && (price < fc.MinPrice || price > fc.MaxPrice) {
+			errs[name] = fmt.Sprintf("must be between %d and %d", fc.MinPrice, fc.MaxPrice)
+		}
+	}
+
+	var out []types.ApiFieldError
+	for _, name := range queryNames {
+		if message, ok := errs[name]; ok {
+			out = append(out, types.ApiFieldError{Field: name, Message: message})
+		}
+	}
+	return params, out
+}
+
+// queryNames are the query tags of types.GetAdParams in field order.
+var queryNames = func() []string {
+	var names []string
+	t := reflect.TypeOf(types.GetAdParams{})
+	for i := 0; i < t.NumField(); i++ {
+		if name := t.Field(i).Tag.Get("query"); name != "-" {
+			names = append(names, name)
+		}
+	}
+	return names
+}()
+
+func queryName(field string) string {
+	f, _ := reflect.TypeOf(types.GetAdParams{}).FieldByName(field)
+	return f.Tag.Get("query")
+}
+
+func fieldErrorMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "min":
+		return "must be at least " + fe.Param()
+	case "max":
+		return "must be at most " + fe.Param()
+	case "gt":
+		return "must be greater than " + fe.Param()
+	case "oneof":
+		return "must be one of " + strings.ReplaceAll(fe.Param(), " ", ", ")
+	case "ltefield":
+		return "must not be greater than " + queryName(fe.Param())
+	case "gtfield":
+		return "must be later than " + queryName(fe.Param())
+	case "excluded_with":
+		return "cannot be combined with " + queryName(fe.Param())
+	default:
+		return "is invalid"
+	}
+}
+
+// encodeParams renders the effective parameters as a query string, the
+// filters only when set.
+func encodeParams(params types.GetAdParams) string {
+	q := url.Values{
+		"page":      {strconv.Itoa(params.Page)},
+		"min_price": {strconv.Itoa(params.MinPrice)},
+		"max_price": {strconv.Itoa(params.MaxPrice)},
+		"sort_by":   {string(params.SortBy)},
+		"order_by":  {string(params.OrderBy)},
+	}
+	if !params.CreatedAfter.IsZero() {
+		q.Set("created_after", params.CreatedAfter.Format(time.RFC3339Nano))
+	}
+	if !params.CreatedBefore.IsZero() {
+		q.Set("created_before", params.CreatedBefore.Format(time.RFC3339Nano))
+	}
+	if params.AuthorId != 0 {
+		q.Set("author_id", strconv.Itoa(params.AuthorId))
+	}
+	if params.OnlyMine {
+		q.Set("only_mine", "true")
+	}
+	if params.ExcludeMine {
+		q.Set("exclude_mine", "true")
+	}
+	if params.HasImage != types.IMAGE_ANY {
+		q.Set("has_image", string(params.HasImage))
+	}
+	if params.Near {
+		q.Set("lat", strconv.FormatFloat(params.Lat, 'f', -1, 64))
+		q.Set("lon", strconv.FormatFloat(params.Lon, 'f', -1, 64))
+	}
+	if params.RadiusKm > 0 {
+		q.Set("radius_km", strconv.FormatFloat(params.RadiusKm, 'f', -1, 64))
+	}
+	return q.Encode()
+}
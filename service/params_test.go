@@ -0,0 +1,219 @@
+package service
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+	"vk-feed/config"
+	"vk-feed/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStrictParams(t *testing.T) {
+	lenient, strict := config.Default().Feed, config.Default().Feed
+	strict.StrictParams = true
+	cases := []struct {
+		prefer string
+		fc     config.Feed
+		want   bool
+	}{
+		{"", lenient, false},
+		{"", strict, true},
+		{"handling=strict", lenient, true},
+		{"respond-async, Handling=Strict", lenient, true},
+		{"handling=lenient", strict, false},
+		{"wait=5", strict, true},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/ads", nil)
+		if c.prefer != "" {
+			r.Header.Set("Prefer", c.prefer)
+		}
+		assert.Equal(t, c.want, strictParams(r, c.fc), "%q strict=%v", c.prefer, c.fc.StrictParams)
+	}
+}
+
+func TestParseStrictParams(t *testing.T) {
+	fc := config.Default().Feed
+	t.Run("defaults", func(t *testing.T) {
+		params, errs := parseStrictParams(url.Values{}, fc, valid, true)
+		assert.Empty(t, errs)
+		assert.Equal(t, defaultParams(fc), params)
+	})
+	t.Run("valid", func(t *testing.T) {
+		q, _ := url.ParseQuery("page=2&min_price=100&max_price=100&sort_by=price&order_by=desc")
+		params, errs := parseStrictParams(q, fc, valid, true)
+		assert.Empty(t, errs)
+		assert.Equal(t, types.GetAdParams{Page: 2, PageSize: 10, MinPrice: 100, MaxPrice: 100, SortBy: types.SORT_BY_PRICE, OrderBy: types.ORDER_BY_DESC}, params)
+	})
+	cases := []struct {
+		query string
+		want  []types.ApiFieldError
+	}{
+		{"sort_by=foo&order_by=bar", []types.ApiFieldError{
+			{Field: "sort_by", Message: `unknown sort key "foo", must be one of created_at, price, id, distance`},
+			{Field: "order_by", Message: "must be one of asc, desc"},
+		}},
+		{"sort_by=price&order_by=bar", []types.ApiFieldError{
+			{Field: "order_by", Message: "must be one of asc, desc"},
+		}},
+		{"sort_by=price:up,created_at", []types.ApiFieldError{
+			{Field: "sort_by", Message: `unknown direction "up" of price, must be asc or desc`},
+		}},
+		{"sort_by=price,id,price:desc", []types.ApiFieldError{
+			{Field: "sort_by", Message: "sort key price is repeated"},
+		}},
+		{"page=-1&max_price=abc", []types.ApiFieldError{
+			{Field: "page", Message: "must be at least 0"},
+			{Field: "max_price", Message: "must be an integer"},
+		}},
+		{"page=1844674407370955162", []types.ApiFieldError{
+			{Field: "page", Message: "must be at most 214748364"},
+		}},
+		{"page=9223372036854775807", []types.ApiFieldError{
+			{Field: "page", Message: "must be at most 214748364"},
+		}},
+		{"min_price=500&max_price=100", []types.ApiFieldError{
+			{Field: "min_price", Message: "must not be greater than max_price"},
+		}},
+		{"min_price=0&max_price=100000000", []types.ApiFieldError{
+			{Field: "min_price", Message: "must be between 1 and 1000000"},
+			{Field: "max_price", Message: "must be between 1 and 1000000"},
+		}},
+		{"created_after=yesterday&created_before=2024-06-09T25:00:00Z", []types.ApiFieldError{
+			{Field: "created_after", Message: "must be an RFC 3339 date-time or a date"},
+			{Field: "created_before", Message: "must be an RFC 3339 date-time or a date"},
+		}},
+		{"created_after=2024-06-09&created_before=2024-06-09T00:00:00Z", []types.ApiFieldError{
+			{Field: "created_before", Message: "must be later than created_after"},
+		}},
+		{"author_id=-1&has_image=maybe", []types.ApiFieldError{
+			{Field: "author_id", Message: "must be at least 1"},
+			{Field: "has_image", Message: "must be true or false"},
+		}},
+		{"only_mine=true&exclude_mine=1", []types.ApiFieldError{
+			{Field: "exclude_mine", Message: "cannot be combined with only_mine"},
+		}},
+		{"lat=100&lon=east&radius_km=-5", []types.ApiFieldError{
+			{Field: "lat", Message: "must be at most 90"},
+			{Field: "lon", Message: "must be a number"},
+			{Field: "radius_km", Message: "must be greater than 0"},
+		}},
+		{"lat=55.75&radius_km=10", []types.ApiFieldError{
+			{Field: "lon", Message: "is required with lat"},
+		}},
+		{"radius_km=10&sort_by=distance", []types.ApiFieldError{
+			{Field: "sort_by", Message: "sort key distance requires lat and lon"},
+			{Field: "radius_km", Message: "requires lat and lon"},
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.query, func(t *testing.T) {
+			q, _ := url.ParseQuery(c.query)
+			_, errs := parseStrictParams(q, fc, valid, true)
+			assert.Equal(t, c.want, errs)
+		})
+	}
+}
+
+func TestParseLenientPage(t *testing.T) {
+	fc := config.Default().Feed
+	for raw, page := range map[string]int{"-1": 0, "3": 3, "214748364": 214748364, "1844674407370955162": 214748364, "9223372036854775807": 214748364} {
+		q := url.Values{"page": {raw}}
+		params := parseLenientParams(q, fc, false)
+		assert.Equal(t, page, params.Page, raw)
+		assert.LessOrEqual(t, params.Page*params.PageSize, types.MaxOffset, raw)
+	}
+}
+
+func TestParseFilters(t *testing.T) {
+	fc := config.Default().Feed
+	q, _ := url.ParseQuery("created_after=2024-06-09&created_before=2024-06-10T12:30:00%2B03:00&author_id=7&has_image=false&exclude_mine=true")
+	want := defaultParams(fc)
+	want.CreatedAfter = time.Date(2024, 6, 9, 0, 0, 0, 0, time.UTC)
+	want.CreatedBefore = time.Date(2024, 6, 10, 9, 30, 0, 0, time.UTC)
+	want.AuthorId = 7
+	want.HasImage = types.IMAGE_WITHOUT
+	want.ExcludeMine = true
+
+	params, errs := parseStrictParams(q, fc, valid, true)
+	assert.Empty(t, errs)
+	assert.Equal(t, want, params)
+	assert.Equal(t, want, parseLenientParams(q, fc, true))
+
+	t.Run("anonymous", func(t *testing.T) {
+		q, _ := url.ParseQuery("only_mine=true&exclude_mine=false")
+		_, errs := parseStrictParams(q, fc, valid, false)
+		assert.Equal(t, []types.ApiFieldError{{Field: "only_mine", Message: "requires authorization"}}, errs)
+		assert.Equal(t, defaultParams(fc), parseLenientParams(q, fc, false), "ignored when lenient")
+	})
+	t.Run("lenient", func(t *testing.T) {
+		q, _ := url.ParseQuery("created_after=yesterday&author_id=-1&has_image=maybe&only_mine=true&exclude_mine=true")
+		assert.Equal(t, defaultParams(fc), parseLenientParams(q, fc, true))
+	})
+}
+
+func TestParseSort(t *testing.T) {
+	fc := config.Default().Feed
+	q, _ := url.ParseQuery("sort_by=price:asc,created_at&order_by=desc")
+	want := defaultParams(fc)
+	want.SortBy = "price:asc,created_at"
+	want.OrderBy = types.ORDER_BY_DESC
+
+	params, errs := parseStrictParams(q, fc, valid, false)
+	assert.Empty(t, errs)
+	assert.Equal(t, want, params)
+	assert.Equal(t, want, parseLenientParams(q, fc, false))
+
+	t.Run("lenient", func(t *testing.T) {
+		q, _ := url.ParseQuery("sort_by=price,monke&order_by=desc")
+		want := defaultParams(fc)
+		want.OrderBy = types.ORDER_BY_DESC
+		assert.Equal(t, want, parseLenientParams(q, fc, false), "the whole list falls back")
+	})
+}
+
+func TestParseLocation(t *testing.T) {
+	fc := config.Default().Feed
+	q, _ := url.ParseQuery("lat=55.7558&lon=37.6173&radius_km=25.5&sort_by=distance")
+	want := defaultParams(fc)
+	want.Lat, want.Lon, want.Near = 55.7558, 37.6173, true
+	want.RadiusKm = 25.5
+	want.SortBy = types.SORT_BY_DISTANCE
+
+	params, errs := parseStrictParams(q, fc, valid, false)
+	assert.Empty(t, errs)
+	assert.Equal(t, want, params)
+	assert.Equal(t, want, parseLenientParams(q, fc, false))
+
+	t.Run("equator", func(t *testing.T) {
+		q, _ := url.ParseQuery("lat=0&lon=0")
+		params, errs := parseStrictParams(q, fc, valid, false)
+		assert.Empty(t, errs)
+		assert.True(t, params.Near)
+	})
+	t.Run("lenient", func(t *testing.T) {
+		q, _ := url.ParseQuery("lat=NaN&lon=37.6&radius_km=10&sort_by=distance")
+		assert.Equal(t, defaultParams(fc), parseLenientParams(q, fc, false), "no point, no radius nor distance")
+		q, _ = url.ParseQuery("lat=55.7&lon=37.6&radius_km=1e9")
+		assert.Equal(t, float64(maxRadiusKm), parseLenientParams(q, fc, false).RadiusKm)
+	})
+}
+
+func TestEncodeParams(t *testing.T) {
+	params := types.GetAdParams{Page: 1, PageSize: 10, MinPrice: 1, MaxPrice: 500, SortBy: types.SORT_BY_PRICE, OrderBy: types.ORDER_BY_DESC}
+	assert.Equal(t, "max_price=500&min_price=1&order_by=desc&page=1&sort_by=price", encodeParams(params))
+	params.CreatedAfter = time.Date(2024, 6, 9, 0, 0, 0, 500, time.UTC)
+	params.AuthorId = 7
+	params.OnlyMine = true
+	params.HasImage = types.IMAGE_WITH
+	params.Lat, params.Lon, params.Near = 0, -70.25, true
+	params.RadiusKm = 12.5
+	assert.Equal(t, "author_id=7&created_after=2024-06-09T00%3A00%3A00.0000005Z&has_image=true&lat=0&lon=-70.25&max_price=500&min_price=1&only_mine=true&order_by=desc&page=1&radius_km=12.5&sort_by=price", encodeParams(params))
+	q, _ := url.ParseQuery(encodeParams(params))
+	parsed, errs := parseStrictParams(q, config.Default().Feed, valid, true)
+	assert.Empty(t, errs)
+	assert.Equal(t, params, parsed, "effective parameters parse back to themselves")
+}
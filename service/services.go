@@ -5,69 +5,276 @@ import (
 	"crypto/sha512"
 	"encoding/base64"
 	"errors"
+	"slices"
+	"sync"
 	"time"
+	"vk-feed/db"
+	imgC "vk-feed/image-checker"
+	"vk-feed/metrics"
+	"vk-feed/tracing"
 	"vk-feed/types"
 
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/jackc/pgx/v4"
 )
 
-var ErrWrongCreds error = errors.New("wrong credentials")
+// userErr reports a missing user, or a write that references one, as
+// ErrUserNotFound.
+func userErr(err error) error {
+	if errors.Is(err, db.ErrNotFound) || errors.Is(err, db.ErrReference) {
+		return ErrUserNotFound
+	}
+	return err
+}
 
-func (d deps) createUser(name, password string) (types.User, error) {
+func hashPassword(password string) string {
 	temp := sha512.Sum512([]byte(password))
-	hashPassword := base64.StdEncoding.EncodeToString(temp[:])
-	id, err := d.client.CreateUser(name, hashPassword)
+	return base64.StdEncoding.EncodeToString(temp[:])
+}
+
+func (d deps) createUser(ctx context.Context, name, password string) (user types.User, err error) {
+	ctx, span := tracing.Tracer.Start(ctx, "service.createUser")
+	defer func() { tracing.EndSpan(span, err) }()
+	id, err := d.client.CreateUser(ctx, name, hashPassword(password))
+	if errors.Is(err, db.ErrConflict) {
+		return types.User{}, ErrUserExists
+	}
 	if err != nil {
 		return types.User{}, err
 	}
+	metrics.Signups.Inc()
 	return types.User{Id: id, Name: name}, nil
 }
 
-func (d deps) signIn(name, password string) (types.Token, error) {
-	id, pass, err := d.client.GetUserByName(name)
+func (d deps) signIn(ctx context.Context, name, password string) (token types.Token, err error) {
+	ctx, span := tracing.Tracer.Start(ctx, "service.signIn")
+	defer func() {
+		tracing.EndSpan(span, err)
+		switch err {
+		case nil:
+			metrics.Signins.WithLabelValues("success").Inc()
+		case ErrWrongCreds:
+			metrics.Signins.WithLabelValues("wrong_credentials").Inc()
+		default:
+			metrics.Signins.WithLabelValues("error").Inc()
+		}
+	}()
+	id, pass, err := d.client.GetUserByName(ctx, name)
 	if err != nil {
-		if err == pgx.ErrNoRows {
+		if err == db.ErrNotFound {
 			return types.Token{}, ErrWrongCreds
 		}
 		return types.Token{}, err
 	}
-	temp := sha512.Sum512([]byte(password))
-	hashPassword := base64.StdEncoding.EncodeToString(temp[:])
-	if pass != hashPassword {
+	if pass != hashPassword(password) {
 		return types.Token{}, ErrWrongCreds
 	}
-	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	// signing in during the grace period keeps the account
+	if err := d.client.CancelUserDeletion(ctx, id); err != nil {
+		return types.Token{}, err
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"sub": id,
-		"exp": time.Now().UTC().Add(time.Hour * 24).Unix(),
+		"exp": time.Now().UTC().Add(d.tokenTTL).Unix(),
 	}).SignedString(d.jwtSecret)
 	if err != nil {
 		return types.Token{}, err
 	}
-	return types.Token{Token: token}, nil
+	return types.Token{Token: signed}, nil
 }
 
-func (d deps) createAd(dto types.AdDto, userId int) (types.Ad, error) {
-	ctx, cancelCtx := context.WithTimeout(context.Background(), time.Second*10)
-	defer cancelCtx()
-	if err := d.ic.Check(ctx, dto.ImageUrl); err != nil {
+func (d deps) createAd(ctx context.Context, dto types.AdDto, userId int) (ad types.Ad, err error) {
+	ctx, span := tracing.Tracer.Start(ctx, "service.createAd")
+	defer func() { tracing.EndSpan(span, err) }()
+	if err = d.checkImage(ctx, dto.ImageUrl); err != nil {
 		return types.Ad{}, err
 	}
-	id, err := d.client.CreateAd(dto, userId)
+	id, err := d.client.CreateAd(ctx, dto, userId)
 	if err != nil {
-		return types.Ad{}, err
+		return types.Ad{}, userErr(err)
 	}
+	d.feed.invalidate()
+	metrics.AdsCreated.Inc()
 	out := types.Ad{
-		Id:       id,
-		Title:    dto.Title,
-		Content:  dto.Content,
-		ImageUrl: dto.ImageUrl,
-		Price:    dto.Price,
+		Id:        id,
+		Title:     dto.Title,
+		Content:   dto.Content,
+		ImageUrl:  dto.ImageUrl,
+		Price:     dto.Price,
+		Latitude:  dto.Latitude,
+		Longitude: dto.Longitude,
+		City:      dto.City,
 	}
 	return out, nil
 }
 
-func (d deps) getAds(userId int, params types.GetAdParams) (res []types.AdFeed, err error) {
-	res, err = d.client.GetAds(userId, params)
-	return
+func (d deps) checkImage(ctx context.Context, url string) error {
+	ctx, cancel := context.WithTimeout(ctx, d.imageTimeout)
+	defer cancel()
+	start := time.Now()
+	err := d.ic.Check(ctx, url)
+	metrics.ImageCheckDuration.Observe(time.Since(start).Seconds())
+	metrics.ImageChecks.WithLabelValues(imageCheckOutcome(err)).Inc()
+	return err
+}
+
+// createAds checks the images concurrently, at most d.bulkParallelism at a
+// time, and inserts the ads that passed. In atomic mode nothing is inserted
+// unless every image passed, and the insert is a single transaction.
+// results[i] describes dtos[i], the Row field is left to the caller.
+func (d deps) createAds(ctx context.Context, dtos []types.AdDto, userId int, atomic bool) (results []types.BulkAdResult, err error) {
+	ctx, span := tracing.Tracer.Start(ctx, "service.createAds")
+	defer func() { tracing.EndSpan(span, err) }()
+
+	checkErrs := make([]error, len(dtos))
+	sem := make(chan struct{}, max(d.bulkParallelism, 1))
+	var wg sync.WaitGroup
+	for i, dto := range dtos {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			checkErrs[i] = d.checkImage(ctx, dto.ImageUrl)
+		}()
+	}
+	wg.Wait()
+
+	results = make([]types.BulkAdResult, len(dtos))
+	allPassed := true
+	for i, checkErr := range checkErrs {
+		switch {
+		case checkErr == nil:
+			continue
+		case slices.Contains([]error{imgC.ErrNotImage, imgC.ErrUrlUnavailable, imgC.ErrImageTooBig}, checkErr):
+			results[i] = types.BulkAdResult{Status: types.BULK_AD_INVALID, Error: checkErr.Error()}
+		default:
+			loggerFrom(ctx).Error(checkErr)
+			results[i] = types.BulkAdResult{Status: types.BULK_AD_FAILED, Error: "image check failed"}
+		}
+		allPassed = false
+	}
+
+	if atomic {
+		if !allPassed {
+			for i := range results {
+				if checkErrs[i] == nil {
+					results[i].Status = types.BULK_AD_SKIPPED
+				}
+			}
+			return results, nil
+		}
+		ids, err := d.client.CreateAds(ctx, dtos, userId)
+		if errors.Is(err, db.ErrInvalid) {
+			// the database does not tell which row it was
+			for i := range results {
+				results[i] = types.BulkAdResult{Status: types.BULK_AD_FAILED, Error: err.Error()}
+			}
+			return results, nil
+		}
+		if err != nil {
+			return nil, userErr(err)
+		}
+		d.feed.invalidate()
+		for i, id := range ids {
+			results[i] = types.BulkAdResult{Status: types.BULK_AD_CREATED, Id: id}
+		}
+		metrics.AdsCreated.Add(float64(len(ids)))
+		return results, nil
+	}
+
+	for i, dto := range dtos {
+		if checkErrs[i] != nil {
+			continue
+		}
+		id, err := d.client.CreateAd(ctx, dto, userId)
+		if errors.Is(err, db.ErrInvalid) {
+			results[i] = types.BulkAdResult{Status: types.BULK_AD_INVALID, Error: err.Error()}
+			continue
+		}
+		if err != nil {
+			loggerFrom(ctx).Error(err)
+			results[i] = types.BulkAdResult{Status: types.BULK_AD_FAILED, Error: "could not be saved"}
+			continue
+		}
+		d.feed.invalidate()
+		metrics.AdsCreated.Inc()
+		results[i] = types.BulkAdResult{Status: types.BULK_AD_CREATED, Id: id}
+	}
+	return results, nil
+}
+
+func imageCheckOutcome(err error) string {
+	switch err {
+	case nil:
+		return "ok"
+	case imgC.ErrNotImage:
+		return "not_image"
+	case imgC.ErrUrlUnavailable:
+		return "url_unavailable"
+	case imgC.ErrImageTooBig:
+		return "too_big"
+	default:
+		return "error"
+	}
+}
+
+// getAds serves anonymous pages from the feed cache, IsYours makes the
+// others differ from user to user.
+func (d deps) getAds(ctx context.Context, userId int, params types.GetAdParams) (res []types.AdFeed, err error) {
+	ctx, span := tracing.Tracer.Start(ctx, "service.getAds")
+	defer func() { tracing.EndSpan(span, err) }()
+	if userId != 0 {
+		return d.client.GetAds(ctx, userId, params)
+	}
+	res, generation, ok := d.feed.get(params)
+	if ok {
+		return res, nil
+	}
+	res, err = d.client.GetAds(ctx, userId, params)
+	if err != nil {
+		return nil, err
+	}
+	d.feed.put(params, generation, res)
+	return res, nil
+}
+
+func (d deps) getUser(ctx context.Context, userId int) (user types.User, err error) {
+	ctx, span := tracing.Tracer.Start(ctx, "service.getUser")
+	defer func() { tracing.EndSpan(span, err) }()
+	user, err = d.client.GetUserById(ctx, userId)
+	if err != nil {
+		return types.User{}, userErr(err)
+	}
+	return user, nil
+}
+
+func (d deps) forEachUserAd(ctx context.Context, userId int, fn func(types.AdFeed) error) (err error) {
+	ctx, span := tracing.Tracer.Start(ctx, "service.forEachUserAd")
+	defer func() { tracing.EndSpan(span, err) }()
+	return d.client.ForEachUserAd(ctx, userId, fn)
+}
+
+// deleteUser checks the password and deletes the account at once or, with
+// a grace period configured, schedules the deletion and returns its time.
+func (d deps) deleteUser(ctx context.Context, userId int, password string) (deleteAt *time.Time, err error) {
+	ctx, span := tracing.Tracer.Start(ctx, "service.deleteUser")
+	defer func() { tracing.EndSpan(span, err) }()
+	pass, err := d.client.GetUserPassword(ctx, userId)
+	if err != nil {
+		return nil, userErr(err)
+	}
+	if pass != hashPassword(password) {
+		return nil, ErrWrongCreds
+	}
+	if d.deletionGrace <= 0 {
+		if err := d.client.DeleteUser(ctx, userId); err != nil {
+			return nil, userErr(err)
+		}
+		d.feed.invalidate()
+		return nil, nil
+	}
+	at := time.Now().UTC().Add(d.deletionGrace).Truncate(time.Second)
+	if err := d.client.ScheduleUserDeletion(ctx, userId, at); err != nil {
+		return nil, userErr(err)
+	}
+	return &at, nil
 }
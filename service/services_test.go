@@ -6,50 +6,109 @@ import (
 	"encoding/base64"
 	"testing"
 	"time"
+	"vk-feed/db"
 	imgC "vk-feed/image-checker"
 	"vk-feed/types"
 
-	"github.com/jackc/pgx/v4"
 	"github.com/stretchr/testify/assert"
 )
 
 type mockDBConnection struct{}
 
-func (m mockDBConnection) CreateUser(name string, password string) (id int, err error) {
+func (m mockDBConnection) CreateUser(ctx context.Context, name string, password string) (id int, err error) {
 	return 1, nil
 }
 
-func (m mockDBConnection) GetUserByName(name string) (int, string, error) {
+func (m mockDBConnection) GetUserByName(ctx context.Context, name string) (int, string, error) {
 	if name == "mock_name" {
 		temp := sha512.Sum512([]byte("mock_password"))
 		hashPassword := base64.StdEncoding.EncodeToString(temp[:])
 		return 1, hashPassword, nil
 	} else {
-		return 0, "", pgx.ErrNoRows
+		return 0, "", db.ErrNotFound
 	}
 }
 
-func (m mockDBConnection) CreateAd(dto types.AdDto, userId int) (id int, err error) {
+func (m mockDBConnection) GetUserById(ctx context.Context, id int) (types.User, error) {
+	if id != 1 {
+		return types.User{}, db.ErrNotFound
+	}
+	return types.User{Id: 1, Name: "mock_name"}, nil
+}
+
+func (m mockDBConnection) GetUserPassword(ctx context.Context, id int) (string, error) {
+	if id != 1 {
+		return "", db.ErrNotFound
+	}
+	temp := sha512.Sum512([]byte("mock_password"))
+	return base64.StdEncoding.EncodeToString(temp[:]), nil
+}
+
+func (m mockDBConnection) DeleteUser(ctx context.Context, id int) error {
+	return nil
+}
+
+func (m mockDBConnection) ScheduleUserDeletion(ctx context.Context, id int, at time.Time) error {
+	return nil
+}
+
+func (m mockDBConnection) CancelUserDeletion(ctx context.Context, id int) error {
+	return nil
+}
+
+func (m mockDBConnection) PurgeUsers(ctx context.Context, before time.Time) (int64, error) {
+	return 0, nil
+}
+
+// errNoAuthor is what inserting an ad of a missing user fails with.
+var errNoAuthor = &db.ConstraintError{Kind: db.ErrReference, Table: "ads", Constraint: "ads_user_id_fkey", Column: "user_id"}
+
+func (m mockDBConnection) CreateAd(ctx context.Context, dto types.AdDto, userId int) (id int, err error) {
 	if userId == 0 {
-		return 0, pgx.ErrNoRows
+		return 0, errNoAuthor
 	} else {
 		return 1, nil
 	}
 }
 
-func (m mockDBConnection) GetAds(userId int, params types.GetAdParams) ([]types.AdFeed, error) {
-	return []types.AdFeed{
-		{
-			Id:        1,
-			Title:     "mock_title",
-			Content:   "mock_content",
-			ImageUrl:  "http://mocksite.com/image.jpg",
-			Price:     6969,
-			CreatedAt: time.Now(),
-			AuthorId:  1,
-			IsYours:   false,
-		},
-	}, nil
+func (m mockDBConnection) CreateAds(ctx context.Context, dtos []types.AdDto, userId int) ([]int, error) {
+	if userId == 0 {
+		return nil, errNoAuthor
+	}
+	ids := make([]int, len(dtos))
+	for i := range ids {
+		ids[i] = i + 1
+	}
+	return ids, nil
+}
+
+func (m mockDBConnection) GetAds(ctx context.Context, userId int, params types.GetAdParams) ([]types.AdFeed, error) {
+	ad := types.AdFeed{
+		Id:        1,
+		Title:     "mock_title",
+		Content:   "mock_content",
+		ImageUrl:  "http://mocksite.com/image.jpg",
+		Price:     6969,
+		CreatedAt: time.Now(),
+		AuthorId:  1,
+		IsYours:   false,
+	}
+	if params.Near {
+		lat, lon, distance := 55.7558, 37.6173, 1.5
+		ad.Latitude, ad.Longitude, ad.City, ad.DistanceKm = &lat, &lon, "Москва", &distance
+	}
+	return []types.AdFeed{ad}, nil
+}
+
+func (m mockDBConnection) ForEachUserAd(ctx context.Context, userId int, fn func(types.AdFeed) error) error {
+	ads, _ := m.GetAds(ctx, userId, types.GetAdParams{})
+	for _, ad := range ads {
+		ad.IsYours = true
+		if err := fn(ad); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 type mockIC struct{}
@@ -64,7 +123,7 @@ func (m mockIC) Check(ctx context.Context, url string) error {
 
 func TestCreateUser(t *testing.T) {
 	d := deps{client: mockDBConnection{}, jwtSecret: []byte("mock_jwt_secret")}
-	user, err := d.createUser("mock_username", "mock_password")
+	user, err := d.createUser(context.Background(), "mock_username", "mock_password")
 	assert.Equal(t, user, types.User{Id: 1, Name: "mock_username"})
 	assert.Equal(t, err, nil)
 }
@@ -72,15 +131,15 @@ func TestCreateUser(t *testing.T) {
 func TestSignin(t *testing.T) {
 	d := deps{client: mockDBConnection{}, jwtSecret: []byte("mock_jwt_secret")}
 	t.Run("OK", func(t *testing.T) {
-		_, err := d.signIn("mock_name", "mock_password")
+		_, err := d.signIn(context.Background(), "mock_name", "mock_password")
 		assert.NoError(t, err)
 	})
 	t.Run("Not found", func(t *testing.T) {
-		_, err := d.signIn("wrong_name", "mock_password")
+		_, err := d.signIn(context.Background(), "wrong_name", "mock_password")
 		assert.Equal(t, ErrWrongCreds, err)
 	})
 	t.Run("Wrong password", func(t *testing.T) {
-		_, err := d.signIn("mock_name", "wrong_password")
+		_, err := d.signIn(context.Background(), "mock_name", "wrong_password")
 		assert.Equal(t, ErrWrongCreds, err)
 	})
 }
@@ -88,20 +147,27 @@ func TestSignin(t *testing.T) {
 func TestCreateAd(t *testing.T) {
 	d := deps{client: mockDBConnection{}, ic: mockIC{}}
 	t.Run("OK", func(t *testing.T) {
+		lat, lon := 55.7558, 37.6173
 		dto := types.AdDto{
-			Title:    "mock_title",
-			Content:  "mock_content",
-			ImageUrl: "OK",
-			Price:    6969,
+			Title:     "mock_title",
+			Content:   "mock_content",
+			ImageUrl:  "OK",
+			Price:     6969,
+			Latitude:  &lat,
+			Longitude: &lon,
+			City:      "Москва",
 		}
 		resAd := types.Ad{
-			Id:       1,
-			Title:    dto.Title,
-			Content:  dto.Content,
-			ImageUrl: dto.ImageUrl,
-			Price:    dto.Price,
+			Id:        1,
+			Title:     dto.Title,
+			Content:   dto.Content,
+			ImageUrl:  dto.ImageUrl,
+			Price:     dto.Price,
+			Latitude:  &lat,
+			Longitude: &lon,
+			City:      "Москва",
 		}
-		ad, err := d.createAd(dto, 1)
+		ad, err := d.createAd(context.Background(), dto, 1)
 		assert.NoError(t, err)
 		assert.Equal(t, resAd, ad)
 	})
@@ -112,7 +178,7 @@ func TestCreateAd(t *testing.T) {
 			ImageUrl: "NOT OK",
 			Price:    6969,
 		}
-		_, err := d.createAd(dto, 1)
+		_, err := d.createAd(context.Background(), dto, 1)
 		assert.Equal(t, imgC.ErrUrlUnavailable, err)
 	})
 	t.Run("Bad user ID", func(t *testing.T) {
@@ -122,9 +188,70 @@ func TestCreateAd(t *testing.T) {
 			ImageUrl: "OK",
 			Price:    6969,
 		}
-		_, err := d.createAd(dto, 0)
-		assert.Equal(t, pgx.ErrNoRows, err)
+		_, err := d.createAd(context.Background(), dto, 0)
+		assert.Equal(t, ErrUserNotFound, err)
 	})
 }
 
-// getAds does not do much, no tests needed
+func TestGetAds(t *testing.T) {
+	conn := db.NewMemoryConnection()
+	d := deps{client: conn, ic: mockIC{}}
+	ctx := context.Background()
+	userId, _ := conn.CreateUser(ctx, "mock_name", "mock_hash")
+	otherId, _ := conn.CreateUser(ctx, "other_name", "mock_hash")
+	for i, price := range []int{300, 100, 200} {
+		dto := types.AdDto{Title: "mock_title", Content: "mock_content", ImageUrl: "OK", Price: price}
+		if i == 1 {
+			_, err := d.createAd(ctx, dto, otherId)
+			assert.NoError(t, err)
+		} else {
+			_, err := d.createAd(ctx, dto, userId)
+			assert.NoError(t, err)
+		}
+	}
+	ads, err := d.getAds(ctx, userId, types.GetAdParams{PageSize: 2, MinPrice: 150, MaxPrice: 1000, SortBy: types.SORT_BY_PRICE, OrderBy: types.ORDER_BY_DESC})
+	assert.NoError(t, err)
+	if assert.Len(t, ads, 2) {
+		assert.Equal(t, 300, ads[0].Price)
+		assert.Equal(t, 200, ads[1].Price)
+		assert.True(t, ads[0].IsYours)
+	}
+}
+
+func TestGetAdsCache(t *testing.T) {
+	conn := db.NewMemoryConnection()
+	d := deps{client: conn, ic: mockIC{}, feed: newFeedCache(time.Minute, 10, 0)}
+	ctx := context.Background()
+	userId, _ := conn.CreateUser(ctx, "mock_name", "mock_hash")
+	params := types.GetAdParams{PageSize: 10, SortBy: types.SORT_BY_DATE, OrderBy: types.ORDER_BY_ASC}
+	dto := types.AdDto{Title: "mock_title", Content: "mock_content", ImageUrl: "OK", Price: 6969}
+
+	ads, err := d.getAds(ctx, 0, params)
+	assert.NoError(t, err)
+	assert.Empty(t, ads)
+	conn.CreateAd(ctx, dto, userId)
+	ads, _ = d.getAds(ctx, 0, params)
+	assert.Empty(t, ads, "anonymous pages are cached")
+	ads, _ = d.getAds(ctx, userId, params)
+	assert.Len(t, ads, 1, "user pages are not")
+
+	_, err = d.createAd(ctx, dto, userId)
+	assert.NoError(t, err)
+	ads, _ = d.getAds(ctx, 0, params)
+	assert.Len(t, ads, 2, "creating an ad invalidates the cache")
+
+	_, err = d.createAds(ctx, []types.AdDto{dto}, userId, true)
+	assert.NoError(t, err)
+	ads, _ = d.getAds(ctx, 0, params)
+	assert.Len(t, ads, 3, "so does a bulk import")
+
+	conn.CreateUser(ctx, "other_name", hashPassword("mock_password"))
+	otherId, _, _ := conn.GetUserByName(ctx, "other_name")
+	d.createAd(ctx, dto, otherId)
+	ads, _ = d.getAds(ctx, 0, params)
+	assert.Len(t, ads, 4)
+	_, err = d.deleteUser(ctx, otherId, "mock_password")
+	assert.NoError(t, err)
+	ads, _ = d.getAds(ctx, 0, params)
+	assert.Len(t, ads, 3, "and deleting an account")
+}
@@ -0,0 +1,48 @@
+package service
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type apiVersion int
+
+const (
+	apiLegacy apiVersion = iota
+	apiV1
+	apiV2
+)
+
+func (v apiVersion) prefix() string {
+	switch v {
+	case apiV1:
+		return "/v1"
+	case apiV2:
+		return "/v2"
+	default:
+		return ""
+	}
+}
+
+// legacyDeprecated is when the unversioned routes were deprecated in favor
+// of /v1.
+var legacyDeprecated = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+
+// deprecationMiddleware marks responses of the unversioned routes as
+// deprecated since legacyDeprecated (RFC 9745), with the date they stop
+// being served (RFC 8594) and a link to the route they are replaced by.
+func deprecationMiddleware(sunset time.Time, successor string) middleware {
+	// a Structured Field Date, e.g. @1688169599
+	deprecation := "@" + strconv.FormatInt(legacyDeprecated.Unix(), 10)
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", deprecation)
+			if !sunset.IsZero() {
+				w.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+			}
+			w.Header().Add("Link", "<"+successor+`>; rel="successor-version"`)
+			next(w, r)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package types
 
 import "time"
 
+// AdFeed is the feed item of API v1. The misspelled image url tag is kept
+// for compatibility with deployed clients, see AdFeedV2.
 type AdFeed struct {
 	Id        int       `json:"id"`
 	Title     string    `json:"title"`
@@ -11,4 +13,29 @@ type AdFeed struct {
 	CreatedAt time.Time `json:"createdAt"`
 	AuthorId  int       `json:"authorId"`
 	IsYours   bool      `json:"isYours"`
+	Latitude  *float64  `json:"latitude,omitempty"`
+	Longitude *float64  `json:"longitude,omitempty"`
+	City      string    `json:"city,omitempty"`
+	// from the lat and lon of the feed query, when both are known
+	DistanceKm *float64 `json:"distanceKm,omitempty"`
+}
+
+type AdFeedV2 struct {
+	Id        int       `json:"id"`
+	Title     string    `json:"title"`
+	Content   string    `json:"content"`
+	ImageUrl  string    `json:"imageUrl"`
+	Price     int       `json:"price"`
+	CreatedAt time.Time `json:"createdAt"`
+	AuthorId  int       `json:"authorId"`
+	IsYours   bool      `json:"isYours"`
+	Latitude  *float64  `json:"latitude,omitempty"`
+	Longitude *float64  `json:"longitude,omitempty"`
+	City      string    `json:"city,omitempty"`
+	// from the lat and lon of the feed query, when both are known
+	DistanceKm *float64 `json:"distanceKm,omitempty"`
+}
+
+func (ad AdFeed) V2() AdFeedV2 {
+	return AdFeedV2(ad)
 }
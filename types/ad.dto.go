@@ -5,4 +5,8 @@ type AdDto struct {
 	Content  string `json:"content" validate:"min=2,max=1000"`
 	ImageUrl string `json:"imageUrl" validate:"url"`
 	Price    int    `json:"price" validate:"min=1,max=1000000"`
+	// the location is optional, but takes both coordinates
+	Latitude  *float64 `json:"latitude,omitempty" validate:"required_with=Longitude,omitempty,min=-90,max=90"`
+	Longitude *float64 `json:"longitude,omitempty" validate:"required_with=Latitude,omitempty,min=-180,max=180"`
+	City      string   `json:"city,omitempty" validate:"max=100"`
 }
@@ -1,9 +1,12 @@
 package types
 
 type Ad struct {
-	Id       int    `json:"id"`
-	Title    string `json:"title"`
-	Content  string `json:"content"`
-	ImageUrl string `json:"imageUrl"`
-	Price    int    `json:"price"`
+	Id        int      `json:"id"`
+	Title     string   `json:"title"`
+	Content   string   `json:"content"`
+	ImageUrl  string   `json:"imageUrl"`
+	Price     int      `json:"price"`
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+	City      string   `json:"city,omitempty"`
 }
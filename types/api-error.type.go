@@ -0,0 +1,27 @@
+package types
+
+type ApiErrorCode string
+
+const (
+	API_ERROR_CONFLICT ApiErrorCode = "conflict"
+	// data passed validation but was rejected by the database
+	API_ERROR_INVALID   ApiErrorCode = "invalid"
+	API_ERROR_NOT_FOUND ApiErrorCode = "not_found"
+	// query parameters rejected in strict mode, see Errors
+	API_ERROR_INVALID_PARAMS ApiErrorCode = "invalid_params"
+	// request body could not be decoded or failed validation, see Errors
+	API_ERROR_INVALID_BODY      ApiErrorCode = "invalid_body"
+	API_ERROR_WRONG_CREDENTIALS ApiErrorCode = "wrong_credentials"
+)
+
+type ApiError struct {
+	Code    ApiErrorCode    `json:"code"`
+	Message string          `json:"message"`
+	Field   string          `json:"field,omitempty"`
+	Errors  []ApiFieldError `json:"errors,omitempty"`
+}
+
+type ApiFieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
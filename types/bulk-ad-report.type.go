@@ -0,0 +1,26 @@
+package types
+
+type BulkAdStatus string
+
+const (
+	BULK_AD_CREATED BulkAdStatus = "created"
+	// row did not pass validation or the image check
+	BULK_AD_INVALID BulkAdStatus = "invalid"
+	// row could not be inserted
+	BULK_AD_FAILED BulkAdStatus = "failed"
+	// row is valid but was not inserted because other rows were not
+	BULK_AD_SKIPPED BulkAdStatus = "skipped"
+)
+
+type BulkAdResult struct {
+	Row    int          `json:"row"`
+	Status BulkAdStatus `json:"status"`
+	Id     int          `json:"id,omitempty"`
+	Error  string       `json:"error,omitempty"`
+}
+
+type BulkAdReport struct {
+	Created int            `json:"created"`
+	Failed  int            `json:"failed"`
+	Results []BulkAdResult `json:"results"`
+}
@@ -0,0 +1,5 @@
+package types
+
+type DeleteAccountDto struct {
+	Password string `json:"password" validate:"min=8,max=16"`
+}
@@ -1,19 +1,114 @@
 package types
 
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
 type SORT_BY string
 
 const SORT_BY_DATE SORT_BY = "created_at"
 const SORT_BY_PRICE SORT_BY = "price"
+const SORT_BY_ID SORT_BY = "id"
+
+// SORT_BY_DISTANCE needs the point of GetAdParams, ads without a location
+// come last either way.
+const SORT_BY_DISTANCE SORT_BY = "distance"
 
 type ORDER_BY string
 
 const ORDER_BY_ASC ORDER_BY = "asc"
 const ORDER_BY_DESC ORDER_BY = "desc"
 
+type IMAGE_FILTER string
+
+const IMAGE_ANY IMAGE_FILTER = ""
+const IMAGE_WITH IMAGE_FILTER = "true"
+const IMAGE_WITHOUT IMAGE_FILTER = "false"
+
+// GetAdParams are the feed query parameters, named in the URL by their
+// query tags. The allowed price range comes from the config and is checked
+// apart from the tags.
 type GetAdParams struct {
-	Page     int
-	MinPrice int
-	MaxPrice int
-	SortBy   SORT_BY
-	OrderBy  ORDER_BY
+	// at most MaxPage, which depends on PageSize and is checked apart
+	Page     int `query:"page" validate:"min=0"`
+	PageSize int `query:"-"`
+	MinPrice int `query:"min_price" validate:"min=0,ltefield=MaxPrice"`
+	MaxPrice int `query:"max_price" validate:"min=0"`
+	// a comma separated list of keys, each optionally followed by its own
+	// direction, see SortKeys
+	SortBy  SORT_BY  `query:"sort_by"`
+	OrderBy ORDER_BY `query:"order_by" validate:"oneof=asc desc"`
+	// zero times leave the range open, both bounds are exclusive
+	CreatedAfter  time.Time `query:"created_after"`
+	CreatedBefore time.Time `query:"created_before" validate:"omitempty,gtfield=CreatedAfter"`
+	// zero means any author
+	AuthorId int `query:"author_id" validate:"omitempty,min=1"`
+	// ads of the user the feed is requested for, see GetAds
+	OnlyMine    bool         `query:"only_mine"`
+	ExcludeMine bool         `query:"exclude_mine" validate:"excluded_with=OnlyMine"`
+	HasImage    IMAGE_FILTER `query:"has_image" validate:"omitempty,oneof=true false"`
+	// the point distances are measured from, Near tells whether it is set
+	// since 0, 0 is a valid one
+	Lat  float64 `query:"lat" validate:"min=-90,max=90"`
+	Lon  float64 `query:"lon" validate:"min=-180,max=180"`
+	Near bool    `query:"-"`
+	// zero means any distance, ads without a location are left out otherwise
+	RadiusKm float64 `query:"radius_km" validate:"omitempty,gt=0,max=20000"`
+}
+
+// MaxOffset bounds Page*PageSize, so the offset fits an int32 whatever the
+// platform or the database.
+const MaxOffset = math.MaxInt32
+
+// MaxPage is the last page whose offset is within MaxOffset.
+func (p GetAdParams) MaxPage() int {
+	return MaxOffset / max(p.PageSize, 1)
+}
+
+// SortKey is a column of the feed order.
+type SortKey struct {
+	By    SORT_BY
+	Order ORDER_BY
+}
+
+// SortKeys parses SortBy, e.g. "price:asc,created_at:desc". Keys without a
+// direction take OrderBy. Unless the order already includes it, id is
+// appended in the direction of the last key, so ties never depend on how
+// the database happens to return rows.
+func (p GetAdParams) SortKeys() ([]SortKey, error) {
+	var keys []SortKey
+	seen := map[SORT_BY]bool{}
+	for _, part := range strings.Split(string(p.SortBy), ",") {
+		by, order, found := strings.Cut(part, ":")
+		key := SortKey{By: SORT_BY(by), Order: ORDER_BY(order)}
+		if !found {
+			key.Order = p.OrderBy
+		}
+		switch key.By {
+		case SORT_BY_DATE, SORT_BY_PRICE, SORT_BY_ID:
+		case SORT_BY_DISTANCE:
+			if !p.Near {
+				return nil, fmt.Errorf("sort key distance requires lat and lon")
+			}
+		default:
+			return nil, fmt.Errorf("unknown sort key %q, must be one of created_at, price, id, distance", by)
+		}
+		switch key.Order {
+		case ORDER_BY_ASC, ORDER_BY_DESC:
+		default:
+			return nil, fmt.Errorf("unknown direction %q of %s, must be asc or desc", key.Order, by)
+		}
+		if seen[key.By] {
+			return nil, fmt.Errorf("sort key %s is repeated", by)
+		}
+		seen[key.By] = true
+		keys = append(keys, key)
+	}
+	if !seen[SORT_BY_ID] {
+		keys = append(keys, SortKey{By: SORT_BY_ID, Order: keys[len(keys)-1].Order})
+	}
+	return keys, nil
 }
@@ -1,6 +1,10 @@
 package types
 
+import "time"
+
 type User struct {
 	Id   int    `json:"id"`
 	Name string `json:"name"`
+	// set while the account is waiting to be purged
+	DeleteAt *time.Time `json:"deleteAt,omitempty"`
 }